@@ -2,38 +2,70 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/bsycorp/keymaster/km/api"
 	"github.com/bsycorp/keymaster/km/server"
-	"github.com/pkg/errors"
 	"log"
 	"os"
 )
 
-func Handler(ctx context.Context, req api.Request) (interface{}, error) {
+// Handler serves raw invokes (an api.Request, as sent by the
+// api.LambdaTransport) and API Gateway proxy events.
+func Handler(ctx context.Context, event json.RawMessage) (interface{}, error) {
+	var proxy events.APIGatewayProxyRequest
+	if err := json.Unmarshal(event, &proxy); err == nil && proxy.HTTPMethod != "" {
+		return handleProxy(&proxy)
+	}
+	var req api.Request
+	if err := json.Unmarshal(event, &req); err != nil {
+		return nil, &api.EncodedError{Err: api.Errorf(api.ErrorCodeBadRequest, "invalid request: %s", err)}
+	}
+	resp, err := handle(req)
+	if err != nil {
+		// Sent to the client as a structured error, see api.EncodedError
+		log.Println(err)
+		return nil, &api.EncodedError{Err: api.ToError(err)}
+	}
+	return resp, nil
+}
+
+func configure() (*server.Server, error) {
 	var km server.Server
 	err := km.Configure(os.Getenv("CONFIG"))
 	if err != nil {
-		nerr := errors.Wrap(err,"Error loading km api configuration")
-		log.Println(nerr)
-		return nil, nerr
+		return nil, api.WrapError(err, api.ErrorCodeConfig, "Error loading km api configuration")
+	}
+	// Each request is served by a freshly configured server, possibly in
+	// another container, so only a shared replay cache remembers anything
+	if cacheType := km.Config.ReplayCache.Type; cacheType != "dynamodb" {
+		return nil, api.Errorf(api.ErrorCodeConfig, "the issuing lambda needs a dynamodb replay cache, not %q", cacheType)
+	}
+	return &km, nil
+}
+
+func handle(req api.Request) (interface{}, error) {
+	km, err := configure()
+	if err != nil {
+		return nil, err
 	}
-	switch r := req.Payload.(type) {
-	case *api.DiscoveryRequest:
-		return km.HandleDiscovery(r)
-	case *api.ConfigRequest:
-		return km.HandleConfig(r)
-	case *api.DirectSamlAuthRequest:
-		return km.HandleDirectSamlAuth(r)
-	case *api.DirectOidcAuthRequest:
-		return km.HandleDirectOidcAuth(r)
-	case *api.WorkflowStartRequest:
-		return km.HandleWorkflowStart(r)
-	case *api.WorkflowAuthRequest:
-		return km.HandleWorkflowAuth(r)
-	default:
-		return nil, errors.New("unexpected request")
+	return km.Handle(&req)
+}
+
+func handleProxy(event *events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
+	km, err := configure()
+	if err != nil {
+		log.Println(err)
+		apiErr := api.ToError(err)
+		body, _ := json.Marshal(api.ErrorResponse{Error: apiErr})
+		return &events.APIGatewayProxyResponse{
+			StatusCode: apiErr.Code.HTTPStatus(),
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       string(body),
+		}, nil
 	}
+	return km.HandleAPIGatewayProxy(event)
 }
 
 func main() {
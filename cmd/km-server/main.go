@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"github.com/bsycorp/keymaster/km/server"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// km-server serves the keymaster API over HTTPS, for environments
+// without Lambda. It handles the same requests as the issuing lambda.
+
+var listenFlag = flag.String("listen", ":8443", "address to listen on")
+var configFlag = flag.String("config", os.Getenv("CONFIG"), "km configuration (or reference to it, e.g. file://, s3://); default $CONFIG")
+var tlsCertFlag = flag.String("tls-cert", "", "TLS certificate file")
+var tlsKeyFlag = flag.String("tls-key", "", "TLS private key file")
+var insecureHTTPFlag = flag.Bool("insecure-http", false, "serve plain HTTP, e.g. behind a TLS terminating proxy")
+var shutdownDelayFlag = flag.Duration("shutdown-delay", 5*time.Second, "time to keep serving at shutdown after readiness starts failing, so load balancers stop sending requests")
+var shutdownTimeoutFlag = flag.Duration("shutdown-timeout", 30*time.Second, "time allowed for in flight requests at shutdown")
+
+func main() {
+	flag.Parse()
+
+	if *configFlag == "" {
+		log.Fatalln("Required argument config missing (need -config or $CONFIG)")
+	}
+	useTLS := *tlsCertFlag != "" || *tlsKeyFlag != ""
+	if useTLS && (*tlsCertFlag == "" || *tlsKeyFlag == "") {
+		log.Fatalln("Need both -tls-cert and -tls-key")
+	}
+	if !useTLS && !*insecureHTTPFlag {
+		log.Fatalln("Required arguments tls-cert and tls-key missing (or use -insecure-http)")
+	}
+
+	var km server.Server
+	if err := km.Configure(*configFlag); err != nil {
+		log.Fatalln("Error loading km api configuration:", err)
+	}
+	handler := server.NewHTTPHandler(&km)
+	srv := &http.Server{
+		Addr:              *listenFlag,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		// Credential issuance can involve several AWS calls
+		WriteTimeout: 60 * time.Second,
+		IdleTimeout:  120 * time.Second,
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		log.Println("Received signal, shutting down:", <-sig)
+		handler.ShuttingDown()
+		time.Sleep(*shutdownDelayFlag)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeoutFlag)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println("Error during shutdown:", err)
+		}
+		close(done)
+	}()
+
+	log.Printf("km server for %s listening on %s (tls: %v)", km.Config.Name, *listenFlag, useTLS)
+	var err error
+	if useTLS {
+		err = srv.ListenAndServeTLS(*tlsCertFlag, *tlsKeyFlag)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatalln("Server error:", err)
+	}
+	<-done
+	log.Println("Shutdown complete")
+}
@@ -11,15 +11,32 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
 )
 
 var targetFlag = flag.String("target", "", "target issuer")
 var roleFlag = flag.String("role", "", "target role")
 var debugFlag = flag.Int("debug", 0, "enable debugging")
+var requesterNameFlag = flag.String("requester-name", "", "your name, for approvers")
+var requesterUsernameFlag = flag.String("requester-username", "", "your IDP username; only you can identify as the requester")
+var requesterEmailFlag = flag.String("requester-email", "", "your IDP email")
+var descriptionFlag = flag.String("description", "", "what the access is for, for approvers")
+var detailsURIFlag = flag.String("details-uri", "", "link to more details for approvers, e.g. the CI job")
+var approvalTimeoutFlag = flag.Duration("approval-timeout", time.Duration(api.DefaultIssuingNonceValidForSeconds)*time.Second, "how long to wait for workflow approval")
 var debugLevel = 0
 
+// Exit codes, so that CI jobs can tell why km failed. Other errors exit
+// with 1.
+const (
+	exitRejected  = 2
+	exitTimedOut  = 3
+	exitCancelled = 130 // as for SIGINT
+)
+
 func main() {
 	flag.Parse()
 
@@ -35,21 +52,49 @@ func main() {
 	if *targetFlag == "" {
 		log.Fatalln("Required argument taget is missing (need -target)")
 	}
+	if *descriptionFlag == "" {
+		log.Fatalln("Required argument description missing (need -description)")
+	}
 	debugLevel = *debugFlag
+	requester := workflow.Requester{
+		Name:     *requesterNameFlag,
+		Username: *requesterUsernameFlag,
+		Email:    *requesterEmailFlag,
+	}
 	// Draft workflow
 
 	// First, get the config
-	// target := "arn:aws:lambda:ap-southeast-2:062921715532:function:km2"
-	//target := "arn:aws:apigateway:ap-southeast-2:lambda:path/2015-03-31/functions/arn:aws:lambda:ap-southeast-2:218296299700:function:km2/invocations"
+	// e.g. arn:aws:lambda:ap-southeast-2:062921715532:function:km2, or
+	// https://km.example.com/ for a standalone server or API Gateway
 	target := *targetFlag
-	kmApi := api.NewClient(target)
+	kmApi, err := api.NewClient(target)
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "error creating km api client"))
+	}
 	kmApi.Debug = debugLevel
 
 	discoveryReq := new(api.DiscoveryRequest)
-	_, err := kmApi.Discovery(discoveryReq)
+	discovery, err := kmApi.Discovery(discoveryReq)
 	if err != nil {
 		log.Fatal(errors.Wrap(err, "error calling kmApi.Discovery"))
 	}
+	if debugLevel > 0 {
+		log.Printf("km server version: %s, protocols: %v, request types: %v, credential types: %v",
+			discovery.Version, discovery.ProtocolVersions, discovery.RequestTypes, discovery.CredentialTypes)
+	}
+	// Fail now, rather than after the user has been through approval
+	for _, requestType := range []string{"config", "workflow_start", "workflow_auth"} {
+		if err := discovery.Check(requestType); err != nil {
+			log.Fatal(errors.Wrapf(err, "km server %s cannot be used", target))
+		}
+	}
+	// The server doesn't check IP oracle tokens yet, so this isn't fatal
+	if discovery.IPOracleRequired {
+		log.Printf("WARNING: km server %s has IP whitelisting configured, but this client can't send IP oracle tokens; requests may be refused", target)
+	}
+	if skew := discovery.ClockSkew(time.Now()); skew > api.MaxClockSkew || skew < -api.MaxClockSkew {
+		log.Printf("WARNING: local clock differs from km server by %s, requests may fail with expiry errors; check your clock is synchronised", skew)
+	}
 
 	configReq := new(api.ConfigRequest)
 	configResp, err := kmApi.GetConfig(configReq)
@@ -57,13 +102,6 @@ func main() {
 		log.Fatal(errors.Wrap(err, "error calling kmApi.GetConfig"))
 	}
 
-	// Now start workflow to get nonce
-	kmWorkflowStartResponse, err := kmApi.WorkflowStart(&api.WorkflowStartRequest{})
-	if err != nil {
-		log.Fatal(errors.Wrap(err, "error calling kmApi.WorkflowStart"))
-	}
-	log.Println("Started workflow with km api")
-
 	log.Println("Target role for authentication:", *roleFlag)
 	targetRole := configResp.Config.FindRoleByName(*roleFlag)
 	if targetRole == nil {
@@ -74,13 +112,23 @@ func main() {
 	if configWorkflowPolicy == nil {
 		log.Fatalf("workflow policy %s not found in config", workflowPolicyName)
 	}
-	workflowPolicy := workflow.Policy{
-		Name:                configWorkflowPolicy.Name,
-		IdpName:             configWorkflowPolicy.IdpName,
-		RequesterCanApprove: configWorkflowPolicy.RequesterCanApprove,
-		IdentifyRoles:       configWorkflowPolicy.IdentifyRoles,
-		ApproverRoles:       configWorkflowPolicy.ApproverRoles,
+	workflowPolicy := workflow.PolicyFromConfig(configWorkflowPolicy)
+	// Only the requester named here can identify, so it has to be their
+	// IDP username or email, which we can't guess
+	if configWorkflowPolicy.RequiresIdentification() && requester.Username == "" && requester.Email == "" {
+		log.Fatalf("workflow policy %s requires you to identify yourself (need -requester-username or -requester-email, as known to the IDP)", workflowPolicyName)
+	}
+
+	// Now start workflow to get nonce
+	kmWorkflowStartResponse, err := kmApi.WorkflowStart(&api.WorkflowStartRequest{
+		Role:              *roleFlag,
+		RequesterUsername: requester.Username,
+		RequesterEmail:    requester.Email,
+	})
+	if err != nil {
+		log.Fatal(errors.Wrap(err, "error calling kmApi.WorkflowStart"))
 	}
+	log.Println("Started workflow with km api")
 
 	workflowBaseUrl := configResp.Config.Workflow.BaseUrl
 	log.Println("Using workflow engine:", workflowBaseUrl)
@@ -92,65 +140,119 @@ func main() {
 
 	// And start a workflow session
 	startResult, err := workflowApi.Create(context.Background(), &workflow.CreateRequest{
-		IdpNonce: kmWorkflowStartResponse.IdpNonce,
-		Requester: workflow.Requester{
-			Name:     "Blair Strang",
-			Username: "strangb",
-			Email:    "blair.strang@auspost.com.au",
-		},
+		IdpNonce:  kmWorkflowStartResponse.IdpNonce,
+		Requester: requester,
 		Source: workflow.Source{
-			Description: "Deploy a new version 3.2 with amazing features",
-			DetailsURI:  "https://gitlab.com/platform/keymaster",
+			Description: *descriptionFlag,
+			DetailsURI:  *detailsURIFlag,
 		},
 		Target: workflow.Target{
 			EnvironmentName:         configResp.Config.Name,
 			EnvironmentDiscoveryURI: target,
 		},
-		Policy: workflowPolicy,
+		Policy:       workflowPolicy,
+		SignedPolicy: kmWorkflowStartResponse.SignedPolicy,
+		// Identification answers its own nonce, not the approvals'
+		IdentifyNonce: kmWorkflowStartResponse.IdentifyNonce,
+		// No point approving it after we've given up
+		ExpiresInSeconds: int(*approvalTimeoutFlag / time.Second),
 	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// Now fix up the workflow URL
-	fixedWorkflowUrl := "https://workflow.int.btr.place/workflow/" + startResult.WorkflowId
+	// Fall back for engines which do not return a URL, assuming they
+	// serve approval pages as the reference engine does
+	fixedWorkflowUrl := startResult.WorkflowUrl
+	if fixedWorkflowUrl == "" {
+		fixedWorkflowUrl = strings.TrimSuffix(workflowBaseUrl, "/") + "/workflow/" + startResult.WorkflowId
+	}
 	log.Printf("------------------------------------------------------------------")
 	log.Printf("******************************************************************")
 	log.Printf("APPROVAL URL: %s", fixedWorkflowUrl)
 	log.Printf("******************************************************************")
 	log.Printf("------------------------------------------------------------------")
 
-	// Poll for assertions
-	var getAssertionsResult *workflow.GetAssertionsResponse
-	for {
-		getAssertionsResult, err = workflowApi.GetAssertions(context.Background(), &workflow.GetAssertionsRequest{
+	// Wait for approval, until the timeout or Ctrl-C (or SIGTERM, e.g.
+	// from a CI runner cancelling the job)
+	waitCtx, cancelWait := context.WithTimeout(context.Background(), *approvalTimeoutFlag)
+	defer cancelWait()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		if _, ok := <-sig; ok {
+			cancelWait()
+		}
+	}()
+	waiter := &workflow.Waiter{
+		Client: workflowApi,
+		OnProgress: func(details *workflow.GetDetailsResponse) {
+			for _, approval := range details.Approvals {
+				log.Printf("approved by %s (%s) at %s %s", approval.Username, approval.Group, approval.ApprovedAt.Format(time.RFC3339), approval.Comment)
+			}
+			if waitingOn := details.WaitingOn(); waitingOn != "" {
+				log.Print(waitingOn)
+			}
+		},
+		OnError: func(err error) {
+			log.Println("workflow engine error, retrying:", err)
+		},
+		OnCancel: func(ctx context.Context) error {
+			log.Println("Stopped waiting for approval, cancelling workflow:", fixedWorkflowUrl)
+			_, err := workflowApi.Cancel(ctx, &workflow.CancelRequest{
+				WorkflowId:    startResult.WorkflowId,
+				WorkflowNonce: startResult.WorkflowNonce,
+			})
+			return err
+		},
+	}
+	getAssertionsResult, err := waiter.Wait(waitCtx, startResult.WorkflowId, startResult.WorkflowNonce)
+	signal.Stop(sig)
+	close(sig)
+	switch err {
+	case nil:
+	case workflow.ErrRejected:
+		details, err := workflowApi.GetDetails(context.Background(), &workflow.GetDetailsRequest{
 			WorkflowId:    startResult.WorkflowId,
 			WorkflowNonce: startResult.WorkflowNonce,
 		})
-		if err != nil {
-			log.Println(errors.Wrap(err, "error calling workflowApi.GetAssertions"))
-		}
-		log.Printf("workflow state: %s", getAssertionsResult.Status)
-		if getAssertionsResult.Status == "CREATED" {
-			time.Sleep(5 * time.Second)
-		} else if getAssertionsResult.Status == "COMPLETED" {
-			break
-		} else if getAssertionsResult.Status == "REJECTED" {
-			log.Fatal("Your change request was REJECTED by a workflow approver. Exiting.")
-		} else {
-			log.Fatal("unexpected assertions result status:", getAssertionsResult.Status)
+		if err == nil && details.Rejection != nil {
+			log.Printf("rejected by %s: %s", details.Rejection.Username, details.Rejection.Reason)
 		}
+		log.Println("Your change request was REJECTED by a workflow approver. Exiting.")
+		os.Exit(exitRejected)
+	case workflow.ErrTimedOut:
+		log.Printf("Timed out after %s waiting for approval. Exiting.", *approvalTimeoutFlag)
+		os.Exit(exitTimedOut)
+	case workflow.ErrExpired:
+		log.Println("The workflow expired before it was approved. Exiting.")
+		os.Exit(exitTimedOut)
+	case workflow.ErrCancelled:
+		log.Println("Cancelled. Exiting.")
+		os.Exit(exitCancelled)
+	default:
+		log.Fatal(errors.Wrap(err, "error waiting for workflow approval"))
 	}
 	log.Printf("got: %d assertions from workflow", len(getAssertionsResult.Assertions))
 
 	creds, err := kmApi.WorkflowAuth(&api.WorkflowAuthRequest{
-		Username:     "gitlab", // TODO
-		Role:         "deployment",
-		IdpNonce:     kmWorkflowStartResponse.IdpNonce,
-		IssuingNonce: kmWorkflowStartResponse.IssuingNonce,
-		Assertions:   getAssertionsResult.Assertions,
+		Role:              *roleFlag,
+		IdpNonce:          kmWorkflowStartResponse.IdpNonce,
+		IssuingNonce:      kmWorkflowStartResponse.IssuingNonce,
+		Assertions:        getAssertionsResult.Assertions,
+		IdentifyAssertion: getAssertionsResult.IdentifyAssertion,
 	})
 	if err != nil {
+		var apiErr *api.Error
+		if errors.As(err, &apiErr) && apiErr.Code == api.ErrorCodeNotEnoughApprovals && apiErr.Details != nil {
+			for group, n := range apiErr.Details.MissingApprovals {
+				log.Printf("still need %d approval(s) from: %s", n, group)
+			}
+		}
+		if api.ErrorCodeOf(err) == api.ErrorCodeWorkflowExpired {
+			log.Println("The workflow was approved too late:", err)
+			os.Exit(exitTimedOut)
+		}
 		log.Fatal(errors.Wrap(err, "error calling kmApi.WorkflowAuth"))
 	}
 
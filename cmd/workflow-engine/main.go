@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"github.com/bsycorp/keymaster/km/workflow/engine"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// workflow-engine runs the reference workflow engine, which collects
+// approvals for km requests.
+
+var listenFlag = flag.String("listen", ":8443", "address to listen on")
+var configFlag = flag.String("config", os.Getenv("CONFIG"), "workflow engine configuration (or reference to it, e.g. file://); default $CONFIG")
+var tlsCertFlag = flag.String("tls-cert", "", "TLS certificate file")
+var tlsKeyFlag = flag.String("tls-key", "", "TLS private key file")
+var insecureHTTPFlag = flag.Bool("insecure-http", false, "serve plain HTTP, e.g. behind a TLS terminating proxy or for local testing")
+var shutdownTimeoutFlag = flag.Duration("shutdown-timeout", 30*time.Second, "time allowed for in flight requests at shutdown")
+
+func main() {
+	flag.Parse()
+
+	if *configFlag == "" {
+		log.Fatalln("Required argument config missing (need -config or $CONFIG)")
+	}
+	useTLS := *tlsCertFlag != "" || *tlsKeyFlag != ""
+	if useTLS && (*tlsCertFlag == "" || *tlsKeyFlag == "") {
+		log.Fatalln("Need both -tls-cert and -tls-key")
+	}
+	if !useTLS && !*insecureHTTPFlag {
+		log.Fatalln("Required arguments tls-cert and tls-key missing (or use -insecure-http)")
+	}
+
+	var e engine.Engine
+	if err := e.Configure(*configFlag); err != nil {
+		log.Fatalln("Error loading workflow engine configuration:", err)
+	}
+	srv := &http.Server{
+		Addr:              *listenFlag,
+		Handler:           engine.NewHandler(&e),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		log.Println("Received signal, shutting down:", <-sig)
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeoutFlag)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println("Error during shutdown:", err)
+		}
+		close(done)
+	}()
+
+	log.Printf("workflow engine %s listening on %s (tls: %v)", e.Config.BaseURL, *listenFlag, useTLS)
+	var err error
+	if useTLS {
+		err = srv.ListenAndServeTLS(*tlsCertFlag, *tlsKeyFlag)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatalln("Server error:", err)
+	}
+	<-done
+	e.WaitForNotifications()
+	log.Println("Shutdown complete")
+}
@@ -21,4 +21,5 @@ require (
 	github.com/stretchr/testify v1.5.1
 	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
 	gopkg.in/ini.v1 v1.55.0
+	gopkg.in/square/go-jose.v2 v2.4.1
 )
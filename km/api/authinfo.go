@@ -4,5 +4,15 @@ type AuthInfo struct {
 	Environment string
 	Role        string
 	Username    string
+	Groups      []string
 	ValidFor    int
+	// Set if the requester is a Kubernetes service account. SSH
+	// certificates include its UID in their key id.
+	ServiceAccount *ServiceAccountInfo
+}
+
+type ServiceAccountInfo struct {
+	Namespace string
+	Name      string
+	UID       string
 }
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ClaimRule matches a token if every named claim matches its pattern.
+// Patterns are as for path.Match, so "*" doesn't match "/":
+// "refs/heads/release-*" matches any release branch, and "platform/*"
+// the projects in the platform group but not its subgroups. Non-string
+// claims are matched in their JSON form, e.g. "true".
+type ClaimRule map[string]string
+
+func (r ClaimRule) Matches(claims map[string]interface{}) bool {
+	if len(r) == 0 {
+		return false
+	}
+	for name, pattern := range r {
+		value, found := claims[name]
+		if !found {
+			return false
+		}
+		if !globMatch(pattern, claimString(value)) {
+			return false
+		}
+	}
+	return true
+}
+
+// pins returns true if the rule matches one of the named claims against
+// a pattern whose first path segment is literal, e.g. "platform/*" but
+// not "*" or "p*/*". The first segment is the top level namespace, which
+// anyone can register on a public instance.
+func (r ClaimRule) pins(names []string) bool {
+	for _, name := range names {
+		first := strings.SplitN(r[name], "/", 2)[0]
+		if first != "" && !strings.ContainsAny(first, `*?[\`) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesAny returns true if any of the rules match the claims
+func MatchesAny(rules []ClaimRule, claims map[string]interface{}) bool {
+	for _, rule := range rules {
+		if rule.Matches(claims) {
+			return true
+		}
+	}
+	return false
+}
+
+func globMatch(pattern string, value string) bool {
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+func claimString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		// encoding/json decodes all numbers as float64
+		return fmt.Sprintf("%g", v)
+	}
+	return fmt.Sprint(value)
+}
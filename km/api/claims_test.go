@@ -0,0 +1,50 @@
+package api
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	assert.True(t, globMatch("abc", "abc"))
+	assert.True(t, globMatch("*", ""))
+	assert.True(t, globMatch("a/*", "a/b"))
+	assert.True(t, globMatch("a/*/*", "a/b/c"))
+	assert.True(t, globMatch("org/repo/.github/workflows/*.yml@refs/heads/*", "org/repo/.github/workflows/deploy.yml@refs/heads/main"))
+	assert.True(t, globMatch("a*b*c", "abc"))
+	assert.True(t, globMatch("a*b*c", "a-b-b-c"))
+
+	// "*" stops at "/", so a group's pattern doesn't match its subgroups
+	assert.False(t, globMatch("*", "a/b/c"))
+	assert.False(t, globMatch("a/*", "a/b/c"))
+	assert.False(t, globMatch("org/repo/.github/workflows/*.yml@*", "org/repo/.github/workflows/deploy.yml@refs/heads/main"))
+	assert.False(t, globMatch("a[", "a["))
+	assert.False(t, globMatch("abc", "abcd"))
+	assert.False(t, globMatch("a/*", "b/a"))
+	assert.False(t, globMatch("*.yml", "deploy.yaml"))
+	assert.False(t, globMatch("a*a", "a"))
+	assert.False(t, globMatch("a*b*c", "acb"))
+}
+
+func TestClaimRule_Matches(t *testing.T) {
+	claims := map[string]interface{}{
+		"project_path":  "platform/deploy",
+		"ref":           "refs/heads/release-1.2",
+		"ref_protected": "true",
+		"protected":     true,
+		"project_id":    float64(42),
+	}
+
+	assert.True(t, ClaimRule{"project_path": "platform/deploy"}.Matches(claims))
+	assert.True(t, ClaimRule{"project_path": "platform/*", "ref": "refs/heads/release-*"}.Matches(claims))
+	assert.True(t, ClaimRule{"ref_protected": "true", "protected": "true", "project_id": "42"}.Matches(claims))
+
+	assert.False(t, ClaimRule{"project_path": "platform/*", "ref": "refs/heads/main"}.Matches(claims))
+	assert.False(t, ClaimRule{"environment": "*"}.Matches(claims))
+	assert.False(t, ClaimRule{"project_path": "platform"}.Matches(claims))
+	assert.False(t, ClaimRule{"project_path": "*/web"}.Matches(claims))
+	assert.False(t, ClaimRule{}.Matches(claims))
+
+	assert.True(t, MatchesAny([]ClaimRule{{"ref": "refs/heads/main"}, {"ref_protected": "true"}}, claims))
+	assert.False(t, MatchesAny(nil, claims))
+}
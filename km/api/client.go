@@ -2,31 +2,24 @@ package api
 
 import (
 	"encoding/json"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/lambda"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/pkg/errors"
 	"log"
 )
 
 type Client struct {
-	//    * Function name - my-function (name-only), my-function:v1 (with alias).
-	//    * Function ARN - arn:aws:lambda:us-west-2:123456789012:function:my-function.
-	//    * Partial ARN - 123456789012:function:my-function.
-	FunctionName string
-	lambdaClient *lambda.Lambda
-	Debug int
+	Transport Transport
+	Debug     int
 }
 
-func NewClient(target string) *Client {
-	c := new(Client)
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
-	c.FunctionName = target
-	c.lambdaClient = lambda.New(sess) // TODO: region? Or can that come from env?
-	return c
+// NewClient returns a client for the target, with a transport chosen by
+// the target's scheme, see NewTransport.
+func NewClient(target string) (*Client, error) {
+	transport, err := NewTransport(target)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{Transport: transport}, nil
 }
 
 func (c *Client) Discovery(req *DiscoveryRequest) (*DiscoveryResponse, error) {
@@ -48,7 +41,57 @@ func (c *Client) GetConfig(req *ConfigRequest) (*ConfigResponse, error) {
 }
 
 func (c *Client) DirectSamlAuth(req *DirectSamlAuthRequest) (*DirectAuthResponse, error) {
-	return nil, nil
+	resp := new(DirectAuthResponse)
+	err := c.rpc(&Request{ Type: "direct_saml_auth", Payload: req}, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) DirectOidcAuth(req *DirectOidcAuthRequest) (*DirectAuthResponse, error) {
+	resp := new(DirectAuthResponse)
+	err := c.rpc(&Request{ Type: "direct_oidc_auth", Payload: req}, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) GitlabJobAuth(req *GitlabJobAuthRequest) (*DirectAuthResponse, error) {
+	resp := new(DirectAuthResponse)
+	err := c.rpc(&Request{ Type: "gitlab_job_auth", Payload: req}, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) GithubActionsAuth(req *GithubActionsAuthRequest) (*DirectAuthResponse, error) {
+	resp := new(DirectAuthResponse)
+	err := c.rpc(&Request{ Type: "github_actions_auth", Payload: req}, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) IAMAuth(req *IAMAuthRequest) (*DirectAuthResponse, error) {
+	resp := new(DirectAuthResponse)
+	err := c.rpc(&Request{ Type: "iam_auth", Payload: req}, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) KubernetesAuth(req *KubernetesAuthRequest) (*DirectAuthResponse, error) {
+	resp := new(DirectAuthResponse)
+	err := c.rpc(&Request{ Type: "kubernetes_auth", Payload: req}, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
 }
 
 func (c *Client) WorkflowStart(req *WorkflowStartRequest) (*WorkflowStartResponse, error) {
@@ -69,17 +112,6 @@ func (c *Client) WorkflowAuth(req *WorkflowAuthRequest) (*WorkflowAuthResponse,
 	return resp, nil
 }
 
-func (c *Client) isError(resp *lambda.InvokeOutput) error {
-	if resp.FunctionError != nil {
-		return errors.Errorf("function error: %s: response payload: %s",
-			*resp.FunctionError, string(resp.Payload))
-	} else if *resp.StatusCode != 200 {
-		return errors.Errorf("bad status code: %d, response payload: %s",
-			*resp.StatusCode, string(resp.Payload))
-	}
-	return nil
-}
-
 func (c *Client) rpc(req interface{}, resp interface{}) error {
 	if c.Debug > 0 {
 		log.Println("rpc request: ", spew.Sdump(req))
@@ -88,20 +120,17 @@ func (c *Client) rpc(req interface{}, resp interface{}) error {
 	if err != nil {
 		return errors.Wrap(err, "rpc marshal")
 	}
-	result, err := c.lambdaClient.Invoke(&lambda.InvokeInput{
-		FunctionName: aws.String(c.FunctionName),
-		Payload: payload,
-	})
+	result, err := c.Transport.RoundTrip(payload)
 	if err != nil {
-		return errors.Wrap(err, "rpc invoke")
-	}
-	if err = c.isError(result); err != nil {
+		if c.Debug > 0 {
+			log.Println("rpc error:", spew.Sdump(err))
+		}
 		return errors.Wrap(err, "rpc error")
 	}
-	err = json.Unmarshal(result.Payload, resp)
+	err = json.Unmarshal(result, resp)
 	if err != nil {
 		if c.Debug > 0 {
-			log.Println("rpc raw response:" + string(result.Payload))
+			log.Println("rpc raw response:" + string(result))
 		}
 		return errors.Wrap(err, "rpc unmarshal")
 	}
@@ -3,16 +3,31 @@ package api
 import (
 	"encoding/json"
 	"github.com/pkg/errors"
+	"strings"
 )
 
+// DefaultIssuingNonceValidForSeconds is how long a workflow may take
+// from start to credential issuance, unless configured otherwise.
+const DefaultIssuingNonceValidForSeconds = 3600
+
+const DefaultSTSEndpoint = "https://sts.amazonaws.com/"
+
 type Config struct {
-	Name          string              `json:"name"`
-	Version       string              `json:"version"`
-	Idp           []IdpConfig         `json:"idp"`
-	Roles         []RoleConfig        `json:"roles"`
-	Workflow      WorkflowConfig      `json:"workflow"`
-	Credentials   []CredentialsConfig `json:"credentials"`
-	AccessControl AccessControlConfig `json:"access_control"`
+	Name          string               `json:"name"`
+	Version       string               `json:"version"`
+	Idp           []IdpConfig          `json:"idp"`
+	Roles         []RoleConfig         `json:"roles"`
+	Workflow      WorkflowConfig       `json:"workflow"`
+	Credentials   []CredentialsConfig  `json:"credentials"`
+	AccessControl AccessControlConfig  `json:"access_control"`
+	IssuingNonce  IssuingNonceConfig   `json:"issuing_nonce"`
+	ReplayCache   ReplayCacheConfig    `json:"replay_cache"`
+	Gitlab        JWTIssuerConfig      `json:"gitlab"`
+	Github        JWTIssuerConfig      `json:"github"`
+	IAMAuth       IAMAuthConfig        `json:"iam_auth"`
+	Kubernetes    KubernetesAuthConfig `json:"kubernetes_auth"`
+	// Signs the policies sent to the workflow engine. Optional.
+	WorkflowPolicySigning WorkflowPolicySigningConfig `json:"workflow_policy_signing"`
 }
 
 func (c *Config) Normalise() {
@@ -21,6 +36,14 @@ func (c *Config) Normalise() {
 		c.Version = "1.0"
 	}
 
+	if c.IssuingNonce.ValidForSeconds == 0 {
+		c.IssuingNonce.ValidForSeconds = DefaultIssuingNonceValidForSeconds
+	}
+
+	if c.IAMAuth.STSEndpoint == "" {
+		c.IAMAuth.STSEndpoint = DefaultSTSEndpoint
+	}
+
 	// If there's no IDP name specified in a policy we will
 	// just use the first IDP.
 	policies := c.Workflow.Policies
@@ -37,9 +60,101 @@ func (c *Config) Validate() error {
 	if c.Version != "1.0" {
 		return errors.Errorf("unsupported version: %s", c.Version)
 	}
-	if len(c.Idp) > 1 {
-		// TODO: multiple IDP support
-		return errors.New("only 1 IDP is supported")
+	idpNames := make(map[string]bool)
+	for _, idp := range c.Idp {
+		if idp.Name == "" {
+			return errors.New("idp with no name")
+		}
+		if idpNames[idp.Name] {
+			return errors.Errorf("duplicate idp name: %s", idp.Name)
+		}
+		idpNames[idp.Name] = true
+	}
+	for _, policy := range c.Workflow.Policies {
+		if policy.MaxApprovalAgeSeconds < 0 {
+			return errors.Errorf("workflow policy %s has a negative max_approval_age_seconds", policy.Name)
+		}
+		// Policies which need no assertions don't need an IDP either
+		if policy.IdpName == "" && len(policy.ApproverRoles) == 0 && len(policy.IdentifyRoles) == 0 {
+			continue
+		}
+		if !idpNames[policy.IdpName] {
+			return errors.Errorf("workflow policy %s references unknown idp: %s", policy.Name, policy.IdpName)
+		}
+		if policy.SelfService && (len(policy.IdentifyRoles) == 0 || len(policy.ApproverRoles) > 0) {
+			return errors.Errorf("self service workflow policy %s must have identify roles and no approver roles", policy.Name)
+		}
+	}
+	signing := c.WorkflowPolicySigning
+	if signing.SigningKey != "" && signing.KmsKeyId != "" {
+		return errors.New("workflow policy signing has both a signing key and a kms key")
+	}
+	if signing.EncryptionKey != "" && signing.SigningKey == "" && signing.KmsKeyId == "" {
+		return errors.New("workflow policy encryption needs a signing key or kms key")
+	}
+	if c.Gitlab.Jwks != "" && c.Gitlab.Issuer == "" {
+		return errors.New("gitlab is configured with no issuer")
+	}
+	// GitHub tokens have a configurable audience, which must be set so
+	// tokens requested for other services can't be used with us.
+	if c.Github.Jwks != "" && (c.Github.Issuer == "" || c.Github.Audience == "") {
+		return errors.New("github is configured with no issuer or audience")
+	}
+	for _, role := range c.Roles {
+		err := validateClaimRules(role.Name, "gitlab", &c.Gitlab, role.GitlabClaims, "project_path", "namespace_path")
+		if err != nil {
+			return err
+		}
+		err = validateClaimRules(role.Name, "github", &c.Github, role.GithubClaims, "repository", "repository_owner")
+		if err != nil {
+			return err
+		}
+		if len(role.KubernetesServiceAccounts) > 0 {
+			k := c.Kubernetes
+			if k.Jwks == "" && k.Server == "" {
+				return errors.Errorf("role %s has kubernetes service accounts but kubernetes auth is not configured", role.Name)
+			}
+			if k.Jwks != "" && k.Issuer == "" {
+				return errors.New("kubernetes auth is configured with no issuer")
+			}
+			if k.Cluster == "" || strings.Contains(k.Cluster, ":") {
+				return errors.New("kubernetes auth needs a cluster name, without \":\"")
+			}
+			for _, binding := range role.KubernetesServiceAccounts {
+				if binding.Audience == "" {
+					return errors.Errorf("role %s has a kubernetes service account binding with no audience", role.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateClaimRules checks a role's claim rules for an issuer. Every
+// rule must pin one of the pinned claims (which say whose job it is) to
+// a pattern with a literal top level namespace, so that no rule matches
+// the jobs of projects someone else can create on the issuer.
+func validateClaimRules(roleName string, issuerName string, issuer *JWTIssuerConfig, rules []ClaimRule, pinned ...string) error {
+	for _, rule := range rules {
+		if len(rule) == 0 {
+			return errors.Errorf("role %s has an empty %s claim rule", roleName, issuerName)
+		}
+		if !rule.pins(pinned) {
+			return errors.Errorf("role %s has a %s claim rule which doesn't pin one of: %s",
+				roleName, issuerName, strings.Join(pinned, ", "))
+		}
+	}
+	if len(rules) > 0 && issuer.Jwks == "" {
+		return errors.Errorf("role %s has %s claim rules but %s is not configured", roleName, issuerName, issuerName)
+	}
+	return nil
+}
+
+func (c *Config) FindIdpByName(name string) *IdpConfig {
+	for _, i := range c.Idp {
+		if i.Name == name {
+			return &i
+		}
 	}
 	return nil
 }
@@ -82,10 +197,19 @@ type IdpConfigSaml struct {
 	EmailAttr    string `json:"email_attr"`
 	GroupsAttr   string `json:"groups_attr"`
 	RedirectURI  string `json:"redirect_uri"`
+	// The IDP's single sign-on URL, used by workflow engines to start
+	// logins. Not needed by the issuing server.
+	SSOURL string `json:"sso_url,omitempty"`
 }
 
 type IdpConfigOidc struct {
-	// Not implemented
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	// Can be s3:// file:// data:// or the raw JWKS document
+	Jwks          string `json:"jwks"`
+	UsernameClaim string `json:"username_claim"`
+	EmailClaim    string `json:"email_claim"`
+	GroupsClaim   string `json:"groups_claim"`
 }
 
 type RoleConfig struct {
@@ -94,6 +218,66 @@ type RoleConfig struct {
 	Credentials        []string                     `json:"credentials"`
 	ValidForSeconds    int                          `json:"valid_for_seconds"`
 	CredentialDelivery RoleCredentialDeliveryConfig `json:"credential_delivery"`
+	// GitLab CI jobs whose job JWT matches any of these rules may
+	// have this role without a workflow.
+	GitlabClaims []ClaimRule `json:"gitlab_claims,omitempty"`
+	// Likewise for GitHub Actions workflows, by their OIDC token
+	GithubClaims []ClaimRule `json:"github_claims,omitempty"`
+	// And for AWS principals, by ARN (patterns as for ClaimRule). An
+	// assumed role session matches both its session ARN and the ARN of
+	// the role, i.e. arn:aws:iam::<account>:role/<name>.
+	IAMPrincipals []string `json:"iam_principals,omitempty"`
+	// And for Kubernetes workloads, by service account
+	KubernetesServiceAccounts []ServiceAccountBinding `json:"kubernetes_service_accounts,omitempty"`
+}
+
+// ServiceAccountBinding matches Kubernetes service accounts by namespace
+// and name (patterns as for ClaimRule), with tokens for the audience.
+type ServiceAccountBinding struct {
+	Namespace      string `json:"namespace"`
+	ServiceAccount string `json:"service_account"`
+	Audience       string `json:"audience"`
+}
+
+// AllowsServiceAccount returns true if a binding matches the service
+// account and one of its token's audiences
+func (r *RoleConfig) AllowsServiceAccount(namespace string, name string, audiences []string) bool {
+	for _, binding := range r.KubernetesServiceAccounts {
+		if !globMatch(binding.Namespace, namespace) || !globMatch(binding.ServiceAccount, name) {
+			continue
+		}
+		for _, aud := range audiences {
+			if aud == binding.Audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ServiceAccountAudiences returns the audiences of the role's service
+// account bindings
+func (r *RoleConfig) ServiceAccountAudiences() []string {
+	var audiences []string
+	seen := make(map[string]bool)
+	for _, binding := range r.KubernetesServiceAccounts {
+		if !seen[binding.Audience] {
+			seen[binding.Audience] = true
+			audiences = append(audiences, binding.Audience)
+		}
+	}
+	return audiences
+}
+
+func (r *RoleConfig) AllowsIAMPrincipal(arns ...string) bool {
+	for _, pattern := range r.IAMPrincipals {
+		for _, arn := range arns {
+			if globMatch(pattern, arn) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (c *ConfigPublic) FindRoleByName(name string) *RoleConfig {
@@ -121,7 +305,13 @@ type CredentialsConfigSSH struct {
 }
 
 type CredentialsConfigKube struct {
-	CAKey string `json:"ca_key"`
+	CAKey       string   `json:"ca_key"`
+	CACert      string   `json:"ca_cert"`
+	Server      string   `json:"server"`
+	ServerCA    string   `json:"server_ca"`
+	ClusterName string   `json:"cluster_name"`
+	Groups      []string `json:"groups"`
+	IdpGroups   bool     `json:"idp_groups"`
 }
 
 type CredentialsConfigIAMAssumeRole struct {
@@ -137,6 +327,14 @@ type WorkflowConfig struct {
 	Policies []WorkflowPolicyConfig `json:"policies"`
 }
 
+// RequiresIdentification is true if requesters must identify themselves
+// to use the policy: it has identify roles, or requesters may not
+// approve their own requests, which can't be checked without knowing
+// who they are.
+func (p *WorkflowPolicyConfig) RequiresIdentification() bool {
+	return len(p.IdentifyRoles) > 0 || (len(p.ApproverRoles) > 0 && !p.RequesterCanApprove)
+}
+
 func (wc *WorkflowConfig) FindPolicyByName(name string) *WorkflowPolicyConfig {
 	for _, p := range wc.Policies {
 		if p.Name == name {
@@ -152,6 +350,72 @@ type WorkflowPolicyConfig struct {
 	RequesterCanApprove bool           `json:"requester_can_approve"`
 	IdentifyRoles       map[string]int `json:"identify_roles"`
 	ApproverRoles       map[string]int `json:"approver_roles"`
+	// Self service policies allow credentials to be issued directly
+	// (without a workflow) to anyone in one of the identify roles.
+	SelfService bool `json:"self_service"`
+	// Approvals are refused for workflows started longer ago than this.
+	// 0 means only the issuing nonce lifetime applies.
+	MaxApprovalAgeSeconds int `json:"max_approval_age_seconds"`
+}
+
+// WorkflowPolicySigningConfig has the key used to sign policies for the
+// workflow engine, which is either a local key or a KMS key.
+type WorkflowPolicySigningConfig struct {
+	// PEM encoded RSA or EC (P-256) private key. Can be s3:// file://
+	// data:// or raw data
+	SigningKey string `json:"signing_key"`
+	// Or an asymmetric KMS key (RSA, for RSASSA_PKCS1_V1_5_SHA_256), by
+	// ID, ARN or alias
+	KmsKeyId string `json:"kms_key_id"`
+	// Optional, the workflow engine's PEM encoded RSA public key. If
+	// set, policies are encrypted so that clients can't read them.
+	EncryptionKey string `json:"encryption_key"`
+}
+
+type IssuingNonceConfig struct {
+	// Can be s3:// file:// data:// or raw data
+	SigningKey      string `json:"signing_key"`
+	ValidForSeconds int    `json:"valid_for_seconds"`
+}
+
+// JWTIssuerConfig configures verification of JWTs from an issuer
+// other than an IDP, e.g. a CI system.
+type JWTIssuerConfig struct {
+	Issuer string `json:"issuer"`
+	// Optional, not all issuers set an audience
+	Audience string `json:"audience"`
+	// Can be s3:// file:// data:// or the raw JWKS document
+	Jwks string `json:"jwks"`
+}
+
+type IAMAuthConfig struct {
+	// Where signed sts:GetCallerIdentity requests are sent. Defaults to
+	// DefaultSTSEndpoint.
+	STSEndpoint string `json:"sts_endpoint"`
+}
+
+// KubernetesAuthConfig configures verification of (projected) service
+// account tokens, either offline using the service account issuer's
+// JWKS, or by a TokenReview with the cluster's API server.
+type KubernetesAuthConfig struct {
+	// Names the cluster in issued identities, which are
+	// keymaster:k8s:<cluster>:<namespace>:<name>
+	Cluster string `json:"cluster"`
+	Issuer   string `json:"issuer"`
+	// Can be s3:// file:// data:// or the raw JWKS document
+	Jwks string `json:"jwks"`
+	// API server URL & CA, for TokenReview
+	Server   string `json:"server"`
+	ServerCA string `json:"server_ca"`
+	// Token of a service account allowed to create TokenReviews
+	ReviewerToken string `json:"reviewer_token"`
+}
+
+type ReplayCacheConfig struct {
+	// One of: memory, file, dynamodb. The issuing lambda needs dynamodb
+	Type  string `json:"type"`
+	Path  string `json:"path"`
+	Table string `json:"table"`
 }
 
 type AccessControlConfig struct {
@@ -70,14 +70,20 @@ func TestLoadSampleConfigs(t *testing.T) {
 				Name: "kube-user",
 				Type: "kubernetes",
 				Config: &CredentialsConfigKube{
-					CAKey: "s3://my-bucket/kubeca.key",
+					CAKey:     "s3://my-bucket/kubeca.key",
+					CACert:    "s3://my-bucket/kubeca.crt",
+					Server:    "https://kube.example.com:6443",
+					IdpGroups: true,
 				},
 			},
 			{
 				Name: "kube-admin",
 				Type: "kubernetes",
 				Config: &CredentialsConfigKube{
-					CAKey: "s3://my-bucket/kubeca.key",
+					CAKey:  "s3://my-bucket/kubeca.key",
+					CACert: "s3://my-bucket/kubeca.crt",
+					Server: "https://kube.example.com:6443",
+					Groups: []string{"system:masters"},
 				},
 			},
 			{
@@ -146,6 +152,14 @@ func TestLoadSampleConfigs(t *testing.T) {
 				WhiteListCidrs: []string{"192.168.0.0/24", "172.16.0.0/12", "10.0.0.0/8"},
 			},
 		},
+		IssuingNonce: IssuingNonceConfig{
+			SigningKey:      "s3://my-bucket/issuing-nonce.key",
+			ValidForSeconds: 7200,
+		},
+		ReplayCache: ReplayCacheConfig{
+			Type:  "dynamodb",
+			Table: "km-fooproject-nonprod-replay",
+		},
 	}
 	data, err := ioutil.ReadFile("./testdata/example_api_config.yaml")
 	assert.NoError(t, err)
@@ -191,6 +205,155 @@ func TestConfig_FindRoleByName(t *testing.T) {
 	assert.Nil(t, config.FindCredentialByName("does-not-exist"))
 }
 
+func TestConfig_FindIdpByName(t *testing.T) {
+	config := Config{
+		Idp: []IdpConfig{
+			{Name: "corporate", Type: "saml", Config: &IdpConfigSaml{}},
+			{Name: "contractors", Type: "saml", Config: &IdpConfigSaml{}},
+		},
+	}
+	idpConfig := config.FindIdpByName("contractors")
+	assert.NotNil(t, idpConfig)
+	assert.Equal(t, "contractors", idpConfig.Name)
+
+	assert.Nil(t, config.FindIdpByName("does-not-exist"))
+}
+
+func TestWorkflowPolicyConfig_RequiresIdentification(t *testing.T) {
+	policy := WorkflowPolicyConfig{Name: "open"}
+	assert.False(t, policy.RequiresIdentification())
+	policy.ApproverRoles = map[string]int{"approvers": 1}
+	assert.True(t, policy.RequiresIdentification())
+	policy.RequesterCanApprove = true
+	assert.False(t, policy.RequiresIdentification())
+	policy.IdentifyRoles = map[string]int{"developers": 1}
+	assert.True(t, policy.RequiresIdentification())
+}
+
+func TestConfig_Validate(t *testing.T) {
+	config := Config{
+		Idp: []IdpConfig{
+			{Name: "corporate", Type: "saml", Config: &IdpConfigSaml{}},
+			{Name: "contractors", Type: "saml", Config: &IdpConfigSaml{}},
+		},
+		Workflow: WorkflowConfig{
+			Policies: []WorkflowPolicyConfig{
+				{Name: "staff", ApproverRoles: map[string]int{"approvers": 1}},
+				{Name: "contractor", IdpName: "contractors", IdentifyRoles: map[string]int{"contractors": 1}},
+			},
+		},
+	}
+	config.Normalise()
+	assert.Equal(t, "corporate", config.Workflow.Policies[0].IdpName)
+	assert.NoError(t, config.Validate())
+
+	config.Workflow.Policies[1].IdpName = "does-not-exist"
+	assert.EqualError(t, config.Validate(), "workflow policy contractor references unknown idp: does-not-exist")
+
+	config.Workflow.Policies[1].IdpName = "contractors"
+	config.Workflow.Policies[1].SelfService = true
+	assert.NoError(t, config.Validate())
+	config.Workflow.Policies[0].SelfService = true
+	assert.EqualError(t, config.Validate(), "self service workflow policy staff must have identify roles and no approver roles")
+	config.Workflow.Policies[0].SelfService = false
+	config.Workflow.Policies[0].MaxApprovalAgeSeconds = -1
+	assert.EqualError(t, config.Validate(), "workflow policy staff has a negative max_approval_age_seconds")
+	config.Workflow.Policies[0].MaxApprovalAgeSeconds = 3600
+	assert.NoError(t, config.Validate())
+
+	config.Idp[1].Name = "corporate"
+	assert.EqualError(t, config.Validate(), "duplicate idp name: corporate")
+
+	config.Idp[1].Name = "contractors"
+	config.Roles = []RoleConfig{{Name: "deployment", GitlabClaims: []ClaimRule{{"project_path": "platform/*"}}}}
+	assert.EqualError(t, config.Validate(), "role deployment has gitlab claim rules but gitlab is not configured")
+	config.Gitlab.Jwks = "s3://my-bucket/gitlab-jwks.json"
+	assert.EqualError(t, config.Validate(), "gitlab is configured with no issuer")
+	config.Gitlab.Issuer = "gitlab.example.com"
+	assert.NoError(t, config.Validate())
+	config.Roles[0].GitlabClaims = append(config.Roles[0].GitlabClaims, ClaimRule{})
+	assert.EqualError(t, config.Validate(), "role deployment has an empty gitlab claim rule")
+	// Rules must say whose jobs they are for
+	config.Roles[0].GitlabClaims = []ClaimRule{{"ref_protected": "true", "environment": "production"}}
+	assert.EqualError(t, config.Validate(), "role deployment has a gitlab claim rule which doesn't pin one of: project_path, namespace_path")
+	config.Roles[0].GitlabClaims = []ClaimRule{{"project_path": "*", "ref_protected": "true"}}
+	assert.EqualError(t, config.Validate(), "role deployment has a gitlab claim rule which doesn't pin one of: project_path, namespace_path")
+	config.Roles[0].GitlabClaims = []ClaimRule{{"project_path": "*/deploy"}}
+	assert.Error(t, config.Validate())
+	// Including the top level group, which anyone can register
+	for _, rule := range []ClaimRule{
+		{"project_path": "p*/*"},
+		{"namespace_path": "o*"},
+		{"project_path": "[a-z]*/x"},
+		{"namespace_path": "/platform"},
+	} {
+		config.Roles[0].GitlabClaims = []ClaimRule{rule}
+		assert.Error(t, config.Validate(), "%v", rule)
+	}
+	config.Roles[0].GitlabClaims = []ClaimRule{{"namespace_path": "platform/*"}}
+	assert.NoError(t, config.Validate())
+	config.Roles[0].GitlabClaims = []ClaimRule{{"namespace_path": "platform", "ref_protected": "true"}}
+	assert.NoError(t, config.Validate())
+	config.Roles[0].GitlabClaims = nil
+
+	config.Roles[0].GithubClaims = []ClaimRule{{"repository": "bsycorp/keymaster"}}
+	assert.EqualError(t, config.Validate(), "role deployment has github claim rules but github is not configured")
+	config.Github = JWTIssuerConfig{Issuer: "https://token.actions.githubusercontent.com", Jwks: "file://jwks.json"}
+	assert.EqualError(t, config.Validate(), "github is configured with no issuer or audience")
+	config.Github.Audience = "keymaster"
+	assert.NoError(t, config.Validate())
+	config.Roles[0].GithubClaims = []ClaimRule{{"repository_owner": "?sycorp", "ref": "refs/heads/master"}}
+	assert.EqualError(t, config.Validate(), "role deployment has a github claim rule which doesn't pin one of: repository, repository_owner")
+	// The owner must be literal, as anyone can create an organization
+	for _, rule := range []ClaimRule{
+		{"repository_owner": "a*"},
+		{"repository_owner": "bsycorp*"},
+		{"repository": "a*/keymaster"},
+		{"repository": "*/keymaster"},
+		{"repository": "[b]sycorp/keymaster"},
+	} {
+		config.Roles[0].GithubClaims = []ClaimRule{rule}
+		assert.EqualError(t, config.Validate(), "role deployment has a github claim rule which doesn't pin one of: repository, repository_owner", "%v", rule)
+	}
+	config.Roles[0].GithubClaims = []ClaimRule{{"repository": "bsycorp/*"}}
+	assert.NoError(t, config.Validate())
+	config.Roles[0].GithubClaims = []ClaimRule{{"repository_owner": "bsycorp", "ref": "refs/heads/*"}}
+	assert.NoError(t, config.Validate())
+	config.Roles[0].GithubClaims = []ClaimRule{{"repository": "bsycorp/keymaster"}}
+
+	config.Roles[0].KubernetesServiceAccounts = []ServiceAccountBinding{{Namespace: "ci", ServiceAccount: "deployer"}}
+	assert.EqualError(t, config.Validate(), "role deployment has kubernetes service accounts but kubernetes auth is not configured")
+	config.Kubernetes = KubernetesAuthConfig{Jwks: "file://jwks.json"}
+	assert.EqualError(t, config.Validate(), "kubernetes auth is configured with no issuer")
+	config.Kubernetes.Issuer = "https://kubernetes.default.svc"
+	assert.EqualError(t, config.Validate(), `kubernetes auth needs a cluster name, without ":"`)
+	config.Kubernetes.Cluster = "ci:prod"
+	assert.EqualError(t, config.Validate(), `kubernetes auth needs a cluster name, without ":"`)
+	config.Kubernetes.Cluster = "ci-cluster"
+	assert.EqualError(t, config.Validate(), "role deployment has a kubernetes service account binding with no audience")
+	config.Roles[0].KubernetesServiceAccounts[0].Audience = "keymaster"
+	assert.NoError(t, config.Validate())
+	config.Kubernetes = KubernetesAuthConfig{Cluster: "ci-cluster", Server: "https://10.0.0.1"}
+	assert.NoError(t, config.Validate())
+
+	config.WorkflowPolicySigning = WorkflowPolicySigningConfig{EncryptionKey: "file://workflow.pem"}
+	assert.EqualError(t, config.Validate(), "workflow policy encryption needs a signing key or kms key")
+	config.WorkflowPolicySigning.KmsKeyId = "alias/km-policy"
+	assert.NoError(t, config.Validate())
+	config.WorkflowPolicySigning.SigningKey = "file://policy.key"
+	assert.EqualError(t, config.Validate(), "workflow policy signing has both a signing key and a kms key")
+	config.WorkflowPolicySigning = WorkflowPolicySigningConfig{}
+
+	// No idp needed if there's nothing to assert
+	config = Config{
+		Workflow: WorkflowConfig{
+			Policies: []WorkflowPolicyConfig{{Name: "open"}},
+		},
+	}
+	config.Normalise()
+	assert.NoError(t, config.Validate())
+}
+
 func TestIdpConfig_UnmarshalJSON(t *testing.T) {
 	testCases := map[string]IdpConfig{
 		"t1": {
@@ -205,6 +368,17 @@ func TestIdpConfig_UnmarshalJSON(t *testing.T) {
 				RedirectURI:  "https://workflow.int.btr.place/1/saml/approve",
 			},
 		},
+		"oidc1": {
+			Type: "oidc",
+			Name: "my-oidc-idp",
+			Config: &IdpConfigOidc{
+				Issuer:        "https://idp.example.com",
+				Audience:      "keymaster",
+				Jwks:          "s3://my-bucket/jwks.json",
+				UsernameClaim: "preferred_username",
+				GroupsClaim:   "roles",
+			},
+		},
 	}
 
 	// Unmarshal c -> c2, check c == c2
@@ -22,6 +22,7 @@ type KubeCred struct {
 	Username   string `json:"username"`
 	PrivateKey string `json:"private_key"`
 	PublicKey  string `json:"public_key"`
+	Kubeconfig string `json:"kubeconfig"`
 }
 
 type IAMCred struct {
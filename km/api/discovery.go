@@ -0,0 +1,68 @@
+package api
+
+import (
+	"github.com/pkg/errors"
+	"time"
+)
+
+// ProtocolVersion is the version of the request/response protocol in
+// this package. It changes only when a change would break older clients
+// or servers.
+const ProtocolVersion = "1.0"
+
+// MaxClockSkew is how far the client and server clocks may differ before
+// the client warns. Nonces and assertions are checked against the
+// server's clock, so a larger skew tends to show up as confusing expiry
+// errors.
+const MaxClockSkew = 60 * time.Second
+
+// SupportsProtocol reports whether the server speaks the protocol
+// version. Servers which predate discovery report no versions; they
+// speak the original protocol.
+func (d *DiscoveryResponse) SupportsProtocol(version string) bool {
+	if len(d.ProtocolVersions) == 0 {
+		return version == ProtocolVersion
+	}
+	for _, v := range d.ProtocolVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Supports reports whether the server has the request type enabled.
+// Servers which predate discovery are assumed to support everything.
+func (d *DiscoveryResponse) Supports(requestType string) bool {
+	if len(d.RequestTypes) == 0 {
+		return true
+	}
+	for _, t := range d.RequestTypes {
+		if t == requestType {
+			return true
+		}
+	}
+	return false
+}
+
+// ClockSkew returns how far the server clock is ahead of now (negative
+// if it is behind), or zero if the server didn't report its time.
+func (d *DiscoveryResponse) ClockSkew(now time.Time) time.Duration {
+	if d.ServerTime == 0 {
+		return 0
+	}
+	return time.Unix(d.ServerTime, 0).Sub(now.Truncate(time.Second))
+}
+
+// Check returns an error explaining why a client speaking this protocol
+// version can't make requests of the given type.
+func (d *DiscoveryResponse) Check(requestType string) error {
+	if !d.SupportsProtocol(ProtocolVersion) {
+		return errors.Errorf("server does not support protocol version %s (server version %s supports: %v), try updating km",
+			ProtocolVersion, d.Version, d.ProtocolVersions)
+	}
+	if !d.Supports(requestType) {
+		return errors.Errorf("server does not have %s requests enabled (enabled: %v)", requestType, d.RequestTypes)
+	}
+	return nil
+}
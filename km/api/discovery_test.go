@@ -0,0 +1,40 @@
+package api
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryResponse_Check(t *testing.T) {
+	d := DiscoveryResponse{
+		Version:          "1.2.0",
+		ProtocolVersions: []string{ProtocolVersion},
+		RequestTypes:     []string{"discovery", "config", "workflow_start", "workflow_auth"},
+	}
+	assert.NoError(t, d.Check("workflow_start"))
+	err := d.Check("iam_auth")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "server does not have iam_auth requests enabled")
+	}
+
+	d.ProtocolVersions = []string{"2.0"}
+	err = d.Check("workflow_start")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "server does not support protocol version "+ProtocolVersion)
+	}
+
+	// Servers from before discovery was implemented
+	var legacy DiscoveryResponse
+	assert.NoError(t, legacy.Check("workflow_start"))
+	assert.NoError(t, legacy.Check("iam_auth"))
+}
+
+func TestDiscoveryResponse_ClockSkew(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	d := DiscoveryResponse{ServerTime: now.Unix() + 90}
+	assert.Equal(t, 90*time.Second, d.ClockSkew(now))
+	d.ServerTime = now.Unix() - 5
+	assert.Equal(t, -5*time.Second, d.ClockSkew(now.Add(500*time.Millisecond)))
+	assert.Equal(t, time.Duration(0), (&DiscoveryResponse{}).ClockSkew(now))
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"net/http"
+)
+
+// ErrorCode identifies the kind of failure. Codes are stable, unlike
+// messages, so clients should use them to decide what to do.
+type ErrorCode string
+
+const (
+	// The request is malformed or inconsistent
+	ErrorCodeBadRequest   ErrorCode = "bad_request"
+	ErrorCodeRoleNotFound ErrorCode = "role_not_found"
+	// The requester, principal or token is not allowed the role
+	ErrorCodeForbidden ErrorCode = "forbidden"
+	// The issuing nonce is invalid, expired or for another request
+	ErrorCodeInvalidNonce ErrorCode = "invalid_nonce"
+	// An IDP assertion or token failed validation
+	ErrorCodeInvalidAssertion ErrorCode = "invalid_assertion"
+	// The workflow was started longer ago than its policy's
+	// max_approval_age_seconds; start a new one
+	ErrorCodeWorkflowExpired ErrorCode = "workflow_expired"
+	// An assertion or nonce has already been used
+	ErrorCodeReplayed ErrorCode = "replayed"
+	// Some approver groups are short of approvals, see
+	// ErrorDetails.MissingApprovals
+	ErrorCodeNotEnoughApprovals ErrorCode = "not_enough_approvals"
+	// A service the server depends on failed; the request may succeed
+	// if retried
+	ErrorCodeUnavailable ErrorCode = "unavailable"
+	// The server is misconfigured
+	ErrorCodeConfig   ErrorCode = "config_error"
+	ErrorCodeInternal ErrorCode = "internal_error"
+)
+
+// HTTPStatus is the status code an HTTP server returns with the code
+func (c ErrorCode) HTTPStatus() int {
+	switch c {
+	case ErrorCodeBadRequest:
+		return http.StatusBadRequest
+	case ErrorCodeRoleNotFound:
+		return http.StatusNotFound
+	case ErrorCodeForbidden, ErrorCodeNotEnoughApprovals, ErrorCodeWorkflowExpired:
+		return http.StatusForbidden
+	case ErrorCodeInvalidNonce, ErrorCodeInvalidAssertion:
+		return http.StatusUnauthorized
+	case ErrorCodeReplayed:
+		return http.StatusConflict
+	case ErrorCodeUnavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// Error is the error envelope returned by the km API. Clients get one
+// from any failed request and can match it with errors.As:
+//
+//	var apiErr *api.Error
+//	if errors.As(err, &apiErr) && apiErr.Code == api.ErrorCodeNotEnoughApprovals {
+//		...
+//	}
+type Error struct {
+	Code    ErrorCode     `json:"code"`
+	Message string        `json:"message"`
+	Details *ErrorDetails `json:"details,omitempty"`
+}
+
+type ErrorDetails struct {
+	Role string `json:"role,omitempty"`
+	// Number of approvals still needed from each approver group
+	MissingApprovals map[string]int `json:"missing_approvals,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *Error) Temporary() bool {
+	return e.Code == ErrorCodeUnavailable
+}
+
+// Errorf returns an Error with the code and a formatted message.
+func Errorf(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// WrapError annotates err with a message and gives it a code, unless it
+// already has one.
+func WrapError(err error, code ErrorCode, message string) error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return errors.Wrap(err, message)
+	}
+	return &Error{
+		Code:    code,
+		Message: message + ": " + err.Error(),
+	}
+}
+
+// ToError converts err to an Error for returning to the client. The
+// code and details come from the innermost Error, the message from the
+// whole chain. Errors with no code are internal errors.
+func ToError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		return &Error{Code: ErrorCodeInternal, Message: err.Error()}
+	}
+	return &Error{
+		Code:    apiErr.Code,
+		Message: err.Error(),
+		Details: apiErr.Details,
+	}
+}
+
+// ErrorCodeOf returns the code of err, or "" if it has none.
+func ErrorCodeOf(err error) ErrorCode {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return ""
+}
+
+// EncodedError carries an Error through a Lambda function error, which
+// only has a message and the name of the error's type. The message is
+// the JSON encoded Error.
+type EncodedError struct {
+	Err *Error
+}
+
+// encodedErrorType is how the Lambda runtime names EncodedError
+const encodedErrorType = "EncodedError"
+
+func (e *EncodedError) Error() string {
+	data, err := json.Marshal(e.Err)
+	if err != nil {
+		return e.Err.Message
+	}
+	return string(data)
+}
+
+// lambdaFunctionError is the payload of a failed Lambda invocation
+type lambdaFunctionError struct {
+	ErrorMessage string `json:"errorMessage"`
+	ErrorType    string `json:"errorType"`
+}
+
+// decodeFunctionError decodes the payload of a failed Lambda invocation.
+// Errors from servers (or runtimes) which don't send an EncodedError
+// become internal errors with the raw payload as the message.
+func decodeFunctionError(payload []byte) *Error {
+	var fe lambdaFunctionError
+	if err := json.Unmarshal(payload, &fe); err != nil || fe.ErrorMessage == "" {
+		return &Error{Code: ErrorCodeInternal, Message: string(payload)}
+	}
+	if fe.ErrorType == encodedErrorType {
+		var apiErr Error
+		if err := json.Unmarshal([]byte(fe.ErrorMessage), &apiErr); err == nil && apiErr.Code != "" {
+			return &apiErr
+		}
+	}
+	return &Error{Code: ErrorCodeInternal, Message: fe.ErrorMessage}
+}
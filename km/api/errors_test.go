@@ -0,0 +1,59 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestToError(t *testing.T) {
+	inner := Errorf(ErrorCodeNotEnoughApprovals, "not enough approvals from: security")
+	inner.Details = &ErrorDetails{MissingApprovals: map[string]int{"security": 1}}
+	err := ToError(errors.Wrap(inner, "approval validation error"))
+	assert.Equal(t, ErrorCodeNotEnoughApprovals, err.Code)
+	assert.Equal(t, "approval validation error: not enough approvals from: security", err.Message)
+	assert.Equal(t, map[string]int{"security": 1}, err.Details.MissingApprovals)
+
+	err = ToError(errors.New("boom"))
+	assert.Equal(t, ErrorCodeInternal, err.Code)
+	assert.Equal(t, "boom", err.Message)
+	assert.Nil(t, ToError(nil))
+}
+
+func TestWrapError(t *testing.T) {
+	err := WrapError(errors.New("bad signature"), ErrorCodeInvalidAssertion, "saml validation error")
+	assert.Equal(t, ErrorCodeInvalidAssertion, ErrorCodeOf(err))
+	assert.Equal(t, "saml validation error: bad signature", err.Error())
+
+	// An existing code is kept
+	err = WrapError(Errorf(ErrorCodeReplayed, "already redeemed"), ErrorCodeInvalidAssertion, "saml validation error")
+	assert.Equal(t, ErrorCodeReplayed, ErrorCodeOf(err))
+	assert.Equal(t, "saml validation error: already redeemed", err.Error())
+
+	assert.Equal(t, ErrorCode(""), ErrorCodeOf(errors.New("no code")))
+}
+
+func TestDecodeFunctionError(t *testing.T) {
+	sent := Errorf(ErrorCodeRoleNotFound, "requested role not found: admin")
+	sent.Details = &ErrorDetails{Role: "admin"}
+	// As serialised by the Lambda runtime
+	payload, err := json.Marshal(map[string]string{
+		"errorMessage": (&EncodedError{Err: sent}).Error(),
+		"errorType":    encodedErrorType,
+	})
+	assert.NoError(t, err)
+
+	var received *Error
+	assert.True(t, errors.As(errors.Wrap(decodeFunctionError(payload), "rpc error"), &received))
+	assert.Equal(t, sent, received)
+	assert.False(t, received.Temporary())
+
+	// Errors from older servers, or the runtime itself
+	received = decodeFunctionError([]byte(`{"errorMessage":"Task timed out after 3.00 seconds","errorType":""}`))
+	assert.Equal(t, ErrorCodeInternal, received.Code)
+	assert.Equal(t, "Task timed out after 3.00 seconds", received.Message)
+	received = decodeFunctionError([]byte(`not json`))
+	assert.Equal(t, ErrorCodeInternal, received.Code)
+	assert.Equal(t, "not json", received.Message)
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/pkg/errors"
+	"io/ioutil"
+)
+
+// IAMServerIDHeader is signed into IAM auth requests, with the name of
+// the keymaster environment as its value. This stops a request made for
+// one keymaster environment being replayed against another.
+const IAMServerIDHeader = "X-Keymaster-Server-ID"
+
+// NewIAMAuthRequest creates an IAM auth request for the role, made with
+// the credentials of the session. The request contains a pre-signed
+// sts:GetCallerIdentity call which the server makes to find out who
+// we are; it can't be used to do anything else.
+func NewIAMAuthRequest(sess *session.Session, role string, serverID string) (*IAMAuthRequest, error) {
+	req, _ := sts.New(sess).GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+	req.HTTPRequest.Header.Set(IAMServerIDHeader, serverID)
+	err := req.Sign()
+	if err != nil {
+		return nil, errors.Wrap(err, "error signing sts request")
+	}
+	body, err := ioutil.ReadAll(req.GetBody())
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading sts request")
+	}
+	return &IAMAuthRequest{
+		RequestedRole: role,
+		Method:        req.HTTPRequest.Method,
+		URL:           req.HTTPRequest.URL.String(),
+		Headers:       req.HTTPRequest.Header,
+		Body:          string(body),
+	}, nil
+}
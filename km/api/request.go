@@ -12,7 +12,23 @@ type Request struct {
 
 type DiscoveryRequest struct {}
 
-type DiscoveryResponse struct {}
+type DiscoveryResponse struct {
+	// Version of the keymaster server software
+	Version string `json:"version"`
+	// API protocol versions the server speaks, see ProtocolVersion
+	ProtocolVersions []string `json:"protocol_versions"`
+	// Request types enabled by the server's configuration
+	RequestTypes []string `json:"request_types"`
+	// Types of credentials the server is configured to issue
+	CredentialTypes []string `json:"credential_types"`
+	// Unix time on the server, for detecting clock skew
+	ServerTime int64 `json:"server_time"`
+	// True if the server has IP whitelisting configured, under which
+	// requests must come from a whitelisted IP address, as attested by
+	// an IP oracle token. The server does not enforce this yet, so
+	// clients without IP oracle support should warn, not give up.
+	IPOracleRequired bool `json:"ip_oracle_required"`
+}
 
 type ConfigRequest struct {
 }
@@ -24,33 +40,77 @@ type ConfigResponse struct {
 
 type DirectSamlAuthRequest struct {
 	RequestedRole string  `json:"requested_role"`
-	SAMLResponse  string  `json:"saml_response"`
-	SigAlg        string  `json:"sig_alg"`
-	Signature     string  `json:"signature"`
+	SAMLResponse  string  `json:"saml_response,omitempty"`
 	RelayState    *string `json:"relay_state,omitempty"`
+	// Or, for a response with a binding signature, the query string
+	// exactly as the IDP sent it (SAMLResponse, RelayState, SigAlg and
+	// Signature), since the signature is over its encoding
+	Query string `json:"query,omitempty"`
 }
 
 type DirectOidcAuthRequest struct {
+	RequestedRole string `json:"requested_role"`
+	IdToken       string `json:"id_token"`
 }
 
 type DirectAuthResponse struct {
-	Credentials map[string][]byte `json:"result"`
+	Credentials []Cred `json:"credentials"`
+}
+
+type GitlabJobAuthRequest struct {
+	RequestedRole string `json:"requested_role"`
+	// The job's CI_JOB_JWT
+	JobJWT string `json:"job_jwt"`
+}
+
+type GithubActionsAuthRequest struct {
+	RequestedRole string `json:"requested_role"`
+	// An OIDC token from the Actions token endpoint
+	Token string `json:"token"`
+}
+
+// IAMAuthRequest carries a signed sts:GetCallerIdentity request, see
+// NewIAMAuthRequest.
+type IAMAuthRequest struct {
+	RequestedRole string              `json:"requested_role"`
+	Method        string              `json:"method"`
+	URL           string              `json:"url"`
+	Headers       map[string][]string `json:"headers"`
+	Body          string              `json:"body"`
+}
+
+type KubernetesAuthRequest struct {
+	RequestedRole string `json:"requested_role"`
+	// A projected service account token
+	Token string `json:"token"`
 }
 
 type WorkflowStartRequest struct {
+	Role string `json:"role"`
+	// The requester, as the workflow engine is told. Only they can
+	// identify themselves as the requester.
+	RequesterUsername string `json:"requester_username,omitempty"`
+	RequesterEmail    string `json:"requester_email,omitempty"`
 }
 
 type WorkflowStartResponse struct {
 	IssuingNonce string `json:"issuing_nonce"`
 	IdpNonce string `json:"idp_nonce"`
+	// The IDP nonce for the requester's identify assertion; approvals
+	// use IdpNonce
+	IdentifyNonce string `json:"identify_nonce"`
+	// For the workflow engine, if the server signs policies. Clients
+	// pass it on unchanged.
+	SignedPolicy string `json:"signed_policy,omitempty"`
 }
 
 type WorkflowAuthRequest struct {
-	Username string `json:"username"` // TODO: remove?
-	Role string `json:"role"`
-	IssuingNonce string `json:"issuing_nonce"`
-	IdpNonce string `json:"idp_nonce"`
-	Assertions []string `json:"assertions"`
+	Role         string   `json:"role"`
+	IssuingNonce string   `json:"issuing_nonce"`
+	IdpNonce     string   `json:"idp_nonce"`
+	Assertions   []string `json:"assertions"`
+	// The requester's own IDP assertion, for policies with identify roles
+	IdentifyAssertion string `json:"identify_assertion,omitempty"`
 }
 
 type WorkflowAuthResponse struct {
@@ -77,6 +137,14 @@ func (c *Request) UnmarshalJSON(data []byte) error {
 		payload = &DirectSamlAuthRequest{}
 	case "direct_oidc_auth":
 		payload = &DirectOidcAuthRequest{}
+	case "gitlab_job_auth":
+		payload = &GitlabJobAuthRequest{}
+	case "github_actions_auth":
+		payload = &GithubActionsAuthRequest{}
+	case "iam_auth":
+		payload = &IAMAuthRequest{}
+	case "kubernetes_auth":
+		payload = &KubernetesAuthRequest{}
 	case "workflow_start":
 		payload = &WorkflowStartRequest{}
 	case "workflow_auth":
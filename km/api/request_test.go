@@ -24,6 +24,28 @@ func TestRequest_UnmarshalJSON(t *testing.T) {
 			Type: "direct_oidc_auth",
 			Payload: &DirectOidcAuthRequest{},
 		},
+		"gitlab_job_auth": {
+			Type: "gitlab_job_auth",
+			Payload: &GitlabJobAuthRequest{RequestedRole: "deployment", JobJWT: "jwt"},
+		},
+		"github_actions_auth": {
+			Type: "github_actions_auth",
+			Payload: &GithubActionsAuthRequest{RequestedRole: "deployment", Token: "jwt"},
+		},
+		"iam_auth": {
+			Type: "iam_auth",
+			Payload: &IAMAuthRequest{
+				RequestedRole: "deployment",
+				Method: "POST",
+				URL: "https://sts.amazonaws.com/",
+				Headers: map[string][]string{"X-Keymaster-Server-Id": {"foo.io"}},
+				Body: "Action=GetCallerIdentity&Version=2011-06-15",
+			},
+		},
+		"kubernetes_auth": {
+			Type: "kubernetes_auth",
+			Payload: &KubernetesAuthRequest{RequestedRole: "deployment", Token: "jwt"},
+		},
 		"workflow_start": {
 			Type: "workflow_start",
 			Payload: &WorkflowStartRequest{},
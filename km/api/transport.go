@@ -0,0 +1,139 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Transport sends an encoded Request to a km server and returns the
+// encoded response. Failed requests return an *Error.
+type Transport interface {
+	RoundTrip(payload []byte) ([]byte, error)
+}
+
+// NewTransport returns a transport for the target:
+//
+//	https://km.example.com/        HTTPS POST (http:// for local testing)
+//	arn:aws:lambda:...             Lambda invoke of the function
+//	arn:aws:apigateway:...         Lambda invoke of the function an API
+//	                               Gateway integration URI refers to
+//	lambda://my-function           Lambda invoke
+//	my-function                    Lambda invoke; the function name
+//	                               formats are the same as for the
+//	                               Lambda Invoke API
+func NewTransport(target string) (Transport, error) {
+	if strings.HasPrefix(target, "https://") || strings.HasPrefix(target, "http://") {
+		return NewHTTPTransport(target), nil
+	}
+	functionName := strings.TrimPrefix(target, "lambda://")
+	if strings.HasPrefix(functionName, "arn:aws:apigateway:") {
+		// e.g. arn:aws:apigateway:ap-southeast-2:lambda:path/2015-03-31/functions/<function arn>/invocations
+		i := strings.Index(functionName, "/functions/")
+		if i < 0 || !strings.HasSuffix(functionName, "/invocations") {
+			return nil, errors.Errorf("unsupported api gateway target: %s", target)
+		}
+		functionName = strings.TrimSuffix(functionName[i+len("/functions/"):], "/invocations")
+	}
+	if functionName == "" || strings.Contains(functionName, "://") {
+		return nil, errors.Errorf("unsupported target: %s", target)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating aws session")
+	}
+	return &LambdaTransport{
+		FunctionName: functionName,
+		Lambda:       lambda.New(sess), // TODO: region? Or can that come from env?
+	}, nil
+}
+
+// LambdaTransport invokes the issuing lambda directly. The caller needs
+// lambda:InvokeFunction on it.
+type LambdaTransport struct {
+	//    * Function name - my-function (name-only), my-function:v1 (with alias).
+	//    * Function ARN - arn:aws:lambda:us-west-2:123456789012:function:my-function.
+	//    * Partial ARN - 123456789012:function:my-function.
+	FunctionName string
+	Lambda       lambdaiface.LambdaAPI
+}
+
+func (t *LambdaTransport) RoundTrip(payload []byte) ([]byte, error) {
+	result, err := t.Lambda.Invoke(&lambda.InvokeInput{
+		FunctionName: aws.String(t.FunctionName),
+		Payload:      payload,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "lambda invoke")
+	}
+	if result.FunctionError != nil {
+		return nil, decodeFunctionError(result.Payload)
+	} else if aws.Int64Value(result.StatusCode) != http.StatusOK {
+		return nil, errors.Errorf("bad status code: %d, response payload: %s",
+			aws.Int64Value(result.StatusCode), string(result.Payload))
+	}
+	return result.Payload, nil
+}
+
+// HTTPTransport POSTs requests as JSON to a km server's URL, which may
+// be the standalone server or an API Gateway in front of the lambda.
+type HTTPTransport struct {
+	URL        string
+	HttpClient *http.Client
+}
+
+const httpTransportTimeout = 30 * time.Second
+
+func NewHTTPTransport(url string) *HTTPTransport {
+	return &HTTPTransport{
+		URL:        url,
+		HttpClient: &http.Client{Timeout: httpTransportTimeout},
+	}
+}
+
+// ErrorResponse is the body of an HTTP error response from a km server
+type ErrorResponse struct {
+	Error *Error `json:"error"`
+}
+
+func (t *HTTPTransport) RoundTrip(payload []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, t.URL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, errors.Wrap(err, "http request construction error")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := t.HttpClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "http request error")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading http response body")
+	}
+	if resp.StatusCode == http.StatusOK {
+		return body, nil
+	}
+	var errResp ErrorResponse
+	if err := json.Unmarshal(body, &errResp); err == nil && errResp.Error != nil && errResp.Error.Code != "" {
+		return nil, errResp.Error
+	}
+	// Not from a km server, e.g. a load balancer or gateway error
+	code := ErrorCodeInternal
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		code = ErrorCodeUnavailable
+	}
+	return nil, Errorf(code, "http status: %d, response: %s", resp.StatusCode, string(body))
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewTransport(t *testing.T) {
+	transport, err := NewTransport("https://km.example.com/")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://km.example.com/", transport.(*HTTPTransport).URL)
+
+	lambdaTargets := map[string]string{
+		"km2":               "km2",
+		"lambda://km2:live": "km2:live",
+		"arn:aws:lambda:ap-southeast-2:062921715532:function:km2":                                                                                "arn:aws:lambda:ap-southeast-2:062921715532:function:km2",
+		"arn:aws:apigateway:ap-southeast-2:lambda:path/2015-03-31/functions/arn:aws:lambda:ap-southeast-2:218296299700:function:km2/invocations": "arn:aws:lambda:ap-southeast-2:218296299700:function:km2",
+	}
+	for target, functionName := range lambdaTargets {
+		transport, err := NewTransport(target)
+		if assert.NoError(t, err, target) {
+			assert.Equal(t, functionName, transport.(*LambdaTransport).FunctionName, target)
+		}
+	}
+
+	_, err = NewTransport("ftp://km.example.com/")
+	assert.Error(t, err)
+	_, err = NewTransport("arn:aws:apigateway:ap-southeast-2:lambda:path/2015-03-31/nothing")
+	assert.Error(t, err)
+}
+
+func TestHTTPTransport(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		body, _ := ioutil.ReadAll(r.Body)
+		switch string(body) {
+		case `{"type":"discovery","payload":{}}`:
+			w.Write([]byte(`{"version":"1.2.0"}`))
+		case `{"type":"config","payload":{}}`:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":"role_not_found","message":"requested role not found: admin","details":{"role":"admin"}}}`))
+		default:
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`<html>Bad Gateway</html>`))
+		}
+	}))
+	defer ts.Close()
+	client := &Client{Transport: NewHTTPTransport(ts.URL)}
+
+	resp, err := client.Discovery(&DiscoveryRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.0", resp.Version)
+
+	_, err = client.GetConfig(&ConfigRequest{})
+	var apiErr *Error
+	if assert.True(t, errors.As(err, &apiErr)) {
+		assert.Equal(t, ErrorCodeRoleNotFound, apiErr.Code)
+		assert.Equal(t, "admin", apiErr.Details.Role)
+	}
+
+	_, err = client.WorkflowStart(&WorkflowStartRequest{Role: "admin"})
+	if assert.True(t, errors.As(err, &apiErr)) {
+		assert.Equal(t, ErrorCodeUnavailable, apiErr.Code)
+		assert.True(t, apiErr.Temporary())
+	}
+}
+
+type stubLambda struct {
+	lambdaiface.LambdaAPI
+	output *lambda.InvokeOutput
+}
+
+func (l *stubLambda) Invoke(input *lambda.InvokeInput) (*lambda.InvokeOutput, error) {
+	return l.output, nil
+}
+
+func TestLambdaTransport(t *testing.T) {
+	stub := &stubLambda{output: &lambda.InvokeOutput{
+		StatusCode: aws.Int64(200),
+		Payload:    []byte(`{"version":"1.2.0"}`),
+	}}
+	client := &Client{Transport: &LambdaTransport{FunctionName: "km2", Lambda: stub}}
+	resp, err := client.Discovery(&DiscoveryRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.0", resp.Version)
+
+	stub.output.FunctionError = aws.String("Unhandled")
+	stub.output.Payload = []byte(`{"errorMessage":"{\"code\":\"replayed\",\"message\":\"approval has already been redeemed\"}","errorType":"EncodedError"}`)
+	_, err = client.Discovery(&DiscoveryRequest{})
+	assert.Equal(t, ErrorCodeReplayed, ErrorCodeOf(err))
+	assert.EqualError(t, err, "rpc error: approval has already been redeemed")
+}
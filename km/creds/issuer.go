@@ -4,6 +4,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/util"
 	"github.com/pkg/errors"
 	"log"
 )
@@ -24,10 +25,29 @@ func NewFromConfig(role *api.RoleConfig, config *api.Config) (*Issuer, error) {
 	var issuer Issuer
 	for _, credName := range role.Credentials {
 		credConfig := config.FindCredentialByName(credName)
+		if credConfig == nil {
+			return nil, errors.Errorf("credential not found: %s", credName)
+		}
 		switch c := credConfig.Config.(type) {
 		case *api.CredentialsConfigIAMAssumeRole:
 			i := NewSTSIssuer(sts.New(sess), c.TargetRole)
 			issuer.issuers = append(issuer.issuers, i)
+		case *api.CredentialsConfigSSH:
+			caKey, err := util.Load(c.CAKey)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error loading ssh ca key for: %s", credName)
+			}
+			i, err := NewSSHIssuer(caKey, c.Principals)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error parsing ssh ca key for: %s", credName)
+			}
+			issuer.issuers = append(issuer.issuers, i)
+		case *api.CredentialsConfigKube:
+			i, err := newKubeIssuerFromConfig(c)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error configuring kubernetes issuer for: %s", credName)
+			}
+			issuer.issuers = append(issuer.issuers, i)
 		default:
 			log.Printf("TODO: unimplemented cred config type for: %s", credName)
 		}
@@ -35,6 +55,32 @@ func NewFromConfig(role *api.RoleConfig, config *api.Config) (*Issuer, error) {
 	return &issuer, nil
 }
 
+func newKubeIssuerFromConfig(c *api.CredentialsConfigKube) (*KubeIssuer, error) {
+	caCert, err := util.Load(c.CACert)
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading ca cert")
+	}
+	caKey, err := util.Load(c.CAKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "error loading ca key")
+	}
+	i, err := NewKubeIssuer(caCert, caKey)
+	if err != nil {
+		return nil, err
+	}
+	if c.ServerCA != "" {
+		i.ServerCA, err = util.Load(c.ServerCA)
+		if err != nil {
+			return nil, errors.Wrap(err, "error loading server ca")
+		}
+	}
+	i.ClusterName = c.ClusterName
+	i.Server = c.Server
+	i.Groups = c.Groups
+	i.IdpGroups = c.IdpGroups
+	return i, nil
+}
+
 func (i *Issuer) IssueFor(u *api.AuthInfo) ([]api.Cred, error) {
 	allCreds := make([]api.Cred, 0)
 	for _, iss := range i.issuers {
@@ -1 +1,57 @@
 package creds
+
+import (
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNewFromConfig(t *testing.T) {
+	config := api.Config{
+		Name: "foo.io",
+		Credentials: []api.CredentialsConfig{
+			{
+				Name: "kube",
+				Type: "kubernetes",
+				Config: &api.CredentialsConfigKube{
+					CAKey:  "file://testdata/kube_ca.key",
+					CACert: "file://testdata/kube_ca.crt",
+					Server: "https://kube.example.com:6443",
+				},
+			},
+			{
+				Name: "ssh-all",
+				Type: "ssh_ca",
+				Config: &api.CredentialsConfigSSH{
+					CAKey:      "file://testdata/test_ca_user_key",
+					Principals: []string{"$idpuser", "core"},
+				},
+			},
+		},
+	}
+	role := api.RoleConfig{
+		Name:            "cloudengineer",
+		Credentials:     []string{"ssh-all", "kube"},
+		ValidForSeconds: 3600,
+	}
+	issuer, err := NewFromConfig(&role, &config)
+	assert.NoError(t, err)
+	assert.NotNil(t, issuer)
+
+	result, err := issuer.IssueFor(&api.AuthInfo{
+		Environment: config.Name,
+		Role:        role.Name,
+		Username:    "fred",
+		ValidFor:    role.ValidForSeconds,
+	})
+	assert.NoError(t, err)
+	assert.Len(t, result, 2)
+	assert.Equal(t, "ssh", result[0].Type)
+	assert.Equal(t, "kube", result[1].Type)
+
+	// Unknown credentials are a configuration error
+	role.Credentials = []string{"does-not-exist"}
+	issuer, err = NewFromConfig(&role, &config)
+	assert.Error(t, err)
+	assert.Nil(t, issuer)
+}
@@ -11,6 +11,8 @@ import (
 	"encoding/asn1"
 	"encoding/pem"
 	"errors"
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/ghodss/yaml"
 	"github.com/jonboulle/clockwork"
 	log "github.com/sirupsen/logrus"
 	"math/big"
@@ -28,6 +30,16 @@ type KubeIssuer struct {
 	CACert        *x509.Certificate
 	CACertEncoded string
 	Clock         clockwork.Clock
+
+	// Cluster details used to build the issued kubeconfig
+	ClusterName string
+	Server      string
+	ServerCA    []byte
+
+	// Organizations added to every issued certificate, and whether
+	// the user's IdP groups are added as well.
+	Groups    []string
+	IdpGroups bool
 }
 
 type UserKeyPair struct {
@@ -52,10 +64,74 @@ func NewKubeIssuer(certPem, keyPem []byte) (*KubeIssuer, error) {
 	}
 	issuer.CAKeypair = &caKeypair
 	issuer.CACert = caCert
+	issuer.CACertEncoded = string(certPem)
 	issuer.Clock = clockwork.NewRealClock()
 	return &issuer, nil
 }
 
+func (issuer *KubeIssuer) IssueFor(u *api.AuthInfo) ([]api.Cred, error) {
+	if issuer.Server == "" {
+		return nil, errors.New("no kubernetes server configured")
+	}
+	kp, err := issuer.GenerateUserKeyPair(u.Username, issuer.orgsFor(u), u.ValidFor)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(kp.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	encoded := kp.Encode()
+
+	clusterName := issuer.ClusterName
+	if clusterName == "" {
+		clusterName = u.Environment
+	}
+	serverCA := issuer.ServerCA
+	if len(serverCA) == 0 {
+		serverCA = []byte(issuer.CACertEncoded)
+	}
+	kubeconfig, err := NewKubeconfig(clusterName, issuer.Server, serverCA, u.Username, encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	profileName := u.Environment + "-" + u.Role
+	return []api.Cred{
+		{
+			Name:   profileName,
+			Type:   "kube",
+			Expiry: cert.NotAfter.Unix(),
+			Value: &api.KubeCred{
+				Username:   u.Username,
+				PrivateKey: string(encoded.PrivateKeyPEM),
+				PublicKey:  string(encoded.PublicKeyPEM),
+				Kubeconfig: string(kubeconfig),
+			},
+		},
+	}, nil
+}
+
+// orgsFor returns the certificate organizations (kubernetes groups)
+// for the given user, without duplicates.
+func (issuer *KubeIssuer) orgsFor(u *api.AuthInfo) []string {
+	orgs := make([]string, 0, len(issuer.Groups))
+	seen := make(map[string]bool)
+	add := func(groups []string) {
+		for _, g := range groups {
+			if !seen[g] {
+				seen[g] = true
+				orgs = append(orgs, g)
+			}
+		}
+	}
+	add(issuer.Groups)
+	if issuer.IdpGroups {
+		add(u.Groups)
+	}
+	return orgs
+}
+
 func RandomSerial() (*big.Int, error) {
 	// CA serial values are supposed to be *guaranteed* unique. But 63 bits
 	// of randomness should be good enough given reasonable birthday bounds.
@@ -154,3 +230,66 @@ func (kp *UserKeyPair) Encode() *EncodedUserKeyPair {
 		PrivateKeyPEM: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: kp.PrivateKey}),
 	}
 }
+
+// Minimal kubeconfig (clientcmd v1) structure; just enough to
+// hand users a working config for a single cluster.
+type kubeconfig struct {
+	APIVersion     string              `json:"apiVersion"`
+	Kind           string              `json:"kind"`
+	Clusters       []kubeconfigCluster `json:"clusters"`
+	Users          []kubeconfigUser    `json:"users"`
+	Contexts       []kubeconfigContext `json:"contexts"`
+	CurrentContext string              `json:"current-context"`
+}
+
+type kubeconfigCluster struct {
+	Name    string `json:"name"`
+	Cluster struct {
+		Server                   string `json:"server"`
+		CertificateAuthorityData []byte `json:"certificate-authority-data"`
+	} `json:"cluster"`
+}
+
+type kubeconfigUser struct {
+	Name string `json:"name"`
+	User struct {
+		ClientCertificateData []byte `json:"client-certificate-data"`
+		ClientKeyData         []byte `json:"client-key-data"`
+	} `json:"user"`
+}
+
+type kubeconfigContext struct {
+	Name    string `json:"name"`
+	Context struct {
+		Cluster string `json:"cluster"`
+		User    string `json:"user"`
+	} `json:"context"`
+}
+
+// NewKubeconfig renders a kubeconfig YAML document for the given cluster and user keypair.
+func NewKubeconfig(clusterName, server string, serverCA []byte, username string, kp *EncodedUserKeyPair) ([]byte, error) {
+	userName := username + "@" + clusterName
+	var cluster kubeconfigCluster
+	cluster.Name = clusterName
+	cluster.Cluster.Server = server
+	cluster.Cluster.CertificateAuthorityData = serverCA
+
+	var user kubeconfigUser
+	user.Name = userName
+	user.User.ClientCertificateData = kp.PublicKeyPEM
+	user.User.ClientKeyData = kp.PrivateKeyPEM
+
+	var context kubeconfigContext
+	context.Name = userName
+	context.Context.Cluster = clusterName
+	context.Context.User = userName
+
+	return yaml.Marshal(&kubeconfig{
+		APIVersion:     "v1",
+		Kind:           "Config",
+		Clusters:       []kubeconfigCluster{cluster},
+		Users:          []kubeconfigUser{user},
+		Contexts:       []kubeconfigContext{context},
+		CurrentContext: userName,
+	})
+}
@@ -2,9 +2,12 @@ package creds
 
 import (
 	"crypto/rand"
+	"crypto/x509"
 	"encoding/hex"
 	"encoding/pem"
 	"fmt"
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/ghodss/yaml"
 	"github.com/jonboulle/clockwork"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
@@ -170,3 +173,55 @@ func (kp *UserKeyPair) Dump(path string) (certPath string, keyPath string, err e
 	}
 	return
 }
+
+func TestKubeIssuer_IssueFor(t *testing.T) {
+	issuer, err := NewKubeIssuer(MustLoadFile(CaTestCertFile), MustLoadFile(CaTestCertKey))
+	assert.Nil(t, err)
+	issuer.Server = "https://kube.example.com:6443"
+	issuer.Groups = []string{"developers"}
+	issuer.IdpGroups = true
+
+	u := api.AuthInfo{
+		Environment: "foo.io",
+		Role:        "developer",
+		Username:    "fred",
+		Groups:      []string{"adfs_role_developer", "developers"},
+		ValidFor:    3600,
+	}
+	result, err := issuer.IssueFor(&u)
+	assert.NoError(t, err)
+	assert.Len(t, result, 1)
+	assert.Equal(t, "kube", result[0].Type)
+	assert.Equal(t, "foo.io-developer", result[0].Name)
+
+	kubeCred, ok := result[0].Value.(*api.KubeCred)
+	assert.True(t, ok)
+	assert.Equal(t, "fred", kubeCred.Username)
+
+	// The certificate should carry the user and de-duplicated groups
+	block, _ := pem.Decode([]byte(kubeCred.PublicKey))
+	assert.NotNil(t, block)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	assert.NoError(t, err)
+	assert.Equal(t, "fred", cert.Subject.CommonName)
+	assert.Equal(t, []string{"developers", "adfs_role_developer"}, cert.Subject.Organization)
+	assert.Equal(t, cert.NotAfter.Unix(), result[0].Expiry)
+
+	// And the kubeconfig should be usable as-is
+	var kc kubeconfig
+	err = yaml.Unmarshal([]byte(kubeCred.Kubeconfig), &kc)
+	assert.NoError(t, err)
+	assert.Equal(t, "fred@foo.io", kc.CurrentContext)
+	assert.Len(t, kc.Clusters, 1)
+	assert.Equal(t, "foo.io", kc.Clusters[0].Name)
+	assert.Equal(t, "https://kube.example.com:6443", kc.Clusters[0].Cluster.Server)
+	assert.Equal(t, MustLoadFile(CaTestCertFile), kc.Clusters[0].Cluster.CertificateAuthorityData)
+	assert.Len(t, kc.Users, 1)
+	assert.Equal(t, kubeCred.PublicKey, string(kc.Users[0].User.ClientCertificateData))
+	assert.Equal(t, kubeCred.PrivateKey, string(kc.Users[0].User.ClientKeyData))
+
+	// Without a server there is no usable kubeconfig
+	issuer.Server = ""
+	_, err = issuer.IssueFor(&u)
+	assert.Error(t, err)
+}
@@ -2,10 +2,12 @@ package creds
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"github.com/bsycorp/keymaster/km/api"
 	"github.com/jonboulle/clockwork"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh"
@@ -15,8 +17,22 @@ import (
 const (
 	KeyBits            = 2048
 	MaxValidForSeconds = 7 * 24 * 3600
+
+	// IdpUserPrincipal is replaced by the authenticated username
+	// when it appears in the configured list of principals.
+	IdpUserPrincipal = "$idpuser"
 )
 
+// DefaultExtensions are the certificate extensions granted to issued
+// SSH certificates. These match the ssh-keygen defaults.
+var DefaultExtensions = map[string]string{
+	"permit-X11-forwarding":   "",
+	"permit-agent-forwarding": "",
+	"permit-port-forwarding":  "",
+	"permit-pty":              "",
+	"permit-user-rc":          "",
+}
+
 type UserInfo struct {
 	Identity        string
 	Principals      []string
@@ -29,8 +45,89 @@ type Credentials struct {
 }
 
 type SSHIssuer struct {
-	Random io.Reader
-	Clock  clockwork.Clock
+	Random     io.Reader
+	Clock      clockwork.Clock
+	CA         ssh.Signer
+	Principals []string
+}
+
+func NewSSHIssuer(caKeyPem []byte, principals []string) (*SSHIssuer, error) {
+	ca, err := ssh.ParsePrivateKey(caKeyPem)
+	if err != nil {
+		return nil, err
+	}
+	return &SSHIssuer{
+		Random:     rand.Reader,
+		Clock:      clockwork.NewRealClock(),
+		CA:         ca,
+		Principals: principals,
+	}, nil
+}
+
+func (issuer *SSHIssuer) IssueFor(u *api.AuthInfo) ([]api.Cred, error) {
+	if issuer.CA == nil {
+		return nil, errors.New("No SSH CA key configured")
+	}
+	user := &UserInfo{
+		Identity:        keyIdFor(u),
+		Principals:      issuer.principalsFor(u),
+		ValidForSeconds: u.ValidFor,
+	}
+	publicKey, privateKey, err := issuer.GenerateKeyPair(user)
+	if err != nil {
+		return nil, err
+	}
+	sshCreds, err := issuer.CreateSignedCertificate(issuer.CA, publicKey, privateKey, user, DefaultExtensions, map[string]string{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Take the expiry from the signed certificate itself so that the
+	// two can never disagree.
+	certKey, _, _, _, err := ssh.ParseAuthorizedKey(sshCreds.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := certKey.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("Signed SSH credential is not a certificate")
+	}
+
+	profileName := u.Environment + "-" + u.Role
+	return []api.Cred{
+		{
+			Name:   profileName,
+			Type:   "ssh",
+			Expiry: int64(cert.ValidBefore),
+			Value: &api.SSHCred{
+				Username:    u.Username,
+				Certificate: sshCreds.Certificate,
+				PrivateKey:  sshCreds.PrivateKey,
+			},
+		},
+	}, nil
+}
+
+// keyIdFor is the certificate key id, which sshd logs. Service accounts
+// get their UID too, since a deleted service account's name can be
+// reused.
+func keyIdFor(u *api.AuthInfo) string {
+	if u.ServiceAccount != nil && u.ServiceAccount.UID != "" {
+		return u.Username + " uid=" + u.ServiceAccount.UID
+	}
+	return u.Username
+}
+
+// principalsFor expands the configured principals for the given user
+func (issuer *SSHIssuer) principalsFor(u *api.AuthInfo) []string {
+	principals := make([]string, 0, len(issuer.Principals))
+	for _, p := range issuer.Principals {
+		if p == IdpUserPrincipal {
+			p = u.Username
+		}
+		principals = append(principals, p)
+	}
+	return principals
 }
 
 func (issuer *SSHIssuer) GenerateKeyPair(user *UserInfo) (ssh.PublicKey, *rsa.PrivateKey, error) {
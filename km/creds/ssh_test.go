@@ -1,6 +1,7 @@
 package creds
 
 import (
+	"github.com/bsycorp/keymaster/km/api"
 	"github.com/jonboulle/clockwork"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/crypto/ssh"
@@ -94,3 +95,60 @@ func TestKeyGeneration(t *testing.T) {
                 permit-pty`
 	assert.Contains(t, string(certDump), expected2)
 }
+
+func TestSSHIssuer_IssueFor(t *testing.T) {
+	tm := time.Date(2015, time.April, 1, 16, 20, 0, 0, time.UTC)
+
+	privateBytes, err := ioutil.ReadFile("testdata/test_ca_user_key")
+	assert.Nil(t, err)
+	sshIssuer, err := NewSSHIssuer(privateBytes, []string{"$idpuser", "core"})
+	assert.Nil(t, err)
+	sshIssuer.Clock = clockwork.NewFakeClockAt(tm)
+
+	u := api.AuthInfo{
+		Environment: "foo.io",
+		Role:        "cloudengineer",
+		Username:    "fred",
+		ValidFor:    3600,
+	}
+	result, err := sshIssuer.IssueFor(&u)
+	assert.NoError(t, err)
+	assert.Len(t, result, 1)
+	assert.Equal(t, "ssh", result[0].Type)
+	assert.Equal(t, "foo.io-cloudengineer", result[0].Name)
+	assert.Equal(t, tm.Unix()+3600, result[0].Expiry)
+
+	sshCred, ok := result[0].Value.(*api.SSHCred)
+	assert.True(t, ok)
+	assert.Equal(t, "fred", sshCred.Username)
+	assert.NotEmpty(t, sshCred.PrivateKey)
+
+	certKey, _, _, _, err := ssh.ParseAuthorizedKey(sshCred.Certificate)
+	assert.NoError(t, err)
+	cert := certKey.(*ssh.Certificate)
+	assert.Equal(t, []string{"fred", "core"}, cert.ValidPrincipals)
+	assert.Equal(t, "fred", cert.KeyId)
+	assert.Equal(t, sshIssuer.CA.PublicKey().Marshal(), cert.SignatureKey.Marshal())
+
+	// Service accounts are identified by UID as well as name
+	sa := api.AuthInfo{
+		Environment:    "foo.io",
+		Role:           "cloudengineer",
+		Username:       "keymaster:k8s:ci-cluster:ci:deployer",
+		ValidFor:       3600,
+		ServiceAccount: &api.ServiceAccountInfo{Namespace: "ci", Name: "deployer", UID: "4a2b"},
+	}
+	result, err = sshIssuer.IssueFor(&sa)
+	assert.NoError(t, err)
+	certKey, _, _, _, err = ssh.ParseAuthorizedKey(result[0].Value.(*api.SSHCred).Certificate)
+	assert.NoError(t, err)
+	cert = certKey.(*ssh.Certificate)
+	assert.Equal(t, "keymaster:k8s:ci-cluster:ci:deployer uid=4a2b", cert.KeyId)
+	assert.Equal(t, []string{"keymaster:k8s:ci-cluster:ci:deployer", "core"}, cert.ValidPrincipals)
+
+	// Issuance period is bounded
+	u.ValidFor = MaxValidForSeconds + 1
+	result, err = sshIssuer.IssueFor(&u)
+	assert.Error(t, err)
+	assert.Empty(t, result)
+}
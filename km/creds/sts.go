@@ -7,6 +7,7 @@ import (
 	"github.com/bsycorp/keymaster/km/api"
 	"github.com/pkg/errors"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -26,7 +27,7 @@ func (i *STSIssuer) IssueFor(u *api.AuthInfo) ([]api.Cred, error) {
 	var assumeRoleOutput *sts.AssumeRoleOutput
 	var err error
 
-	roleSessionName :=  u.Username + "-" + strconv.Itoa(int(time.Now().UnixNano() % 1e6))
+	roleSessionName := roleSessionNameFor(u.Username, strconv.Itoa(int(time.Now().UnixNano() % 1e6)))
 	assumeRoleInput := sts.AssumeRoleInput{
 		DurationSeconds: aws.Int64(int64(u.ValidFor)),
 		RoleArn:         &i.RoleArn,
@@ -55,3 +56,21 @@ func (i *STSIssuer) IssueFor(u *api.AuthInfo) ([]api.Cred, error) {
 		},
 	}, nil
 }
+
+// Role session names are limited to 64 characters from [\w+=,.@-].
+// Usernames of machine identities often have other characters (e.g.
+// a GitLab project path, or keymaster:k8s:cluster:ns:name), which are
+// replaced with "-".
+func roleSessionNameFor(username string, suffix string) string {
+	name := []rune(username)
+	for i, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("_+=,.@-", r)) {
+			name[i] = '-'
+		}
+	}
+	maxLen := 64 - len(suffix) - 1
+	if len(name) > maxLen {
+		name = name[:maxLen]
+	}
+	return string(name) + "-" + suffix
+}
@@ -61,3 +61,12 @@ func TestSTSIssuer(t *testing.T) {
 	assert.Empty(t, result)
 	assert.Error(t, err)
 }
+
+func TestRoleSessionNameFor(t *testing.T) {
+	assert.Equal(t, "fred-123", roleSessionNameFor("fred", "123"))
+	assert.Equal(t, "platform-deploy-123", roleSessionNameFor("platform/deploy", "123"))
+	assert.Equal(t, "keymaster-k8s-ci-cluster-ci-deployer-123", roleSessionNameFor("keymaster:k8s:ci-cluster:ci:deployer", "123"))
+	long := roleSessionNameFor("platform/infrastructure/a-very-long-project-name-indeed-it-is-long", "123456")
+	assert.Len(t, long, 64)
+	assert.Equal(t, "platform-infrastructure-a-very-long-project-name-indeed-i-123456", long)
+}
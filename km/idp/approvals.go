@@ -0,0 +1,124 @@
+package idp
+
+import (
+	"sort"
+	"strings"
+)
+
+// AssignApprovers assigns each approver to at most one of the approver
+// groups they belong to, such that as many group quorums as possible are
+// met. It returns the group each approver counts towards, or "" for
+// approvers who aren't needed (or aren't in any of the groups).
+//
+// An approver in several groups could satisfy any one of them, so a
+// greedy assignment is not enough. This is a bipartite matching between
+// approvers and group "seats" (one seat per required approval), solved
+// with augmenting paths. Policies are small so this is cheap.
+func AssignApprovers(required map[string]int, approvers []UserInfo) []string {
+	// One seat per required approval, in a stable order
+	var seats []string
+	for _, groupName := range GroupNames(required) {
+		for i := 0; i < required[groupName]; i++ {
+			seats = append(seats, groupName)
+		}
+	}
+
+	// Which seats could each approver fill?
+	eligible := make([][]int, len(approvers))
+	for a, approver := range approvers {
+		inGroup := make(map[string]bool)
+		for _, groupName := range approver.Groups {
+			inGroup[groupName] = true
+		}
+		for seat, groupName := range seats {
+			if inGroup[groupName] {
+				eligible[a] = append(eligible[a], seat)
+			}
+		}
+	}
+
+	seatHolder := make([]int, len(seats))
+	for i := range seatHolder {
+		seatHolder[i] = -1
+	}
+	var assign func(a int, visited []bool) bool
+	assign = func(a int, visited []bool) bool {
+		for _, seat := range eligible[a] {
+			if visited[seat] {
+				continue
+			}
+			visited[seat] = true
+			if seatHolder[seat] == -1 || assign(seatHolder[seat], visited) {
+				seatHolder[seat] = a
+				return true
+			}
+		}
+		return false
+	}
+	for a := range approvers {
+		assign(a, make([]bool, len(seats)))
+	}
+
+	assigned := make([]string, len(approvers))
+	for seat, holder := range seatHolder {
+		if holder != -1 {
+			assigned[holder] = seats[seat]
+		}
+	}
+	return assigned
+}
+
+// MatchApprovals returns the number of approvals counted for each group,
+// with approvers assigned as by AssignApprovers.
+func MatchApprovals(required map[string]int, approvers []UserInfo) map[string]int {
+	approvals := make(map[string]int)
+	for _, groupName := range AssignApprovers(required, approvers) {
+		if groupName != "" {
+			approvals[groupName]++
+		}
+	}
+	return approvals
+}
+
+// MissingApprovals returns the number of approvals each group whose
+// quorum is not met still needs.
+func MissingApprovals(required map[string]int, approvals map[string]int) map[string]int {
+	missing := make(map[string]int)
+	for groupName, n := range required {
+		if approvals[groupName] < n {
+			missing[groupName] = n - approvals[groupName]
+		}
+	}
+	return missing
+}
+
+// SamePerson matches people on their verified username or email.
+func SamePerson(a UserInfo, b UserInfo) bool {
+	if a.Username != "" && strings.EqualFold(a.Username, b.Username) {
+		return true
+	}
+	if a.Email != "" && strings.EqualFold(a.Email, b.Email) {
+		return true
+	}
+	return false
+}
+
+// InAnyGroup reports whether any of groups is one of the policy's groups
+func InAnyGroup(required map[string]int, groups []string) bool {
+	for _, groupName := range groups {
+		if _, found := required[groupName]; found {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupNames returns the policy's group names in order
+func GroupNames(groups map[string]int) []string {
+	names := make([]string, 0, len(groups))
+	for k := range groups {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -119,6 +119,13 @@ type Config struct {
 	DisableNameIDValidation bool   `json:"disableValidateNameID"`
 }
 
+// AssertionConnector is a SAMLConnector which can also report the ID
+// of the assertion that a response was verified from.
+type AssertionConnector interface {
+	connector.SAMLConnector
+	HandlePOSTAssertion(s connector.Scopes, samlResponse, inResponseTo string) (ident connector.Identity, assertionID string, err error)
+}
+
 type certStore struct {
 	certs []*x509.Certificate
 }
@@ -289,9 +296,16 @@ func (p *provider) POSTData(s connector.Scopes, id string) (action, value string
 // * Map the Assertion's attribute elements to user info.
 //
 func (p *provider) HandlePOST(s connector.Scopes, samlResponse, inResponseTo string) (ident connector.Identity, err error) {
+	ident, _, err = p.HandlePOSTAssertion(s, samlResponse, inResponseTo)
+	return ident, err
+}
+
+// HandlePOSTAssertion is HandlePOST, but also returns the ID of the verified
+// assertion so callers can detect the same assertion being presented twice.
+func (p *provider) HandlePOSTAssertion(s connector.Scopes, samlResponse, inResponseTo string) (ident connector.Identity, assertionID string, err error) {
 	rawResp, err := base64.StdEncoding.DecodeString(samlResponse)
 	if err != nil {
-		return ident, fmt.Errorf("decode response: %v", err)
+		return ident, assertionID, fmt.Errorf("decode response: %v", err)
 	}
 
 	// Root element is allowed to not be signed if the Assertion element is.
@@ -299,65 +313,66 @@ func (p *provider) HandlePOST(s connector.Scopes, samlResponse, inResponseTo str
 	if p.validator != nil {
 		rawResp, rootElementSigned, err = verifyResponseSig(p.validator, rawResp)
 		if err != nil {
-			return ident, fmt.Errorf("verify signature: %v", err)
+			return ident, assertionID, fmt.Errorf("verify signature: %v", err)
 		}
 	}
 
 	var resp response
 	if err := xml.Unmarshal(rawResp, &resp); err != nil {
-		return ident, fmt.Errorf("unmarshal response: %v", err)
+		return ident, assertionID, fmt.Errorf("unmarshal response: %v", err)
 	}
 
 	// If the root element isn't signed, there's no reason to inspect these
 	// elements. They're not verified.
 	if rootElementSigned {
 		if p.ssoIssuer != "" && resp.Issuer != nil && resp.Issuer.Issuer != p.ssoIssuer {
-			return ident, fmt.Errorf("expected Issuer value %s, got %s", p.ssoIssuer, resp.Issuer.Issuer)
+			return ident, assertionID, fmt.Errorf("expected Issuer value %s, got %s", p.ssoIssuer, resp.Issuer.Issuer)
 		}
 
 		// Verify InResponseTo value matches the expected ID associated with
 		// the RelayState.
 		if resp.InResponseTo != inResponseTo {
-			return ident, fmt.Errorf("expected InResponseTo value %s, got %s", inResponseTo, resp.InResponseTo)
+			return ident, assertionID, fmt.Errorf("expected InResponseTo value %s, got %s", inResponseTo, resp.InResponseTo)
 		}
 
 		// Destination is optional.
 		if resp.Destination != "" && resp.Destination != p.redirectURI {
-			return ident, fmt.Errorf("expected destination %q got %q", p.redirectURI, resp.Destination)
+			return ident, assertionID, fmt.Errorf("expected destination %q got %q", p.redirectURI, resp.Destination)
 		}
 
 		// Status is a required element.
 		if resp.Status == nil {
-			return ident, fmt.Errorf("response did not contain a Status element")
+			return ident, assertionID, fmt.Errorf("response did not contain a Status element")
 		}
 
 		if err = p.validateStatus(resp.Status); err != nil {
-			return ident, err
+			return ident, assertionID, err
 		}
 	}
 
 	assertion := resp.Assertion
 	if assertion == nil {
-		return ident, fmt.Errorf("response did not contain an assertion")
+		return ident, assertionID, fmt.Errorf("response did not contain an assertion")
 	}
+	assertionID = assertion.ID
 
 	// Subject is usually optional, but we need it for the user ID, so complain
 	// if it's not present.
 	subject := assertion.Subject
 	if subject == nil {
-		return ident, fmt.Errorf("response did not contain a subject")
+		return ident, assertionID, fmt.Errorf("response did not contain a subject")
 	}
 
 	// Validate that the response is to the request we originally sent.
 	if err = p.validateSubject(subject, inResponseTo); err != nil {
-		return ident, err
+		return ident, assertionID, err
 	}
 
 	// Conditions element is optional, but must be validated if present.
 	if assertion.Conditions != nil {
 		// Validate that dex is the intended audience of this response.
 		if err = p.validateConditions(assertion.Conditions); err != nil {
-			return ident, err
+			return ident, assertionID, err
 		}
 	}
 
@@ -365,10 +380,10 @@ func (p *provider) HandlePOST(s connector.Scopes, samlResponse, inResponseTo str
 		switch {
 		case subject.NameID != nil:
 			if ident.UserID = subject.NameID.Value; ident.UserID == "" {
-				return ident, fmt.Errorf("NameID element does not contain a value")
+				return ident, assertionID, fmt.Errorf("NameID element does not contain a value")
 			}
 		default:
-			return ident, fmt.Errorf("subject does not contain an NameID element")
+			return ident, assertionID, fmt.Errorf("subject does not contain an NameID element")
 		}
 	}
 
@@ -376,7 +391,7 @@ func (p *provider) HandlePOST(s connector.Scopes, samlResponse, inResponseTo str
 	// various user info.
 	attributes := assertion.AttributeStatement
 	if attributes == nil {
-		return ident, fmt.Errorf("response did not contain a AttributeStatement")
+		return ident, assertionID, fmt.Errorf("response did not contain a AttributeStatement")
 	}
 
 	// Log the actual attributes we got back from the server. This helps debug
@@ -386,45 +401,45 @@ func (p *provider) HandlePOST(s connector.Scopes, samlResponse, inResponseTo str
 
 	// Grab the email.
 	if ident.Email, _ = attributes.get(p.emailAttr); ident.Email == "" {
-		return ident, fmt.Errorf("no attribute with name %q: %s", p.emailAttr, attributes.names())
+		return ident, assertionID, fmt.Errorf("no attribute with name %q: %s", p.emailAttr, attributes.names())
 	}
 	// TODO(ericchiang): Does SAML have an email_verified equivalent?
 	ident.EmailVerified = true
 
 	// Grab the username.
 	if ident.Username, _ = attributes.get(p.usernameAttr); ident.Username == "" {
-		return ident, fmt.Errorf("no attribute with name %q: %s", p.usernameAttr, attributes.names())
+		return ident, assertionID, fmt.Errorf("no attribute with name %q: %s", p.usernameAttr, attributes.names())
 	}
 
 	if len(p.allowedGroups) == 0 && (!s.Groups || p.groupsAttr == "") {
 		// Groups not requested or not configured. We're done.
-		return ident, nil
+		return ident, assertionID, nil
 	}
 
 	if len(p.allowedGroups) > 0 && (!s.Groups || p.groupsAttr == "") {
 		// allowedGroups set but no groups or groupsAttr. Disallowing.
-		return ident, fmt.Errorf("user not a member of allowed groups")
+		return ident, assertionID, fmt.Errorf("user not a member of allowed groups")
 	}
 
 	// Grab the groups.
 	if p.groupsDelim != "" {
 		groupsStr, ok := attributes.get(p.groupsAttr)
 		if !ok {
-			return ident, fmt.Errorf("no attribute with name %q: %s", p.groupsAttr, attributes.names())
+			return ident, assertionID, fmt.Errorf("no attribute with name %q: %s", p.groupsAttr, attributes.names())
 		}
 		// TODO(ericchiang): Do we need to further trim whitespace?
 		ident.Groups = strings.Split(groupsStr, p.groupsDelim)
 	} else {
 		groups, ok := attributes.all(p.groupsAttr)
 		if !ok {
-			return ident, fmt.Errorf("no attribute with name %q: %s", p.groupsAttr, attributes.names())
+			return ident, assertionID, fmt.Errorf("no attribute with name %q: %s", p.groupsAttr, attributes.names())
 		}
 		ident.Groups = groups
 	}
 
 	if len(p.allowedGroups) == 0 {
 		// No allowed groups set, just return the ident
-		return ident, nil
+		return ident, assertionID, nil
 	}
 
 	// Look for membership in one of the allowed groups
@@ -432,11 +447,11 @@ func (p *provider) HandlePOST(s connector.Scopes, samlResponse, inResponseTo str
 
 	if len(groupMatches) == 0 {
 		// No group membership matches found, disallowing
-		return ident, fmt.Errorf("user not a member of allowed groups")
+		return ident, assertionID, fmt.Errorf("user not a member of allowed groups")
 	}
 
 	// Otherwise, we're good
-	return ident, nil
+	return ident, assertionID, nil
 }
 
 // validateStatus verifies that the response has a good status code or
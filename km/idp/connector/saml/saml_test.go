@@ -78,6 +78,37 @@ func TestGoodResponse(t *testing.T) {
 	test.run(t)
 }
 
+func TestAssertionID(t *testing.T) {
+	c := Config{
+		CA:           "testdata/ca.crt",
+		UsernameAttr: "Name",
+		EmailAttr:    "email",
+		RedirectURI:  "http://127.0.0.1:5556/dex/callback",
+		SSOURL:       "http://foo.bar/",
+	}
+	now, err := time.Parse(timeFormat, "2017-04-04T04:34:59.330Z")
+	if err != nil {
+		t.Fatalf("parse test time: %v", err)
+	}
+	conn, err := c.openConnector(logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.now = func() time.Time { return now }
+	resp, err := ioutil.ReadFile("testdata/good-resp.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ac AssertionConnector = conn
+	_, assertionID, err := ac.HandlePOSTAssertion(connector.Scopes{}, base64.StdEncoding.EncodeToString(resp), "6zmm5mguyebwvajyf2sdwwcw6m")
+	if err != nil {
+		t.Fatalf("handle response: %v", err)
+	}
+	if assertionID != "id199065211253338521862321146" {
+		t.Errorf("unexpected assertion id: %s", assertionID)
+	}
+}
+
 func TestGroups(t *testing.T) {
 	test := responseTest{
 		caFile:       "testdata/ca.crt",
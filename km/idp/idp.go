@@ -0,0 +1,22 @@
+// Package idp has the types shared by the identity providers which
+// keymaster accepts approvals and identification from.
+package idp
+
+import "time"
+
+// UserInfo is a verified identity taken from an IDP assertion.
+type UserInfo struct {
+	Username string
+	Email    string
+	Groups   []string
+	// Unique per assertion, used to prevent replays
+	AssertionID string
+	// When the assertion stops being valid, if known
+	Expiry time.Time
+}
+
+// Processor verifies IDP assertions which were issued in response to a
+// nonce (the workflow IDP nonce).
+type Processor interface {
+	Process(inResponseTo string, assertions []string) ([]UserInfo, error)
+}
@@ -0,0 +1,74 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// KeySet is a set of public keys from a JSON Web Key Set (RFC 7517),
+// indexed by key ID. Only RSA and EC signing keys are supported.
+type KeySet struct {
+	keys map[string]interface{}
+}
+
+// ParseKeySet parses a JWKS document, i.e. {"keys": [...]}. Keys are
+// parsed by go-jose, one at a time so that keys for other uses (which
+// may be of types it doesn't know) are skipped rather than failing the
+// whole set.
+func ParseKeySet(data []byte) (*KeySet, error) {
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	err := json.Unmarshal(data, &jwks)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid jwks")
+	}
+	ks := &KeySet{keys: make(map[string]interface{})}
+	for _, raw := range jwks.Keys {
+		var header struct {
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+		}
+		if err := json.Unmarshal(raw, &header); err != nil {
+			return nil, errors.Wrap(err, "invalid jwks key")
+		}
+		if header.Use != "" && header.Use != "sig" {
+			continue
+		}
+		var jwk jose.JSONWebKey
+		if err := jwk.UnmarshalJSON(raw); err != nil {
+			return nil, errors.Wrapf(err, "invalid jwks key: %s", header.Kid)
+		}
+		switch jwk.Key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+		default:
+			return nil, errors.Errorf("unsupported jwks key: %s", header.Kid)
+		}
+		if _, found := ks.keys[jwk.KeyID]; found {
+			return nil, errors.Errorf("duplicate jwks key: %s", jwk.KeyID)
+		}
+		ks.keys[jwk.KeyID] = jwk.Key
+	}
+	if len(ks.keys) == 0 {
+		return nil, errors.New("jwks has no signing keys")
+	}
+	return ks, nil
+}
+
+// Key returns the public key with the given key ID. Tokens without a
+// key ID can only be verified if there is just one key in the set.
+func (ks *KeySet) Key(kid string) (interface{}, error) {
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, nil
+		}
+	}
+	key, found := ks.keys[kid]
+	if !found {
+		return nil, errors.Errorf("unknown signing key: %s", kid)
+	}
+	return key, nil
+}
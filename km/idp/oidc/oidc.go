@@ -0,0 +1,121 @@
+package oidc
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/bsycorp/keymaster/km/idp"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"time"
+)
+
+const (
+	DefaultUsernameClaim = "sub"
+	DefaultEmailClaim    = "email"
+	DefaultGroupsClaim   = "groups"
+)
+
+// TokenProcessor verifies OIDC ID tokens submitted as workflow
+// approvals or identification. It is the OIDC counterpart to the SAML
+// AssertionProcessor: the ID token nonce must be the workflow IDP nonce.
+type TokenProcessor struct {
+	Issuer   string
+	Audience string
+	// JWKS document containing the issuer's signing keys
+	JWKSData      []byte
+	UsernameClaim string
+	EmailClaim    string
+	GroupsClaim   string
+	Clock         clockwork.Clock
+
+	verifier *Verifier
+}
+
+func (tp *TokenProcessor) Init() error {
+	if tp.Issuer == "" {
+		return errors.New("TokenProcessor: no issuer configured")
+	}
+	if tp.Audience == "" {
+		return errors.New("TokenProcessor: no audience configured")
+	}
+	keys, err := ParseKeySet(tp.JWKSData)
+	if err != nil {
+		return errors.Wrap(err, "TokenProcessor: jwks error")
+	}
+	if tp.UsernameClaim == "" {
+		tp.UsernameClaim = DefaultUsernameClaim
+	}
+	if tp.EmailClaim == "" {
+		tp.EmailClaim = DefaultEmailClaim
+	}
+	if tp.GroupsClaim == "" {
+		tp.GroupsClaim = DefaultGroupsClaim
+	}
+	tp.verifier = &Verifier{
+		Issuer:   tp.Issuer,
+		Audience: tp.Audience,
+		Keys:     keys,
+		Clock:    tp.Clock,
+	}
+	return nil
+}
+
+func (tp *TokenProcessor) Process(nonce string, idTokens []string) ([]idp.UserInfo, error) {
+	result := make([]idp.UserInfo, 0, len(idTokens))
+	for _, idToken := range idTokens {
+		claims, userInfo, err := tp.verify(idToken)
+		if err != nil {
+			return nil, err
+		}
+		if StringClaim(claims, "nonce") != nonce {
+			return nil, errors.New("TokenProcessor: id token nonce does not match")
+		}
+		result = append(result, *userInfo)
+	}
+	return result, nil
+}
+
+// ProcessDirect verifies an ID token presented directly by the user it
+// identifies. There's no workflow IDP nonce, so tokens with a nonce are
+// refused: they could be workflow approvals or identification, which
+// are only valid for their workflow.
+func (tp *TokenProcessor) ProcessDirect(idToken string) (*idp.UserInfo, error) {
+	claims, userInfo, err := tp.verify(idToken)
+	if err != nil {
+		return nil, err
+	}
+	if StringClaim(claims, "nonce") != "" {
+		return nil, errors.New("TokenProcessor: direct auth id tokens must not have a nonce")
+	}
+	return userInfo, nil
+}
+
+func (tp *TokenProcessor) verify(idToken string) (jwt.MapClaims, *idp.UserInfo, error) {
+	if tp.verifier == nil {
+		return nil, nil, errors.New("TokenProcessor: not initialised")
+	}
+	claims, err := tp.verifier.Verify(idToken)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "TokenProcessor: invalid id token")
+	}
+	username := StringClaim(claims, tp.UsernameClaim)
+	if username == "" {
+		return nil, nil, errors.Errorf("TokenProcessor: id token has no username claim: %s", tp.UsernameClaim)
+	}
+	// Tokens without a jti are identified by their signed content
+	assertionID := StringClaim(claims, "jti")
+	if assertionID == "" {
+		sum := sha256.Sum256([]byte(idToken))
+		assertionID = hex.EncodeToString(sum[:])
+	}
+	// Verify checked there is an expiry
+	exp, _ := numericClaim(claims, "exp")
+	return claims, &idp.UserInfo{
+		Username:    username,
+		Email:       StringClaim(claims, tp.EmailClaim),
+		Groups:      StringsClaim(claims, tp.GroupsClaim),
+		AssertionID: assertionID,
+		Expiry:      time.Unix(exp, 0).Add(Leeway),
+	}, nil
+}
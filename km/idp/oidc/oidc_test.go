@@ -0,0 +1,224 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kid": kid,
+		"kty": "RSA",
+		"use": "sig",
+		"n":   b64(key.N.Bytes()),
+		"e":   b64(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+// EC coordinates are padded to the curve size
+func ecJWK(kid string, key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kid": kid,
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   b64(pad(key.X.Bytes(), 32)),
+		"y":   b64(pad(key.Y.Bytes(), 32)),
+	}
+}
+
+func pad(b []byte, n int) []byte {
+	return append(make([]byte, n-len(b)), b...)
+}
+
+func jwks(t *testing.T, keys ...map[string]string) []byte {
+	b, err := json.Marshal(map[string]interface{}{"keys": keys})
+	assert.NoError(t, err)
+	return b
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	s, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return s
+}
+
+func TestParseKeySet(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	ks, err := ParseKeySet(jwks(t, rsaJWK("rsa-1", &rsaKey.PublicKey), ecJWK("ec-1", &ecKey.PublicKey),
+		map[string]string{"kid": "enc-1", "kty": "RSA", "use": "enc"}))
+	assert.NoError(t, err)
+	key, err := ks.Key("rsa-1")
+	assert.NoError(t, err)
+	assert.Equal(t, &rsaKey.PublicKey, key)
+	key, err = ks.Key("ec-1")
+	assert.NoError(t, err)
+	assert.Equal(t, ecKey.PublicKey.X, key.(*ecdsa.PublicKey).X)
+
+	// Encryption keys are skipped; unknown key IDs and ambiguous
+	// tokens without a key ID are errors
+	_, err = ks.Key("enc-1")
+	assert.Error(t, err)
+	_, err = ks.Key("")
+	assert.Error(t, err)
+
+	_, err = ParseKeySet([]byte(`{"keys": []}`))
+	assert.Error(t, err)
+	_, err = ParseKeySet([]byte(`{"keys": [{"kid": "x", "kty": "oct", "k": "c2VjcmV0"}]}`))
+	assert.Error(t, err)
+	_, err = ParseKeySet([]byte(`{"keys": [{"kid": "x", "kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`))
+	assert.Error(t, err)
+	_, err = ParseKeySet([]byte(`not json`))
+	assert.Error(t, err)
+	// Private keys don't belong in a JWKS
+	private := rsaJWK("rsa-private", &rsaKey.PublicKey)
+	private["d"] = b64(rsaKey.D.Bytes())
+	private["p"] = b64(rsaKey.Primes[0].Bytes())
+	private["q"] = b64(rsaKey.Primes[1].Bytes())
+	_, err = ParseKeySet(jwks(t, private))
+	assert.Error(t, err)
+}
+
+func TestVerifier_Verify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	ks, err := ParseKeySet(jwks(t, rsaJWK("rsa-1", &rsaKey.PublicKey), ecJWK("ec-1", &ecKey.PublicKey)))
+	assert.NoError(t, err)
+
+	clock := clockwork.NewFakeClock()
+	v := &Verifier{Issuer: "https://idp.example.com", Audience: "keymaster", Keys: ks, Clock: clock}
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss": "https://idp.example.com",
+			"aud": []string{"something-else", "keymaster"},
+			"sub": "alice",
+			"iat": clock.Now().Unix(),
+			"exp": clock.Now().Add(5 * time.Minute).Unix(),
+		}
+	}
+
+	result, err := v.Verify(sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims()))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", StringClaim(result, "sub"))
+	_, err = v.Verify(sign(t, jwt.SigningMethodES256, "ec-1", ecKey, claims()))
+	assert.NoError(t, err)
+
+	// Wrong key for the key ID
+	_, err = v.Verify(sign(t, jwt.SigningMethodES256, "rsa-1", ecKey, claims()))
+	assert.Error(t, err)
+	// HMAC using the public key as the secret
+	_, err = v.Verify(sign(t, jwt.SigningMethodHS256, "rsa-1", rsaKey.PublicKey.N.Bytes(), claims()))
+	assert.Error(t, err)
+
+	c := claims()
+	c["iss"] = "https://evil.example.com"
+	_, err = v.Verify(sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, c))
+	assert.Error(t, err)
+
+	c = claims()
+	c["aud"] = "something-else"
+	_, err = v.Verify(sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, c))
+	assert.Error(t, err)
+
+	c = claims()
+	delete(c, "exp")
+	_, err = v.Verify(sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, c))
+	assert.Error(t, err)
+
+	c = claims()
+	c["nbf"] = clock.Now().Add(time.Hour).Unix()
+	_, err = v.Verify(sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, c))
+	assert.Error(t, err)
+
+	token := sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims())
+	clock.Advance(5*time.Minute + Leeway)
+	_, err = v.Verify(token)
+	assert.Error(t, err)
+}
+
+func TestTokenProcessor_Process(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	clock := clockwork.NewFakeClock()
+	tp := &TokenProcessor{
+		Issuer:      "https://idp.example.com",
+		Audience:    "keymaster",
+		JWKSData:    jwks(t, rsaJWK("key-1", &key.PublicKey)),
+		GroupsClaim: "roles",
+		Clock:       clock,
+	}
+	assert.NoError(t, tp.Init())
+
+	idToken := func(nonce string, sub string, extra jwt.MapClaims) string {
+		claims := jwt.MapClaims{
+			"iss":   "https://idp.example.com",
+			"aud":   "keymaster",
+			"sub":   sub,
+			"email": sub + "@example.com",
+			"nonce": nonce,
+			"roles": []string{"approvers", "everyone"},
+			"exp":   clock.Now().Add(5 * time.Minute).Unix(),
+		}
+		for k, v := range extra {
+			claims[k] = v
+		}
+		return sign(t, jwt.SigningMethodRS256, "key-1", key, claims)
+	}
+
+	bobToken := idToken("nonce-1", "bob", nil)
+	userInfos, err := tp.Process("nonce-1", []string{
+		idToken("nonce-1", "alice", jwt.MapClaims{"jti": "id-1"}),
+		bobToken,
+	})
+	assert.NoError(t, err)
+	assert.Len(t, userInfos, 2)
+	assert.Equal(t, "alice", userInfos[0].Username)
+	assert.Equal(t, "alice@example.com", userInfos[0].Email)
+	assert.Equal(t, []string{"approvers", "everyone"}, userInfos[0].Groups)
+	assert.Equal(t, "id-1", userInfos[0].AssertionID)
+	assert.NotEmpty(t, userInfos[1].AssertionID)
+
+	// The same token always has the same ID
+	again, err := tp.Process("nonce-1", []string{bobToken})
+	assert.NoError(t, err)
+	assert.Equal(t, userInfos[1].AssertionID, again[0].AssertionID)
+
+	// Tokens must be for this workflow
+	_, err = tp.Process("nonce-2", []string{bobToken})
+	assert.Error(t, err)
+	_, err = tp.Process("nonce-1", []string{idToken("nonce-1", "", nil)})
+	assert.Error(t, err)
+
+	// Direct auth tokens have no nonce, so that workflow approvals (which
+	// have the workflow's) can't be used
+	_, err = tp.ProcessDirect(idToken("workflow-idp-nonce", "carol", nil))
+	assert.Error(t, err)
+	userInfo, err := tp.ProcessDirect(idToken("", "carol", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "carol", userInfo.Username)
+	assert.Equal(t, clock.Now().Add(5*time.Minute+Leeway).Unix(), userInfo.Expiry.Unix())
+
+	assert.Error(t, (&TokenProcessor{Issuer: "x", Audience: "y", JWKSData: []byte(`{}`)}).Init())
+	assert.Error(t, (&TokenProcessor{Audience: "y", JWKSData: tp.JWKSData}).Init())
+}
@@ -0,0 +1,118 @@
+package oidc
+
+import (
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Leeway allows for clock skew between the token issuer and us
+const Leeway = 60 * time.Second
+
+// Only asymmetric algorithms; a JWKS holds public keys, so accepting
+// HMAC would let anyone with the JWKS forge tokens.
+var validMethods = []string{
+	"RS256", "RS384", "RS512",
+	"PS256", "PS384", "PS512",
+	"ES256", "ES384", "ES512",
+}
+
+// Verifier checks the signature, issuer, audience and validity period
+// of a JWT. It's the common part of verifying OIDC ID tokens and the
+// various CI and workload identity tokens, which are all JWTs signed
+// with a key from the issuer's JWKS.
+type Verifier struct {
+	Issuer string
+	// If empty, the audience is not checked. Only for issuers which
+	// don't set one.
+	Audience string
+	Keys     *KeySet
+	Clock    clockwork.Clock
+}
+
+// Verify returns the token's claims if it is valid.
+func (v *Verifier) Verify(token string) (jwt.MapClaims, error) {
+	if v.Keys == nil {
+		return nil, errors.New("no jwks configured")
+	}
+	// exp is required here, and checked below with Leeway like nbf and iat
+	parser := jwt.Parser{
+		ValidMethods:         validMethods,
+		SkipClaimsValidation: true,
+	}
+	claims := jwt.MapClaims{}
+	_, err := parser.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return v.Keys.Key(kid)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid token")
+	}
+
+	now := time.Now()
+	if v.Clock != nil {
+		now = v.Clock.Now()
+	}
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return nil, errors.New("token has no expiry")
+	}
+	if now.Add(-Leeway).Unix() >= exp {
+		return nil, errors.New("token has expired")
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(Leeway).Unix() < nbf {
+		return nil, errors.New("token is not yet valid")
+	}
+	if iat, ok := numericClaim(claims, "iat"); ok && now.Add(Leeway).Unix() < iat {
+		return nil, errors.New("token was issued in the future")
+	}
+	if iss, _ := claims["iss"].(string); iss != v.Issuer {
+		return nil, errors.Errorf("token has wrong issuer: %s", iss)
+	}
+	if v.Audience != "" && !hasAudience(claims, v.Audience) {
+		return nil, errors.Errorf("token has wrong audience: %v", claims["aud"])
+	}
+	return claims, nil
+}
+
+// StringClaim returns a string claim, or "" if it is missing or not a
+// string.
+func StringClaim(claims jwt.MapClaims, name string) string {
+	s, _ := claims[name].(string)
+	return s
+}
+
+// StringsClaim returns a claim which is a list of strings (or a single
+// string, which some issuers use for one element lists).
+func StringsClaim(claims jwt.MapClaims, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+func numericClaim(claims jwt.MapClaims, name string) (int64, bool) {
+	// encoding/json decodes all numbers as float64
+	f, ok := claims[name].(float64)
+	return int64(f), ok
+}
+
+// The aud claim may be a string or a list of strings
+func hasAudience(claims jwt.MapClaims, audience string) bool {
+	for _, aud := range StringsClaim(claims, "aud") {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/beevik/etree"
+	"github.com/bsycorp/keymaster/km/idp"
+	"github.com/dexidp/dex/connector"
+	"github.com/pkg/errors"
+	"net/url"
+	"strings"
+)
+
+// Signature algorithms accepted for direct (workflow-free) SAML auth,
+// both for the XML signature and the binding signature. SHA-1 is not
+// accepted.
+var directSigAlgs = map[string]crypto.Hash{
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256": crypto.SHA256,
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha384": crypto.SHA384,
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512": crypto.SHA512,
+}
+
+// RedirectQuery is a SAML response with a binding signature, as in the
+// HTTP-Redirect binding, parsed from the query string it came in.
+type RedirectQuery struct {
+	SAMLResponse string
+	RelayState   *string
+	SigAlg       string
+	Signature    string
+	// The signed octets, from the parameters as the IDP encoded them
+	signed string
+}
+
+// ParseRedirectQuery parses the raw query string of an HTTP-Redirect
+// binding message. The signature is over the parameters exactly as the
+// IDP sent them, which can't be rebuilt from the decoded values.
+func ParseRedirectQuery(rawQuery string) (*RedirectQuery, error) {
+	raw := make(map[string]string)
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		parts := strings.SplitN(param, "=", 2)
+		name, err := url.QueryUnescape(parts[0])
+		if err != nil {
+			return nil, errors.Wrap(err, "AssertionProcessor: invalid query")
+		}
+		if _, found := raw[name]; found {
+			return nil, errors.Errorf("AssertionProcessor: repeated query parameter: %s", name)
+		}
+		raw[name] = ""
+		if len(parts) == 2 {
+			raw[name] = parts[1]
+		}
+	}
+	for _, name := range []string{"SAMLResponse", "SigAlg", "Signature"} {
+		if raw[name] == "" {
+			return nil, errors.Errorf("AssertionProcessor: query has no %s", name)
+		}
+	}
+	q := &RedirectQuery{}
+	var err error
+	for name, value := range map[string]*string{
+		"SAMLResponse": &q.SAMLResponse,
+		"SigAlg":       &q.SigAlg,
+		"Signature":    &q.Signature,
+	} {
+		if *value, err = url.QueryUnescape(raw[name]); err != nil {
+			return nil, errors.Wrapf(err, "AssertionProcessor: invalid %s", name)
+		}
+	}
+	// Signed octets as per the HTTP-Redirect binding (saml-bindings 3.4.4.1)
+	q.signed = "SAMLResponse=" + raw["SAMLResponse"]
+	if rawRelayState, found := raw["RelayState"]; found {
+		relayState, err := url.QueryUnescape(rawRelayState)
+		if err != nil {
+			return nil, errors.Wrap(err, "AssertionProcessor: invalid RelayState")
+		}
+		q.RelayState = &relayState
+		q.signed += "&RelayState=" + rawRelayState
+	}
+	q.signed += "&SigAlg=" + raw["SigAlg"]
+	return q, nil
+}
+
+// ProcessRedirect verifies the binding signature of a query, made with
+// the IDP's key, then processes its SAML response as for ProcessDirect.
+func (sp *AssertionProcessor) ProcessRedirect(q *RedirectQuery) (*idp.UserInfo, error) {
+	if err := sp.verifyBindingSignature(q); err != nil {
+		return nil, err
+	}
+	return sp.ProcessDirect(q.SAMLResponse)
+}
+
+// ProcessDirect verifies an unsolicited (IDP initiated) SAML response
+// presented directly by the user it identifies.
+//
+// There's no workflow IDP nonce to check InResponseTo against, so the
+// response must not be in response to anything. Only SHA-2 signature
+// algorithms are accepted.
+func (sp *AssertionProcessor) ProcessDirect(samlResponse string) (*idp.UserInfo, error) {
+	if sp.samlConn == nil {
+		return nil, errors.New("AssertionProcessor: not initialised")
+	}
+	err := checkXMLSigAlgs(samlResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := connector.Scopes{
+		OfflineAccess: false,
+		Groups:        true,
+	}
+	ident, assertionID, err := sp.samlConn.HandlePOSTAssertion(scopes, samlResponse, "")
+	if err != nil {
+		return nil, errors.Wrap(err, "AssertionProcessor: invalid saml response")
+	}
+	return &idp.UserInfo{
+		Username:    ident.Username,
+		Email:       ident.Email,
+		Groups:      ident.Groups,
+		AssertionID: assertionID,
+	}, nil
+}
+
+func (sp *AssertionProcessor) verifyBindingSignature(q *RedirectQuery) error {
+	if sp.samlConn == nil {
+		return errors.New("AssertionProcessor: not initialised")
+	}
+	hash, ok := directSigAlgs[q.SigAlg]
+	if !ok {
+		return errors.Errorf("AssertionProcessor: unsupported sig alg: %s", q.SigAlg)
+	}
+	sig, err := base64.StdEncoding.DecodeString(q.Signature)
+	if err != nil {
+		return errors.Wrap(err, "AssertionProcessor: invalid signature encoding")
+	}
+	h := hash.New()
+	h.Write([]byte(q.signed))
+	digest := h.Sum(nil)
+
+	keys, err := sp.publicKeys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil {
+			return nil
+		}
+	}
+	return errors.New("AssertionProcessor: invalid binding signature")
+}
+
+func (sp *AssertionProcessor) publicKeys() ([]*rsa.PublicKey, error) {
+	var keys []*rsa.PublicKey
+	rest := sp.CAData
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "AssertionProcessor: invalid certificate")
+		}
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("AssertionProcessor: no rsa certificates")
+	}
+	return keys, nil
+}
+
+// checkXMLSigAlgs rejects responses with any XML signature made using an
+// algorithm outside directSigAlgs.
+func checkXMLSigAlgs(samlResponse string) error {
+	raw, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		return errors.Wrap(err, "AssertionProcessor: invalid saml response encoding")
+	}
+	doc := etree.NewDocument()
+	err = doc.ReadFromBytes(raw)
+	if err != nil {
+		return errors.Wrap(err, "AssertionProcessor: invalid saml response")
+	}
+	for _, method := range doc.FindElements("//SignatureMethod") {
+		alg := method.SelectAttrValue("Algorithm", "")
+		if _, ok := directSigAlgs[alg]; !ok {
+			return errors.Errorf("AssertionProcessor: unsupported signature algorithm: %s", alg)
+		}
+	}
+	return nil
+}
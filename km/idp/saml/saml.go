@@ -1,6 +1,7 @@
 package saml
 
 import (
+	"github.com/bsycorp/keymaster/km/idp"
 	"github.com/bsycorp/keymaster/km/idp/connector/saml"
 	"github.com/dexidp/dex/connector"
 	"github.com/pkg/errors"
@@ -18,14 +19,12 @@ type AssertionProcessor struct {
 	GroupsAttr              string
 	RedirectURI             string
 	DisableNameIDValidation bool
+	// The IDP's single sign-on URL. Only needed to start logins, see
+	// AuthnRequest.
+	SSOURL string
 
 	conn     connector.Connector
-	samlConn connector.SAMLConnector
-}
-
-type UserInfo struct {
-	Username string
-	Groups   []string
+	samlConn saml.AssertionConnector
 }
 
 func (sp *AssertionProcessor) Init() error {
@@ -36,38 +35,54 @@ func (sp *AssertionProcessor) Init() error {
 		EmailAttr:               sp.EmailAttr,
 		GroupsAttr:              sp.GroupsAttr,
 		RedirectURI:             sp.RedirectURI,
-		SSOURL:                  "UNUSED",
+		SSOURL:                  sp.SSOURL,
 		DisableNameIDValidation: sp.DisableNameIDValidation,
 	}
+	if c.SSOURL == "" {
+		c.SSOURL = "UNUSED"
+	}
 	conn, err := c.Open("saml", logrus.New())
 	if err != nil {
 		return errors.Wrap(err, "AssertionProcessor: open error")
 	}
 	var ok bool
-	sp.samlConn, ok = conn.(connector.SAMLConnector)
+	sp.samlConn, ok = conn.(saml.AssertionConnector)
 	if !ok {
 		return errors.New("AssertionProcessor: not a saml connector!")
 	}
 	return nil
 }
 
-func (sp *AssertionProcessor) Process(inResponseTo string, assertions []string) ([]UserInfo, error) {
+func (sp *AssertionProcessor) Process(inResponseTo string, assertions []string) ([]idp.UserInfo, error) {
 	scopes := connector.Scopes{
 		OfflineAccess: false,
 		Groups:        true,
 	}
-	result := make([]UserInfo, 0, len(assertions))
+	result := make([]idp.UserInfo, 0, len(assertions))
 	for _, samlResponse := range assertions {
-		ident, err := sp.samlConn.HandlePOST(scopes, samlResponse, inResponseTo)
+		ident, assertionID, err := sp.samlConn.HandlePOSTAssertion(scopes, samlResponse, inResponseTo)
 		if err != nil {
 			return nil, errors.Wrap(err, "AssertionProcessor: invalid saml response")
 		}
-		userInfo := UserInfo{
-			Username: ident.Username,
-			Groups:   ident.Groups,
+		userInfo := idp.UserInfo{
+			Username:    ident.Username,
+			Email:       ident.Email,
+			Groups:      ident.Groups,
+			AssertionID: assertionID,
 		}
 		result = append(result, userInfo)
 	}
 
 	return result, nil
 }
+
+// AuthnRequest returns an SP initiated login request with the given ID,
+// which the IDP will put in the response's InResponseTo. The request is
+// to be sent to the IDP's SSO URL with the HTTP-POST binding, as the
+// SAMLRequest form value.
+func (sp *AssertionProcessor) AuthnRequest(id string) (ssoURL string, samlRequest string, err error) {
+	if sp.SSOURL == "" {
+		return "", "", errors.New("AssertionProcessor: no sso url configured")
+	}
+	return sp.samlConn.POSTData(connector.Scopes{Groups: true}, id)
+}
@@ -0,0 +1,73 @@
+package replay
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+const (
+	dynamoKeyAttr    = "replay_key"
+	dynamoExpiryAttr = "expires_at"
+)
+
+// DynamoDBStore is a Store backed by a DynamoDB table with a string
+// hash key named "replay_key". Enable TTL on the "expires_at" attribute
+// to have DynamoDB clean up expired entries.
+type DynamoDBStore struct {
+	DynamoDB dynamodbiface.DynamoDBAPI
+	Table    string
+	Clock    clockwork.Clock
+}
+
+func NewDynamoDBStore(db dynamodbiface.DynamoDBAPI, table string) *DynamoDBStore {
+	return &DynamoDBStore{
+		DynamoDB: db,
+		Table:    table,
+		Clock:    clockwork.NewRealClock(),
+	}
+}
+
+func (s *DynamoDBStore) Redeem(keys []string, expiry time.Time) error {
+	now := strconv.FormatInt(s.Clock.Now().Unix(), 10)
+	// TTL deletion is lazy, so an expired item may still be present.
+	// Each put only succeeds if the key is new or has expired, and the
+	// transaction only if they all do.
+	var items []*dynamodb.TransactWriteItem
+	for _, key := range keys {
+		items = append(items, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName: aws.String(s.Table),
+				Item: map[string]*dynamodb.AttributeValue{
+					dynamoKeyAttr:    {S: aws.String(key)},
+					dynamoExpiryAttr: {N: aws.String(strconv.FormatInt(expiry.Unix(), 10))},
+				},
+				ConditionExpression: aws.String("attribute_not_exists(#k) OR #e < :now"),
+				ExpressionAttributeNames: map[string]*string{
+					"#k": aws.String(dynamoKeyAttr),
+					"#e": aws.String(dynamoExpiryAttr),
+				},
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":now": {N: aws.String(now)},
+				},
+			},
+		})
+	}
+	_, err := s.DynamoDB.TransactWriteItems(&dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if cancelled, ok := err.(*dynamodb.TransactionCanceledException); ok {
+		// Reasons are in the same order as the items
+		for i, reason := range cancelled.CancellationReasons {
+			if i < len(keys) && aws.StringValue(reason.Code) == "ConditionalCheckFailed" {
+				return &RedeemedError{Key: keys[i]}
+			}
+		}
+	}
+	if err != nil {
+		return errors.Wrap(err, "error writing to replay cache")
+	}
+	return nil
+}
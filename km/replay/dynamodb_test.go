@@ -0,0 +1,67 @@
+package replay
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// mockDynamoDB evaluates conditional transactions the same way DynamoDB
+// would
+type mockDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	items map[string]int64
+	fail  bool
+}
+
+func (m *mockDynamoDB) TransactWriteItems(input *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	if m.fail {
+		return nil, errors.New("it didn't work")
+	}
+	reasons := make([]*dynamodb.CancellationReason, len(input.TransactItems))
+	cancelled := false
+	for i, item := range input.TransactItems {
+		reasons[i] = &dynamodb.CancellationReason{Code: aws.String("None")}
+		key := *item.Put.Item[dynamoKeyAttr].S
+		now, _ := strconv.ParseInt(*item.Put.ExpressionAttributeValues[":now"].N, 10, 64)
+		if existing, found := m.items[key]; found && existing >= now {
+			reasons[i].Code = aws.String("ConditionalCheckFailed")
+			cancelled = true
+		}
+	}
+	if cancelled {
+		return nil, &dynamodb.TransactionCanceledException{CancellationReasons: reasons}
+	}
+	for _, item := range input.TransactItems {
+		expiry, _ := strconv.ParseInt(*item.Put.Item[dynamoExpiryAttr].N, 10, 64)
+		m.items[*item.Put.Item[dynamoKeyAttr].S] = expiry
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+func TestDynamoDBStore_Redeem(t *testing.T) {
+	db := &mockDynamoDB{items: make(map[string]int64)}
+	s := NewDynamoDBStore(db, "keymaster-replay")
+
+	expiry := time.Now().Add(time.Hour)
+	assert.NoError(t, s.Redeem([]string{"a"}, expiry))
+	err := s.Redeem([]string{"b", "a"}, expiry)
+	assert.True(t, errors.Is(err, ErrRedeemed))
+	assert.Equal(t, &RedeemedError{Key: "a"}, err)
+	// All or nothing, so b wasn't redeemed
+	assert.NoError(t, s.Redeem([]string{"b"}, expiry))
+
+	// Expired items that TTL has not cleaned up yet can be reused
+	db.items["c"] = time.Now().Add(-time.Hour).Unix()
+	assert.NoError(t, s.Redeem([]string{"c"}, expiry))
+
+	db.fail = true
+	err = s.Redeem([]string{"d"}, expiry)
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrRedeemed))
+}
@@ -0,0 +1,88 @@
+package replay
+
+import (
+	"encoding/json"
+	"github.com/bsycorp/keymaster/km/util"
+	"github.com/jonboulle/clockwork"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store for tests and local use. If Path is set, the
+// redeemed keys are also persisted to that file so they survive restarts.
+// It is only safe for use by a single process.
+type MemoryStore struct {
+	Path  string
+	Clock clockwork.Clock
+
+	mu       sync.Mutex
+	redeemed map[string]int64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		Clock:    clockwork.NewRealClock(),
+		redeemed: make(map[string]int64),
+	}
+}
+
+func NewFileStore(path string) *MemoryStore {
+	s := NewMemoryStore()
+	s.Path = path
+	return s
+}
+
+func (s *MemoryStore) Redeem(keys []string, expiry time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Path != "" {
+		if err := s.load(); err != nil {
+			return err
+		}
+	}
+	now := s.Clock.Now().Unix()
+	for k, exp := range s.redeemed {
+		if exp < now {
+			delete(s.redeemed, k)
+		}
+	}
+	for _, key := range keys {
+		if _, found := s.redeemed[key]; found {
+			return &RedeemedError{Key: key}
+		}
+	}
+	for _, key := range keys {
+		s.redeemed[key] = expiry.Unix()
+	}
+	if s.Path != "" {
+		if err := s.save(); err != nil {
+			// Not redeemed after all
+			for _, key := range keys {
+				delete(s.redeemed, key)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) load() error {
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &s.redeemed)
+}
+
+func (s *MemoryStore) save() error {
+	data, err := json.Marshal(s.redeemed)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(s.Path, data)
+}
@@ -0,0 +1,51 @@
+package replay
+
+import (
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore_Redeem(t *testing.T) {
+	clock := clockwork.NewFakeClockAt(time.Date(2020, time.May, 1, 12, 0, 0, 0, time.UTC))
+	s := NewMemoryStore()
+	s.Clock = clock
+
+	expiry := clock.Now().Add(time.Hour)
+	assert.NoError(t, s.Redeem([]string{"a"}, expiry))
+	assert.Equal(t, &RedeemedError{Key: "a"}, s.Redeem([]string{"b", "a"}, expiry))
+	// All or nothing, so b wasn't redeemed
+	assert.NoError(t, s.Redeem([]string{"b"}, expiry))
+
+	// Once expired, keys are forgotten
+	clock.Advance(2 * time.Hour)
+	assert.NoError(t, s.Redeem([]string{"a"}, clock.Now().Add(time.Hour)))
+}
+
+func TestFileStore_Redeem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "replay.json")
+
+	expiry := time.Now().Add(time.Hour)
+	s := NewFileStore(path)
+	assert.NoError(t, s.Redeem([]string{"a"}, expiry))
+	assert.True(t, errors.Is(s.Redeem([]string{"a"}, expiry), ErrRedeemed))
+
+	// A fresh store sees keys redeemed by the first one
+	s2 := NewFileStore(path)
+	assert.True(t, errors.Is(s2.Redeem([]string{"a"}, expiry), ErrRedeemed))
+	assert.NoError(t, s2.Redeem([]string{"b"}, expiry))
+
+	// Nothing is redeemed if the file can't be saved
+	s2.Path = filepath.Join(dir, "missing", "replay.json")
+	assert.Error(t, s2.Redeem([]string{"c"}, expiry))
+	s2.Path = ""
+	assert.NoError(t, s2.Redeem([]string{"c"}, expiry))
+}
@@ -0,0 +1,61 @@
+package replay
+
+import (
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// ErrRedeemed matches (with errors.Is) the RedeemedError returned when a
+// key has already been redeemed.
+var ErrRedeemed = errors.New("already redeemed")
+
+// RedeemedError names a key which has already been redeemed
+type RedeemedError struct {
+	Key string
+}
+
+func (e *RedeemedError) Error() string {
+	return "already redeemed: " + e.Key
+}
+
+func (e *RedeemedError) Is(target error) bool {
+	return target == ErrRedeemed
+}
+
+// A Store records single-use values (assertion IDs, nonces) so that
+// they can not be presented to the issuing server a second time.
+type Store interface {
+	// Redeem marks the keys as used until expiry, all or none of them.
+	// If any key was already redeemed and has not yet expired, nothing
+	// is redeemed and the error is a RedeemedError.
+	Redeem(keys []string, expiry time.Time) error
+}
+
+// NewFromConfig returns the configured store, or nil if there is none.
+func NewFromConfig(config *api.ReplayCacheConfig) (Store, error) {
+	switch config.Type {
+	case "":
+		return nil, nil
+	case "memory":
+		return NewMemoryStore(), nil
+	case "file":
+		if config.Path == "" {
+			return nil, errors.New("file replay cache requires a path")
+		}
+		return NewFileStore(config.Path), nil
+	case "dynamodb":
+		if config.Table == "" {
+			return nil, errors.New("dynamodb replay cache requires a table")
+		}
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		return NewDynamoDBStore(dynamodb.New(sess), config.Table), nil
+	default:
+		return nil, errors.Errorf("unknown replay cache type: %s", config.Type)
+	}
+}
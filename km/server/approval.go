@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/idp"
+	log "github.com/sirupsen/logrus"
+	"strings"
+)
+
+// countApprovals counts each approver towards at most one of the
+// approver groups they belong to (see idp.MatchApprovals). It returns
+// the number of approvals counted for each group, or an error naming the
+// groups whose quorum was not met.
+func countApprovals(required map[string]int, approvers []idp.UserInfo) (map[string]int, error) {
+	for _, approver := range approvers {
+		if !idp.InAnyGroup(required, approver.Groups) {
+			return nil, api.Errorf(api.ErrorCodeForbidden, "assertion with no valid approval groups from: %s got: %s want: %s",
+				approver.Username, approver.Groups, idp.GroupNames(required))
+		}
+	}
+	approvals := idp.MatchApprovals(required, approvers)
+	missingApprovals := idp.MissingApprovals(required, approvals)
+	if len(missingApprovals) > 0 {
+		var missing []string
+		for _, groupName := range idp.GroupNames(missingApprovals) {
+			missing = append(missing, fmt.Sprintf("%s (want: %d, got: %d)",
+				groupName, required[groupName], approvals[groupName]))
+		}
+		err := api.Errorf(api.ErrorCodeNotEnoughApprovals, "not enough approvals from: %s", strings.Join(missing, ", "))
+		err.Details = &api.ErrorDetails{MissingApprovals: missingApprovals}
+		return approvals, err
+	}
+	return approvals, nil
+}
+
+// distinctApprovers drops repeat approvals from the same person, so that
+// nobody can count more than once towards a quorum by submitting several
+// assertions. People are matched on their verified username or email.
+// Unless the policy allows it, approvals from the (identified) requester
+// are rejected outright.
+func distinctApprovers(approvers []idp.UserInfo, requester *idp.UserInfo, requesterCanApprove bool) ([]idp.UserInfo, error) {
+	result := make([]idp.UserInfo, 0, len(approvers))
+	for _, approver := range approvers {
+		if requester != nil && !requesterCanApprove && idp.SamePerson(approver, *requester) {
+			return nil, api.Errorf(api.ErrorCodeForbidden, "requester %s cannot approve their own request", requester.Username)
+		}
+		duplicate := false
+		for _, seen := range result {
+			if idp.SamePerson(approver, seen) {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			log.Println("Ignoring duplicate approval from:", approver.Username)
+			continue
+		}
+		result = append(result, approver)
+	}
+	return result, nil
+}
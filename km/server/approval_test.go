@@ -0,0 +1,101 @@
+package server
+
+import (
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/idp"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCountApprovals(t *testing.T) {
+	required := map[string]int{"security": 1, "platform-leads": 2}
+	approver := func(name string, groups ...string) idp.UserInfo {
+		return idp.UserInfo{Username: name, Groups: groups}
+	}
+
+	approvals, err := countApprovals(required, []idp.UserInfo{
+		approver("alice", "security", "platform-leads"),
+		approver("bob", "platform-leads"),
+		approver("carol", "everyone", "platform-leads"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"security": 1, "platform-leads": 2}, approvals)
+
+	// Alice can only count once, so one of the groups is short
+	_, err = countApprovals(required, []idp.UserInfo{
+		approver("alice", "security", "platform-leads"),
+		approver("bob", "platform-leads"),
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not enough approvals from: ")
+
+	_, err = countApprovals(required, []idp.UserInfo{
+		approver("alice", "security"),
+		approver("bob", "platform-leads"),
+		approver("carol", "security"),
+	})
+	assert.EqualError(t, err, "not enough approvals from: platform-leads (want: 2, got: 1)")
+
+	// Both groups short
+	_, err = countApprovals(required, []idp.UserInfo{
+		approver("bob", "platform-leads"),
+	})
+	assert.EqualError(t, err, "not enough approvals from: platform-leads (want: 2, got: 1), security (want: 1, got: 0)")
+	var apiErr *api.Error
+	if assert.True(t, errors.As(err, &apiErr)) {
+		assert.Equal(t, api.ErrorCodeNotEnoughApprovals, apiErr.Code)
+		assert.Equal(t, map[string]int{"platform-leads": 1, "security": 1}, apiErr.Details.MissingApprovals)
+	}
+
+	// A greedy assignment of alice to "x" would fail here
+	approvals, err = countApprovals(map[string]int{"x": 1, "y": 1}, []idp.UserInfo{
+		approver("alice", "x", "y"),
+		approver("bob", "x"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"x": 1, "y": 1}, approvals)
+
+	// Every assertion must come from an approver
+	_, err = countApprovals(required, []idp.UserInfo{
+		approver("alice", "security"),
+		approver("bob", "platform-leads"),
+		approver("carol", "platform-leads"),
+		approver("mallory", "everyone"),
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "mallory")
+
+	// No approvers required
+	approvals, err = countApprovals(nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, approvals)
+}
+
+func TestDistinctApprovers(t *testing.T) {
+	alice := idp.UserInfo{Username: "alice", Email: "alice@example.com", AssertionID: "id-1"}
+	alice2 := idp.UserInfo{Username: "Alice", Email: "alice@example.com", AssertionID: "id-2"}
+	aliceByEmail := idp.UserInfo{Username: "asmith", Email: "ALICE@example.com", AssertionID: "id-3"}
+	bob := idp.UserInfo{Username: "bob", Email: "bob@example.com", AssertionID: "id-4"}
+
+	approvers, err := distinctApprovers([]idp.UserInfo{alice, bob, alice2, aliceByEmail}, nil, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []idp.UserInfo{alice, bob}, approvers)
+
+	// The requester can't approve their own request...
+	_, err = distinctApprovers([]idp.UserInfo{bob, alice2}, &alice, false)
+	assert.EqualError(t, err, "requester alice cannot approve their own request")
+	_, err = distinctApprovers([]idp.UserInfo{aliceByEmail}, &alice, false)
+	assert.Error(t, err)
+
+	// ...unless the policy allows it
+	approvers, err = distinctApprovers([]idp.UserInfo{bob, alice2}, &alice, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []idp.UserInfo{bob, alice2}, approvers)
+
+	// Empty usernames and emails never match
+	anon := idp.UserInfo{AssertionID: "id-5"}
+	approvers, err = distinctApprovers([]idp.UserInfo{anon, anon}, &idp.UserInfo{}, false)
+	assert.NoError(t, err)
+	assert.Len(t, approvers, 2)
+}
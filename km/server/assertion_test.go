@@ -0,0 +1,221 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/beevik/etree"
+	"github.com/bsycorp/keymaster/km/api"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	dsig "github.com/russellhaering/goxmldsig"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Test IDP configuration & helpers for building signed SAML responses.
+
+const (
+	testIdpCertFile    = "testdata/idp.crt"
+	testIdpKeyFile     = "testdata/idp.key"
+	testIdpAudience    = "keymaster-saml"
+	testIdpRedirectURI = "https://workflow.example.com/1/saml/approve"
+)
+
+func testIdpConfig(name string) api.IdpConfig {
+	cert, err := ioutil.ReadFile(testIdpCertFile)
+	if err != nil {
+		panic(err)
+	}
+	return api.IdpConfig{
+		Name: name,
+		Type: "saml",
+		Config: &api.IdpConfigSaml{
+			Certificate:  string(cert),
+			Audience:     testIdpAudience,
+			UsernameAttr: "name",
+			EmailAttr:    "email",
+			GroupsAttr:   "groups",
+			RedirectURI:  testIdpRedirectURI,
+		},
+	}
+}
+
+type testKeyStore struct {
+	key  *rsa.PrivateKey
+	cert []byte
+}
+
+func (ks *testKeyStore) GetKeyPair() (*rsa.PrivateKey, []byte, error) {
+	return ks.key, ks.cert, nil
+}
+
+func loadTestKeyStore() *testKeyStore {
+	kp, err := tls.LoadX509KeyPair(testIdpCertFile, testIdpKeyFile)
+	if err != nil {
+		panic(err)
+	}
+	return &testKeyStore{
+		key:  kp.PrivateKey.(*rsa.PrivateKey),
+		cert: kp.Certificate[0],
+	}
+}
+
+// samlResponse builds a base64 encoded, signed SAML response for the
+// given user & groups, in response to inResponseTo.
+func samlResponse(inResponseTo string, username string, groups ...string) string {
+	return samlResponseWithID(inResponseTo, "_"+uuid.New().String(), username, groups...)
+}
+
+func samlResponseWithID(inResponseTo string, assertionID string, username string, groups ...string) string {
+	return signedSamlResponse(dsig.RSASHA256SignatureMethod, inResponseTo, assertionID, username, groups...)
+}
+
+func signedSamlResponse(sigAlg string, inResponseTo string, assertionID string, username string, groups ...string) string {
+	now := time.Now().UTC()
+	ts := func(t time.Time) string { return t.Format("2006-01-02T15:04:05Z") }
+	var groupValues strings.Builder
+	for _, g := range groups {
+		fmt.Fprintf(&groupValues, `<saml:AttributeValue>%s</saml:AttributeValue>`, g)
+	}
+	doc := fmt.Sprintf(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_%s" Version="2.0" IssueInstant="%s" InResponseTo="%s" Destination="%s">
+<saml:Issuer>test-idp</saml:Issuer>
+<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>
+<saml:Assertion ID="%s" Version="2.0" IssueInstant="%s">
+<saml:Issuer>test-idp</saml:Issuer>
+<saml:Subject>
+<saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">%s@example.com</saml:NameID>
+<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
+<saml:SubjectConfirmationData InResponseTo="%s" NotOnOrAfter="%s" Recipient="%s"/>
+</saml:SubjectConfirmation>
+</saml:Subject>
+<saml:Conditions NotBefore="%s" NotOnOrAfter="%s">
+<saml:AudienceRestriction><saml:Audience>%s</saml:Audience></saml:AudienceRestriction>
+</saml:Conditions>
+<saml:AttributeStatement>
+<saml:Attribute Name="name"><saml:AttributeValue>%s</saml:AttributeValue></saml:Attribute>
+<saml:Attribute Name="email"><saml:AttributeValue>%s@example.com</saml:AttributeValue></saml:Attribute>
+<saml:Attribute Name="groups">%s</saml:Attribute>
+</saml:AttributeStatement>
+</saml:Assertion>
+</samlp:Response>`,
+		uuid.New().String(), ts(now), inResponseTo, testIdpRedirectURI,
+		assertionID, ts(now),
+		username,
+		inResponseTo, ts(now.Add(5*time.Minute)), testIdpRedirectURI,
+		ts(now.Add(-time.Minute)), ts(now.Add(5*time.Minute)),
+		testIdpAudience,
+		username, username, groupValues.String())
+
+	xml := etree.NewDocument()
+	if err := xml.ReadFromString(doc); err != nil {
+		panic(err)
+	}
+	ctx := dsig.NewDefaultSigningContext(loadTestKeyStore())
+	if err := ctx.SetSignatureMethod(sigAlg); err != nil {
+		panic(err)
+	}
+	signed, err := ctx.SignEnveloped(xml.Root())
+	if err != nil {
+		panic(err)
+	}
+	xml.SetRoot(signed)
+	b, err := xml.WriteToBytes()
+	if err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// testOidcIdp is an OIDC IDP issuing RS256 signed ID tokens.
+type testOidcIdp struct {
+	key *rsa.PrivateKey
+}
+
+func newTestOidcIdp() *testOidcIdp {
+	kp, err := tls.LoadX509KeyPair(testIdpCertFile, testIdpKeyFile)
+	if err != nil {
+		panic(err)
+	}
+	return &testOidcIdp{key: kp.PrivateKey.(*rsa.PrivateKey)}
+}
+
+func (ti *testOidcIdp) jwks() string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	return fmt.Sprintf(`{"keys": [{"kid": "test-key", "kty": "RSA", "use": "sig", "n": "%s", "e": "%s"}]}`,
+		b64(ti.key.PublicKey.N.Bytes()), b64(big.NewInt(int64(ti.key.PublicKey.E)).Bytes()))
+}
+
+func (ti *testOidcIdp) config(name string) api.IdpConfig {
+	return api.IdpConfig{
+		Name: name,
+		Type: "oidc",
+		Config: &api.IdpConfigOidc{
+			Issuer:        "https://idp.example.com",
+			Audience:      "keymaster",
+			Jwks:          ti.jwks(),
+			UsernameClaim: "preferred_username",
+		},
+	}
+}
+
+func (ti *testOidcIdp) idToken(nonce string, username string, groups ...string) string {
+	now := time.Now()
+	return ti.sign(jwt.MapClaims{
+		"iss":                "https://idp.example.com",
+		"aud":                "keymaster",
+		"sub":                uuid.New().String(),
+		"preferred_username": username,
+		"email":              username + "@example.com",
+		"groups":             groups,
+		"nonce":              nonce,
+		"jti":                uuid.New().String(),
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+	})
+}
+
+// sign signs any claims (e.g. of a CI job token) with the IDP key
+func (ti *testOidcIdp) sign(claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test-key"
+	s, err := token.SignedString(ti.key)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// redirectQuery is the query string of a direct auth SAML response
+// signed as per the HTTP-Redirect binding, with the parameters encoded
+// by escape, since IDPs encode them differently.
+func redirectQuery(samlResponse string, relayState string, sigAlg string, escape func(string) string) string {
+	signed := "SAMLResponse=" + escape(samlResponse) +
+		"&RelayState=" + escape(relayState) +
+		"&SigAlg=" + escape(sigAlg)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, loadTestKeyStore().key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signed + "&Signature=" + escape(base64.StdEncoding.EncodeToString(sig))
+}
+
+// lowerHexEscape escapes as url.QueryEscape does, but with lower case
+// hex digits
+func lowerHexEscape(s string) string {
+	escaped := url.QueryEscape(s)
+	for i := 0; i < len(escaped); i++ {
+		if escaped[i] == '%' {
+			escaped = escaped[:i+1] + strings.ToLower(escaped[i+1:i+3]) + escaped[i+3:]
+		}
+	}
+	return escaped
+}
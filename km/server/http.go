@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/util"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+)
+
+// HTTPHandler serves the km API over HTTP. Requests are POSTed as JSON
+// to any path, as api.HTTPTransport sends them, so the server can sit
+// behind a path prefix. GET /healthz and /readyz are for load balancer
+// and Kubernetes probes.
+type HTTPHandler struct {
+	Server *Server
+
+	shuttingDown int32
+}
+
+func NewHTTPHandler(s *Server) *HTTPHandler {
+	return &HTTPHandler{Server: s}
+}
+
+// ShuttingDown makes the readiness check fail, so that load balancers
+// stop sending new requests while in flight requests finish.
+func (h *HTTPHandler) ShuttingDown() {
+	atomic.StoreInt32(&h.shuttingDown, 1)
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/healthz":
+		writeText(w, http.StatusOK, "ok")
+	case r.Method == http.MethodGet && r.URL.Path == "/readyz":
+		h.serveReady(w)
+	case r.Method == http.MethodPost:
+		h.serveAPI(w, r)
+	default:
+		w.Header().Set("Allow", "POST")
+		writeError(w, api.Errorf(api.ErrorCodeBadRequest, "method not allowed: %s", r.Method), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *HTTPHandler) serveReady(w http.ResponseWriter) {
+	if atomic.LoadInt32(&h.shuttingDown) != 0 {
+		writeText(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	if err := h.Server.Ready(); err != nil {
+		writeText(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writeText(w, http.StatusOK, "ok")
+}
+
+func (h *HTTPHandler) serveAPI(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, util.MaxRequestBytes))
+	if err != nil {
+		writeError(w, api.Errorf(api.ErrorCodeBadRequest, "error reading request: %s", err), 0)
+		return
+	}
+	var req api.Request
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, api.Errorf(api.ErrorCodeBadRequest, "invalid request: %s", err), 0)
+		return
+	}
+	resp, err := h.Server.Handle(&req)
+	if err != nil {
+		log.Println("Request error:", req.Type, err)
+		writeError(w, api.ToError(err), 0)
+		return
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		writeError(w, api.Errorf(api.ErrorCodeInternal, "error encoding response: %s", err), 0)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// writeError writes the error envelope, with the status for the error
+// code unless one is given.
+func writeError(w http.ResponseWriter, apiErr *api.Error, status int) {
+	if status == 0 {
+		status = apiErr.Code.HTTPStatus()
+	}
+	data, _ := json.Marshal(api.ErrorResponse{Error: apiErr})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func writeText(w http.ResponseWriter, status int, text string) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(status)
+	w.Write([]byte(text + "\n"))
+}
+
+// Ready checks the server is configured well enough to handle requests.
+func (s *Server) Ready() error {
+	if s.Config.Name == "" {
+		return errors.New("not configured")
+	}
+	if s.Replay == nil {
+		return errors.New("no replay cache configured")
+	}
+	if _, err := s.issuingNonceKey(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// HandleAPIGatewayProxy serves an API Gateway (REST API) Lambda proxy
+// event with an HTTPHandler, so that the issuing lambda can be put
+// behind API Gateway with no mapping templates.
+func (s *Server) HandleAPIGatewayProxy(event *events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
+	body := []byte(event.Body)
+	if event.IsBase64Encoded {
+		var err error
+		body, err = base64.StdEncoding.DecodeString(event.Body)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid base64 request body")
+		}
+	}
+	path := event.Path
+	if path == "" {
+		path = "/"
+	}
+	r, err := http.NewRequest(event.HTTPMethod, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid api gateway request")
+	}
+	// Headers only has the last value of repeated headers
+	for name, value := range event.Headers {
+		r.Header.Set(name, value)
+	}
+	for name, values := range event.MultiValueHeaders {
+		r.Header.Del(name)
+		for _, value := range values {
+			r.Header.Add(name, value)
+		}
+	}
+	rec := httptest.NewRecorder()
+	NewHTTPHandler(s).ServeHTTP(rec, r)
+	return &events.APIGatewayProxyResponse{
+		StatusCode:        rec.Code,
+		MultiValueHeaders: rec.Header(),
+		Body:              rec.Body.String(),
+	}, nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/base64"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	handler := NewHTTPHandler(newTestServer())
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	client := &api.Client{Transport: api.NewHTTPTransport(ts.URL + "/km")}
+
+	resp, err := client.WorkflowStart(&api.WorkflowStartRequest{Role: "deployment"})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, resp.IssuingNonce)
+
+	_, err = client.WorkflowStart(&api.WorkflowStartRequest{Role: "admin"})
+	var apiErr *api.Error
+	if assert.True(t, errors.As(err, &apiErr)) {
+		assert.Equal(t, api.ErrorCodeRoleNotFound, apiErr.Code)
+	}
+
+	r, err := http.Get(ts.URL + "/healthz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	r, err = http.Get(ts.URL + "/readyz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	r, err = http.Get(ts.URL + "/")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, r.StatusCode)
+	r, err = http.Post(ts.URL+"/", "application/json", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+
+	handler.ShuttingDown()
+	r, err = http.Get(ts.URL + "/readyz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, r.StatusCode)
+}
+
+func TestServer_Ready(t *testing.T) {
+	s := newTestServer()
+	assert.NoError(t, s.Ready())
+	s.Config.IssuingNonce.SigningKey = ""
+	assert.Error(t, s.Ready())
+	assert.Error(t, (&Server{}).Ready())
+}
+
+func TestServer_HandleAPIGatewayProxy(t *testing.T) {
+	s := newTestServer()
+	resp, err := s.HandleAPIGatewayProxy(&events.APIGatewayProxyRequest{
+		HTTPMethod: http.MethodPost,
+		Path:       "/",
+		Body:       `{"type":"discovery","payload":{}}`,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"application/json"}, resp.MultiValueHeaders["Content-Type"])
+	assert.Contains(t, resp.Body, `"protocol_versions":["1.0"]`)
+
+	resp, err = s.HandleAPIGatewayProxy(&events.APIGatewayProxyRequest{
+		HTTPMethod:      http.MethodPost,
+		Path:            "/",
+		Body:            base64.StdEncoding.EncodeToString([]byte(`{"type":"workflow_start","payload":{"role":"admin"}}`)),
+		IsBase64Encoded: true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, resp.Body, `"code":"role_not_found"`)
+
+	resp, err = s.HandleAPIGatewayProxy(&events.APIGatewayProxyRequest{
+		HTTPMethod: http.MethodGet,
+		Path:       "/healthz",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// All response headers are passed back
+	resp, err = s.HandleAPIGatewayProxy(&events.APIGatewayProxyRequest{
+		HTTPMethod:        http.MethodDelete,
+		Path:              "/",
+		Headers:           map[string]string{"Accept": "text/plain"},
+		MultiValueHeaders: map[string][]string{"Accept": {"application/json", "text/plain"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	assert.Equal(t, []string{"POST"}, resp.MultiValueHeaders["Allow"])
+}
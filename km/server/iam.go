@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/xml"
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/idp"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// IAM auth, in the style of Vault's aws auth method: the client signs
+// an sts:GetCallerIdentity request (but doesn't send it) and gives it to
+// us. We send it to STS, and the response tells us who signed it. STS
+// checks the signature, so we need no AWS credentials or permissions of
+// our own.
+
+const stsRequestTimeout = 10 * time.Second
+
+type callerIdentity struct {
+	Arn     string `xml:"GetCallerIdentityResult>Arn"`
+	UserId  string `xml:"GetCallerIdentityResult>UserId"`
+	Account string `xml:"GetCallerIdentityResult>Account"`
+}
+
+func (s *Server) HandleIAMAuth(req *api.IAMAuthRequest) (*api.DirectAuthResponse, error) {
+	role := s.Config.FindRoleByName(req.RequestedRole)
+	if role == nil {
+		return nil, roleNotFound(req.RequestedRole)
+	}
+	if len(role.IAMPrincipals) == 0 {
+		return nil, api.Errorf(api.ErrorCodeForbidden, "requested role does not allow iam auth: %s", role.Name)
+	}
+	identity, err := s.getCallerIdentity(req)
+	if err != nil {
+		return nil, err
+	}
+	roleArn := canonicalArn(identity.Arn)
+	if !role.AllowsIAMPrincipal(identity.Arn, roleArn) {
+		return nil, api.Errorf(api.ErrorCodeForbidden, "iam principal %s is not allowed role: %s", identity.Arn, role.Name)
+	}
+	log.Println("IAM auth:", identity.Arn, "role:", role.Name)
+	issuedCreds, err := s.issue(role, &idp.UserInfo{Username: roleArn})
+	if err != nil {
+		return nil, err
+	}
+	return &api.DirectAuthResponse{
+		Credentials: issuedCreds,
+	}, nil
+}
+
+// getCallerIdentity checks the signed request is a GetCallerIdentity
+// call made for this keymaster environment, and sends it to STS.
+func (s *Server) getCallerIdentity(req *api.IAMAuthRequest) (*callerIdentity, error) {
+	if req.Method != http.MethodPost {
+		return nil, api.Errorf(api.ErrorCodeBadRequest, "sts request has unexpected method: %s", req.Method)
+	}
+	endpoint := s.Config.IAMAuth.STSEndpoint
+	if endpoint == "" {
+		endpoint = api.DefaultSTSEndpoint
+	}
+	// The request is always sent to the configured endpoint; the URL is
+	// only checked so a mismatch gives a clearer error than STS would.
+	if strings.TrimSuffix(req.URL, "/") != strings.TrimSuffix(endpoint, "/") {
+		return nil, api.Errorf(api.ErrorCodeBadRequest, "sts request is for unexpected endpoint: %s", req.URL)
+	}
+	body, err := url.ParseQuery(req.Body)
+	if err != nil {
+		return nil, api.WrapError(err, api.ErrorCodeBadRequest, "invalid sts request body")
+	}
+	if len(body) != 2 || body.Get("Action") != "GetCallerIdentity" || body.Get("Version") == "" {
+		return nil, api.Errorf(api.ErrorCodeBadRequest, "sts request is not GetCallerIdentity: %s", req.Body)
+	}
+	headers := http.Header(req.Headers)
+	if headers.Get(api.IAMServerIDHeader) != s.Config.Name {
+		return nil, api.Errorf(api.ErrorCodeBadRequest, "sts request is for another server: %s", headers.Get(api.IAMServerIDHeader))
+	}
+	if !isSignedHeader(headers.Get("Authorization"), api.IAMServerIDHeader) {
+		return nil, api.Errorf(api.ErrorCodeBadRequest, "sts request does not sign the %s header", api.IAMServerIDHeader)
+	}
+
+	stsReq, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(req.Body))
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating sts request")
+	}
+	for name, values := range headers {
+		// Set by net/http itself
+		if strings.EqualFold(name, "Content-Length") || strings.EqualFold(name, "Host") {
+			continue
+		}
+		stsReq.Header[name] = values
+	}
+	client := &http.Client{Timeout: stsRequestTimeout}
+	resp, err := client.Do(stsReq)
+	if err != nil {
+		return nil, api.WrapError(err, api.ErrorCodeUnavailable, "error sending sts request")
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, api.WrapError(err, api.ErrorCodeUnavailable, "error reading sts response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		// STS rejects bad signatures with a 4xx
+		code := api.ErrorCodeInvalidAssertion
+		if resp.StatusCode >= 500 {
+			code = api.ErrorCodeUnavailable
+		}
+		return nil, api.Errorf(code, "sts request failed, status: %d, response: %s", resp.StatusCode, string(respBody))
+	}
+	var identity callerIdentity
+	err = xml.Unmarshal(respBody, &identity)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid sts response")
+	}
+	if identity.Arn == "" {
+		return nil, errors.New("sts response has no arn")
+	}
+	return &identity, nil
+}
+
+// isSignedHeader checks a SigV4 Authorization header covers the header
+func isSignedHeader(authorization string, header string) bool {
+	for _, part := range strings.Split(authorization, ",") {
+		part = strings.TrimSpace(part)
+		if i := strings.Index(part, "SignedHeaders="); i >= 0 {
+			for _, signed := range strings.Split(part[i+len("SignedHeaders="):], ";") {
+				if strings.EqualFold(signed, header) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// canonicalArn returns the IAM role ARN for an assumed role session ARN,
+// e.g. arn:aws:sts::123456789012:assumed-role/ci-runner/i-0abc becomes
+// arn:aws:iam::123456789012:role/ci-runner. Other ARNs are unchanged.
+// (The role's path isn't in the session ARN, so can't be matched on.)
+func canonicalArn(arn string) string {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[2] != "sts" || !strings.HasPrefix(parts[5], "assumed-role/") {
+		return arn
+	}
+	resource := strings.Split(parts[5], "/")
+	if len(resource) != 3 {
+		return arn
+	}
+	return strings.Join([]string{parts[0], parts[1], "iam", "", parts[4], "role/" + resource[1]}, ":")
+}
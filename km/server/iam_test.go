@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// stubSTS answers GetCallerIdentity with the ARN for the access key
+// the request was signed with. It doesn't check signatures.
+func stubSTS(t *testing.T, arns map[string]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal(t, "Action=GetCallerIdentity&Version=2011-06-15", string(body))
+		assert.Equal(t, "foo.io", r.Header.Get(api.IAMServerIDHeader))
+		for accessKey, arn := range arns {
+			if strings.Contains(r.Header.Get("Authorization"), "Credential="+accessKey+"/") {
+				fmt.Fprintf(w, `<GetCallerIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <GetCallerIdentityResult>
+    <Arn>%s</Arn>
+    <UserId>AROAEXAMPLE:session</UserId>
+    <Account>123456789012</Account>
+  </GetCallerIdentityResult>
+  <ResponseMetadata><RequestId>01234567-89ab-cdef-0123-456789abcdef</RequestId></ResponseMetadata>
+</GetCallerIdentityResponse>`, arn)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `<ErrorResponse><Error><Code>InvalidClientTokenId</Code></Error></ErrorResponse>`)
+	}))
+}
+
+func iamAuthRequest(t *testing.T, endpoint string, accessKey string, role string, serverID string) *api.IAMAuthRequest {
+	sess, err := session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(endpoint),
+		Credentials: credentials.NewStaticCredentials(accessKey, "secret", ""),
+	})
+	assert.NoError(t, err)
+	req, err := api.NewIAMAuthRequest(sess, role, serverID)
+	assert.NoError(t, err)
+	return req
+}
+
+func TestServer_HandleIAMAuth(t *testing.T) {
+	sts := stubSTS(t, map[string]string{
+		"AKIARUNNER": "arn:aws:sts::123456789012:assumed-role/ci-runner/i-0abc",
+		"AKIAOTHER":  "arn:aws:sts::123456789012:assumed-role/developer/alice",
+	})
+	defer sts.Close()
+	s := newTestServer()
+	s.Config.IAMAuth.STSEndpoint = sts.URL + "/"
+	s.Config.Roles[0].IAMPrincipals = []string{"arn:aws:iam::123456789012:role/ci-*"}
+
+	resp, err := s.HandleIAMAuth(iamAuthRequest(t, sts.URL, "AKIARUNNER", "deployment", "foo.io"))
+	assert.NoError(t, err)
+	assert.Equal(t, "arn:aws:iam::123456789012:role/ci-runner",
+		sshUsername(t, &api.WorkflowAuthResponse{Credentials: resp.Credentials}))
+
+	_, err = s.HandleIAMAuth(iamAuthRequest(t, sts.URL, "AKIAOTHER", "deployment", "foo.io"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is not allowed role")
+	_, err = s.HandleIAMAuth(iamAuthRequest(t, sts.URL, "AKIAUNKNOWN", "deployment", "foo.io"))
+	assert.Error(t, err)
+	_, err = s.HandleIAMAuth(iamAuthRequest(t, sts.URL, "AKIARUNNER", "developer", "foo.io"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not allow iam auth")
+
+	// Requests for another keymaster environment
+	_, err = s.HandleIAMAuth(iamAuthRequest(t, sts.URL, "AKIARUNNER", "deployment", "bar.io"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "another server")
+
+	// Anything but GetCallerIdentity
+	req := iamAuthRequest(t, sts.URL, "AKIARUNNER", "deployment", "foo.io")
+	req.Body = "Action=AssumeRole&Version=2011-06-15&RoleArn=x"
+	_, err = s.HandleIAMAuth(req)
+	assert.Error(t, err)
+
+	// Server ID header must be signed
+	req = iamAuthRequest(t, sts.URL, "AKIARUNNER", "deployment", "foo.io")
+	req.Headers["Authorization"] = []string{strings.Replace(req.Headers["Authorization"][0], ";x-keymaster-server-id", "", 1)}
+	_, err = s.HandleIAMAuth(req)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not sign")
+
+	// Requests for other endpoints
+	req = iamAuthRequest(t, "https://sts.evil.example.com", "AKIARUNNER", "deployment", "foo.io")
+	_, err = s.HandleIAMAuth(req)
+	assert.Error(t, err)
+}
+
+func TestCanonicalArn(t *testing.T) {
+	assert.Equal(t, "arn:aws:iam::123456789012:role/ci-runner",
+		canonicalArn("arn:aws:sts::123456789012:assumed-role/ci-runner/i-0abc"))
+	assert.Equal(t, "arn:aws:iam::123456789012:user/alice",
+		canonicalArn("arn:aws:iam::123456789012:user/alice"))
+	assert.Equal(t, "arn:aws-cn:iam::123456789012:role/ci",
+		canonicalArn("arn:aws-cn:sts::123456789012:assumed-role/ci/session"))
+	assert.Equal(t, "not-an-arn", canonicalArn("not-an-arn"))
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/idp"
+	"github.com/bsycorp/keymaster/km/idp/oidc"
+	"github.com/bsycorp/keymaster/km/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// Roles can be bound to the claims of tokens issued to CI jobs (and
+// similar machine identities). A job presenting a valid token whose
+// claims match one of a role's rules gets the role's credentials with
+// no workflow. Job tokens are bearer tokens meant to be used for the
+// life of the job, so unlike approvals they can be used more than once.
+
+func (s *Server) jwtVerifier(issuerName string, c *api.JWTIssuerConfig) (*oidc.Verifier, error) {
+	if c.Jwks == "" {
+		return nil, api.Errorf(api.ErrorCodeConfig, "%s is not configured", issuerName)
+	}
+	jwks, err := util.Load(c.Jwks)
+	if err != nil {
+		return nil, api.WrapError(err, api.ErrorCodeConfig, fmt.Sprintf("error loading %s jwks", issuerName))
+	}
+	keys, err := oidc.ParseKeySet(jwks)
+	if err != nil {
+		return nil, api.WrapError(err, api.ErrorCodeConfig, fmt.Sprintf("error parsing %s jwks", issuerName))
+	}
+	return &oidc.Verifier{
+		Issuer:   c.Issuer,
+		Audience: c.Audience,
+		Keys:     keys,
+		Clock:    s.Clock,
+	}, nil
+}
+
+// jobTokenAuth verifies a job token and issues the role's credentials
+// if its claims match the rules. The job is identified to credential
+// issuers by the usernameClaim.
+func (s *Server) jobTokenAuth(issuerName string, c *api.JWTIssuerConfig, role *api.RoleConfig, rules []api.ClaimRule, token string, usernameClaim string) (*api.DirectAuthResponse, error) {
+	if len(rules) == 0 {
+		return nil, api.Errorf(api.ErrorCodeForbidden, "requested role does not allow %s auth: %s", issuerName, role.Name)
+	}
+	verifier, err := s.jwtVerifier(issuerName, c)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := verifier.Verify(token)
+	if err != nil {
+		return nil, api.WrapError(err, api.ErrorCodeInvalidAssertion, fmt.Sprintf("%s token validation error", issuerName))
+	}
+	username := oidc.StringClaim(claims, usernameClaim)
+	if username == "" {
+		return nil, api.Errorf(api.ErrorCodeInvalidAssertion, "%s token has no %s claim", issuerName, usernameClaim)
+	}
+	if !api.MatchesAny(rules, claims) {
+		return nil, api.Errorf(api.ErrorCodeForbidden, "%s token for %s does not match any rule for role: %s",
+			issuerName, username, role.Name)
+	}
+	log.Println("Job token auth:", issuerName, username, "role:", role.Name)
+	issuedCreds, err := s.issue(role, &idp.UserInfo{Username: username})
+	if err != nil {
+		return nil, err
+	}
+	return &api.DirectAuthResponse{
+		Credentials: issuedCreds,
+	}, nil
+}
+
+func (s *Server) HandleGitlabJobAuth(req *api.GitlabJobAuthRequest) (*api.DirectAuthResponse, error) {
+	role := s.Config.FindRoleByName(req.RequestedRole)
+	if role == nil {
+		return nil, roleNotFound(req.RequestedRole)
+	}
+	return s.jobTokenAuth("gitlab", &s.Config.Gitlab, role, role.GitlabClaims, req.JobJWT, "project_path")
+}
+
+func (s *Server) HandleGithubActionsAuth(req *api.GithubActionsAuthRequest) (*api.DirectAuthResponse, error) {
+	role := s.Config.FindRoleByName(req.RequestedRole)
+	if role == nil {
+		return nil, roleNotFound(req.RequestedRole)
+	}
+	return s.jobTokenAuth("github", &s.Config.Github, role, role.GithubClaims, req.Token, "repository")
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"github.com/bsycorp/keymaster/km/api"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func gitlabJobJWT(ti *testOidcIdp, projectPath string, ref string, protected bool, environment string) string {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":           "gitlab.example.com",
+		"sub":           "job_1234",
+		"namespace_id":  "1",
+		"project_path":  projectPath,
+		"ref":           ref,
+		"ref_type":      "branch",
+		"ref_protected": "false",
+		"user_login":    "alice",
+		"iat":           now.Unix(),
+		"nbf":           now.Add(-time.Second).Unix(),
+		"exp":           now.Add(time.Hour).Unix(),
+	}
+	if protected {
+		claims["ref_protected"] = "true"
+	}
+	if environment != "" {
+		claims["environment"] = environment
+	}
+	return ti.sign(claims)
+}
+
+func TestServer_HandleGitlabJobAuth(t *testing.T) {
+	s := newTestServer()
+	ti := newTestOidcIdp()
+	s.Config.Gitlab = api.JWTIssuerConfig{
+		Issuer: "gitlab.example.com",
+		Jwks:   ti.jwks(),
+	}
+	s.Config.Roles[0].GitlabClaims = []api.ClaimRule{
+		{"project_path": "platform/*", "ref_protected": "true", "environment": "production"},
+	}
+	assert.NoError(t, s.Config.Validate())
+	gitlabAuth := func(role string, token string) (*api.DirectAuthResponse, error) {
+		return s.HandleGitlabJobAuth(&api.GitlabJobAuthRequest{RequestedRole: role, JobJWT: token})
+	}
+
+	token := gitlabJobJWT(ti, "platform/deploy", "main", true, "production")
+	resp, err := gitlabAuth("deployment", token)
+	assert.NoError(t, err)
+	assert.Equal(t, "platform/deploy", sshUsername(t, &api.WorkflowAuthResponse{Credentials: resp.Credentials}))
+
+	// Job tokens can be used for the life of the job
+	_, err = gitlabAuth("deployment", token)
+	assert.NoError(t, err)
+
+	// Unprotected branches, other projects and environments don't match
+	_, err = gitlabAuth("deployment", gitlabJobJWT(ti, "platform/deploy", "feature", false, "production"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not match any rule")
+	_, err = gitlabAuth("deployment", gitlabJobJWT(ti, "apps/web", "main", true, "production"))
+	assert.Error(t, err)
+	_, err = gitlabAuth("deployment", gitlabJobJWT(ti, "platform/deploy", "main", true, ""))
+	assert.Error(t, err)
+
+	// Roles without rules are workflow only
+	_, err = gitlabAuth("developer", token)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not allow gitlab auth")
+
+	// Tokens from another gitlab
+	s.Config.Gitlab.Issuer = "gitlab.com"
+	_, err = gitlabAuth("deployment", token)
+	assert.Error(t, err)
+
+	s.Config.Gitlab = api.JWTIssuerConfig{}
+	_, err = gitlabAuth("deployment", token)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "gitlab is not configured")
+}
+
+func githubActionsToken(ti *testOidcIdp, repository string, ref string, environment string, jobWorkflowRef string) string {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":              "https://token.actions.githubusercontent.com",
+		"aud":              "keymaster",
+		"sub":              "repo:" + repository + ":ref:" + ref,
+		"repository":       repository,
+		"repository_owner": "bsycorp",
+		"ref":              ref,
+		"job_workflow_ref": jobWorkflowRef,
+		"event_name":       "push",
+		"iat":              now.Unix(),
+		"nbf":              now.Unix(),
+		"exp":              now.Add(5 * time.Minute).Unix(),
+	}
+	if environment != "" {
+		claims["environment"] = environment
+	}
+	return ti.sign(claims)
+}
+
+func TestServer_HandleGithubActionsAuth(t *testing.T) {
+	s := newTestServer()
+	ti := newTestOidcIdp()
+	s.Config.Github = api.JWTIssuerConfig{
+		Issuer:   "https://token.actions.githubusercontent.com",
+		Audience: "keymaster",
+		Jwks:     ti.jwks(),
+	}
+	s.Config.Roles[0].GithubClaims = []api.ClaimRule{
+		{
+			"repository":       "bsycorp/keymaster",
+			"ref":              "refs/heads/master",
+			"environment":      "production",
+			"job_workflow_ref": "bsycorp/workflows/.github/workflows/deploy.yml@refs/heads/*",
+		},
+	}
+	assert.NoError(t, s.Config.Validate())
+	githubAuth := func(role string, token string) (*api.DirectAuthResponse, error) {
+		return s.HandleGithubActionsAuth(&api.GithubActionsAuthRequest{RequestedRole: role, Token: token})
+	}
+	deployWorkflow := "bsycorp/workflows/.github/workflows/deploy.yml@refs/heads/master"
+
+	resp, err := githubAuth("deployment", githubActionsToken(ti, "bsycorp/keymaster", "refs/heads/master", "production", deployWorkflow))
+	assert.NoError(t, err)
+	assert.Equal(t, "bsycorp/keymaster", sshUsername(t, &api.WorkflowAuthResponse{Credentials: resp.Credentials}))
+
+	_, err = githubAuth("deployment", githubActionsToken(ti, "bsycorp/keymaster", "refs/heads/feature", "production", deployWorkflow))
+	assert.Error(t, err)
+	_, err = githubAuth("deployment", githubActionsToken(ti, "bsycorp/keymaster", "refs/heads/master", "staging", deployWorkflow))
+	assert.Error(t, err)
+	_, err = githubAuth("deployment", githubActionsToken(ti, "bsycorp/keymaster", "refs/heads/master", "production",
+		"bsycorp/keymaster/.github/workflows/other.yml@refs/heads/master"))
+	assert.Error(t, err)
+	_, err = githubAuth("developer", githubActionsToken(ti, "bsycorp/keymaster", "refs/heads/master", "production", deployWorkflow))
+	assert.Error(t, err)
+
+	// Tokens requested for another audience
+	s.Config.Github.Audience = "sts.amazonaws.com"
+	_, err = githubAuth("deployment", githubActionsToken(ti, "bsycorp/keymaster", "refs/heads/master", "production", deployWorkflow))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "audience")
+}
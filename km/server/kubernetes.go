@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/idp/oidc"
+	"github.com/bsycorp/keymaster/km/util"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Kubernetes service account token auth. Tokens are verified offline
+// against the service account issuer's JWKS if configured, otherwise
+// with a TokenReview by the cluster's API server.
+
+const tokenReviewTimeout = 10 * time.Second
+
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     tokenReviewStatus `json:"status"`
+}
+
+type tokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool     `json:"authenticated"`
+	Audiences     []string `json:"audiences"`
+	Error         string   `json:"error"`
+	User          struct {
+		Username string `json:"username"`
+		UID      string `json:"uid"`
+	} `json:"user"`
+}
+
+func (s *Server) HandleKubernetesAuth(req *api.KubernetesAuthRequest) (*api.DirectAuthResponse, error) {
+	role := s.Config.FindRoleByName(req.RequestedRole)
+	if role == nil {
+		return nil, roleNotFound(req.RequestedRole)
+	}
+	if len(role.KubernetesServiceAccounts) == 0 {
+		return nil, api.Errorf(api.ErrorCodeForbidden, "requested role does not allow kubernetes auth: %s", role.Name)
+	}
+	var sa *api.ServiceAccountInfo
+	var audiences []string
+	var err error
+	if s.Config.Kubernetes.Jwks != "" {
+		sa, audiences, err = s.verifyServiceAccountToken(req.Token)
+	} else {
+		sa, audiences, err = s.reviewServiceAccountToken(req.Token, role.ServiceAccountAudiences())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !role.AllowsServiceAccount(sa.Namespace, sa.Name, audiences) {
+		return nil, api.Errorf(api.ErrorCodeForbidden, "service account %s/%s with token audience %s is not allowed role: %s",
+			sa.Namespace, sa.Name, audiences, role.Name)
+	}
+	log.Println("Kubernetes auth:", sa.Namespace+"/"+sa.Name, "role:", role.Name)
+
+	// Not named as Kubernetes does, so that the credentials get none of
+	// the grants for service accounts in the clusters they are used in
+	cluster := "keymaster:k8s:" + s.Config.Kubernetes.Cluster
+	issuedCreds, err := s.issueFor(role, &api.AuthInfo{
+		Environment:    s.Config.Name,
+		Role:           role.Name,
+		Username:       cluster + ":" + sa.Namespace + ":" + sa.Name,
+		Groups:         []string{cluster + ":" + sa.Namespace},
+		ValidFor:       role.ValidForSeconds,
+		ServiceAccount: sa,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &api.DirectAuthResponse{
+		Credentials: issuedCreds,
+	}, nil
+}
+
+// verifyServiceAccountToken returns the token's service account and
+// audiences. The audiences are checked against the role's bindings.
+func (s *Server) verifyServiceAccountToken(token string) (*api.ServiceAccountInfo, []string, error) {
+	k := &s.Config.Kubernetes
+	verifier, err := s.jwtVerifier("kubernetes", &api.JWTIssuerConfig{
+		Issuer: k.Issuer,
+		Jwks:   k.Jwks,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	claims, err := verifier.Verify(token)
+	if err != nil {
+		return nil, nil, api.WrapError(err, api.ErrorCodeInvalidAssertion, "kubernetes token validation error")
+	}
+	// Projected tokens have a "kubernetes.io" claim
+	var k8s struct {
+		Namespace      string `json:"namespace"`
+		ServiceAccount struct {
+			Name string `json:"name"`
+			UID  string `json:"uid"`
+		} `json:"serviceaccount"`
+	}
+	b, err := json.Marshal(claims["kubernetes.io"])
+	if err == nil {
+		err = json.Unmarshal(b, &k8s)
+	}
+	if err != nil || k8s.Namespace == "" || k8s.ServiceAccount.Name == "" {
+		return nil, nil, api.Errorf(api.ErrorCodeInvalidAssertion, "kubernetes token is not a service account token")
+	}
+	sa := &api.ServiceAccountInfo{
+		Namespace: k8s.Namespace,
+		Name:      k8s.ServiceAccount.Name,
+		UID:       k8s.ServiceAccount.UID,
+	}
+	if sub := oidc.StringClaim(claims, "sub"); sub != "system:serviceaccount:"+sa.Namespace+":"+sa.Name {
+		return nil, nil, api.Errorf(api.ErrorCodeInvalidAssertion, "kubernetes token subject does not match service account: %s", sub)
+	}
+	return sa, oidc.StringsClaim(claims, "aud"), nil
+}
+
+// reviewServiceAccountToken returns the token's service account, and
+// which of the audiences it is for
+func (s *Server) reviewServiceAccountToken(token string, audiences []string) (*api.ServiceAccountInfo, []string, error) {
+	k := &s.Config.Kubernetes
+	if k.Server == "" || len(audiences) == 0 {
+		return nil, nil, api.Errorf(api.ErrorCodeConfig, "kubernetes auth is not configured")
+	}
+	review := tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec: tokenReviewSpec{
+			Token:     token,
+			Audiences: audiences,
+		},
+	}
+	body, err := json.Marshal(&review)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost,
+		strings.TrimSuffix(k.Server, "/")+"/apis/authentication.k8s.io/v1/tokenreviews", bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error creating token review")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if k.ReviewerToken != "" {
+		reviewerToken, err := util.Load(k.ReviewerToken)
+		if err != nil {
+			return nil, nil, api.WrapError(err, api.ErrorCodeConfig, "error loading kubernetes reviewer token")
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(reviewerToken)))
+	}
+	client := &http.Client{Timeout: tokenReviewTimeout}
+	if k.ServerCA != "" {
+		serverCA, err := util.Load(k.ServerCA)
+		if err != nil {
+			return nil, nil, api.WrapError(err, api.ErrorCodeConfig, "error loading kubernetes server ca")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(serverCA) {
+			return nil, nil, api.Errorf(api.ErrorCodeConfig, "invalid kubernetes server ca")
+		}
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, api.WrapError(err, api.ErrorCodeUnavailable, "error sending token review")
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, api.WrapError(err, api.ErrorCodeUnavailable, "error reading token review")
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		// A 4xx means our reviewer token isn't allowed to create reviews
+		code := api.ErrorCodeConfig
+		if resp.StatusCode >= 500 {
+			code = api.ErrorCodeUnavailable
+		}
+		return nil, nil, api.Errorf(code, "token review failed, status: %d, response: %s", resp.StatusCode, string(respBody))
+	}
+	var result tokenReview
+	err = json.Unmarshal(respBody, &result)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "invalid token review response")
+	}
+	if !result.Status.Authenticated {
+		return nil, nil, api.Errorf(api.ErrorCodeInvalidAssertion, "kubernetes token not authenticated: %s", result.Status.Error)
+	}
+	parts := strings.Split(result.Status.User.Username, ":")
+	if len(parts) != 4 || parts[0] != "system" || parts[1] != "serviceaccount" {
+		return nil, nil, api.Errorf(api.ErrorCodeInvalidAssertion, "kubernetes token is not for a service account: %s", result.Status.User.Username)
+	}
+	return &api.ServiceAccountInfo{
+		Namespace: parts[2],
+		Name:      parts[3],
+		UID:       result.Status.User.UID,
+	}, result.Status.Audiences, nil
+}
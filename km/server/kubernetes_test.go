@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/bsycorp/keymaster/km/api"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func serviceAccountToken(ti *testOidcIdp, audience string, namespace string, name string) string {
+	now := time.Now()
+	return ti.sign(jwt.MapClaims{
+		"iss": "https://kubernetes.default.svc",
+		"aud": []string{audience},
+		"sub": "system:serviceaccount:" + namespace + ":" + name,
+		"kubernetes.io": map[string]interface{}{
+			"namespace": namespace,
+			"pod":       map[string]string{"name": "deployer-abc", "uid": "pod-uid"},
+			"serviceaccount": map[string]string{
+				"name": name,
+				"uid":  "sa-uid",
+			},
+		},
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	})
+}
+
+func TestServer_HandleKubernetesAuth(t *testing.T) {
+	s := newTestServer()
+	ti := newTestOidcIdp()
+	s.Config.Kubernetes = api.KubernetesAuthConfig{
+		Cluster: "ci-cluster",
+		Issuer:  "https://kubernetes.default.svc",
+		Jwks:    ti.jwks(),
+	}
+	s.Config.Roles[0].KubernetesServiceAccounts = []api.ServiceAccountBinding{
+		{Namespace: "ci", ServiceAccount: "deployer", Audience: "keymaster"},
+		{Namespace: "team-*", ServiceAccount: "deployer", Audience: "keymaster-teams"},
+	}
+	assert.NoError(t, s.Config.Validate())
+	k8sAuth := func(role string, token string) (*api.DirectAuthResponse, error) {
+		return s.HandleKubernetesAuth(&api.KubernetesAuthRequest{RequestedRole: role, Token: token})
+	}
+
+	// Named by keymaster, so the credentials don't get the grants of
+	// the same service account in the target cluster
+	resp, err := k8sAuth("deployment", serviceAccountToken(ti, "keymaster", "ci", "deployer"))
+	assert.NoError(t, err)
+	assert.Equal(t, "keymaster:k8s:ci-cluster:ci:deployer",
+		sshUsername(t, &api.WorkflowAuthResponse{Credentials: resp.Credentials}))
+	_, err = k8sAuth("deployment", serviceAccountToken(ti, "keymaster-teams", "team-a", "deployer"))
+	assert.NoError(t, err)
+	// Each binding has its own audience
+	_, err = k8sAuth("deployment", serviceAccountToken(ti, "keymaster", "team-a", "deployer"))
+	assert.Error(t, err)
+
+	_, err = k8sAuth("deployment", serviceAccountToken(ti, "keymaster", "ci", "default"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is not allowed role")
+	_, err = k8sAuth("deployment", serviceAccountToken(ti, "keymaster", "kube-system", "deployer"))
+	assert.Error(t, err)
+	_, err = k8sAuth("developer", serviceAccountToken(ti, "keymaster", "ci", "deployer"))
+	assert.Error(t, err)
+
+	// Tokens for the API server (or anything else)
+	_, err = k8sAuth("deployment", serviceAccountToken(ti, "https://kubernetes.default.svc", "ci", "deployer"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "audience")
+
+	// ID tokens from the same issuer which aren't service account tokens
+	_, err = k8sAuth("deployment", ti.sign(jwt.MapClaims{
+		"iss": "https://kubernetes.default.svc",
+		"aud": "keymaster",
+		"sub": "system:serviceaccount:ci:deployer",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}))
+	assert.Error(t, err)
+}
+
+func TestServer_HandleKubernetesAuthTokenReview(t *testing.T) {
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/apis/authentication.k8s.io/v1/tokenreviews", r.URL.Path)
+		assert.Equal(t, "Bearer reviewer-token", r.Header.Get("Authorization"))
+		var review tokenReview
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&review))
+		assert.Equal(t, []string{"keymaster", "keymaster-teams"}, review.Spec.Audiences)
+		switch review.Spec.Token {
+		case "deployer-token":
+			review.Status.Authenticated = true
+			review.Status.Audiences = []string{"keymaster"}
+			review.Status.User.Username = "system:serviceaccount:ci:deployer"
+			review.Status.User.UID = "sa-uid"
+		case "user-token":
+			review.Status.Authenticated = true
+			review.Status.Audiences = []string{"keymaster"}
+			review.Status.User.Username = "alice"
+		default:
+			review.Status.Error = "invalid bearer token"
+		}
+		w.WriteHeader(http.StatusCreated)
+		assert.NoError(t, json.NewEncoder(w).Encode(&review))
+	}))
+	defer apiServer.Close()
+
+	s := newTestServer()
+	s.Config.Kubernetes = api.KubernetesAuthConfig{
+		Cluster:       "ci-cluster",
+		Server:        apiServer.URL,
+		ReviewerToken: "reviewer-token",
+	}
+	s.Config.Roles[0].KubernetesServiceAccounts = []api.ServiceAccountBinding{
+		{Namespace: "ci", ServiceAccount: "deployer", Audience: "keymaster"},
+		{Namespace: "team-*", ServiceAccount: "deployer", Audience: "keymaster-teams"},
+	}
+	assert.NoError(t, s.Config.Validate())
+
+	resp, err := s.HandleKubernetesAuth(&api.KubernetesAuthRequest{RequestedRole: "deployment", Token: "deployer-token"})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Credentials, 1)
+
+	_, err = s.HandleKubernetesAuth(&api.KubernetesAuthRequest{RequestedRole: "deployment", Token: "user-token"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not for a service account")
+	_, err = s.HandleKubernetesAuth(&api.KubernetesAuthRequest{RequestedRole: "deployment", Token: "bad-token"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid bearer token")
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/bsycorp/keymaster/km/api"
+)
+
+// LocalTransport is an api.Transport which calls a Server in the same
+// process, for tests and local development. Requests and responses are
+// still encoded, so they behave as they would over the network.
+type LocalTransport struct {
+	Server *Server
+}
+
+func (t *LocalTransport) RoundTrip(payload []byte) ([]byte, error) {
+	var req api.Request
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, api.Errorf(api.ErrorCodeBadRequest, "invalid request: %s", err)
+	}
+	resp, err := t.Server.Handle(&req)
+	if err != nil {
+		return nil, api.ToError(err)
+	}
+	return json.Marshal(resp)
+}
+
+// NewLocalClient returns an api.Client for the server.
+func NewLocalClient(s *Server) *api.Client {
+	return &api.Client{Transport: &LocalTransport{Server: s}}
+}
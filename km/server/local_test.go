@@ -0,0 +1,26 @@
+package server
+
+import (
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLocalClient(t *testing.T) {
+	client := NewLocalClient(newTestServer())
+	discovery, err := client.Discovery(&api.DiscoveryRequest{})
+	assert.NoError(t, err)
+	assert.NoError(t, discovery.Check("workflow_start"))
+
+	resp, err := client.WorkflowStart(&api.WorkflowStartRequest{Role: "deployment"})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, resp.IssuingNonce)
+
+	_, err = client.WorkflowStart(&api.WorkflowStartRequest{Role: "admin"})
+	var apiErr *api.Error
+	if assert.True(t, errors.As(err, &apiErr)) {
+		assert.Equal(t, api.ErrorCodeRoleNotFound, apiErr.Code)
+		assert.Equal(t, "admin", apiErr.Details.Role)
+	}
+}
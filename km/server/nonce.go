@@ -0,0 +1,97 @@
+package server
+
+import (
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/util"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"time"
+)
+
+const issuingNonceIssuer = "keymaster"
+
+// The issuing nonce is a signed token handed out at workflow start and
+// returned at workflow auth. It binds the requested role, environment and
+// IDP nonce together so that the (stateless) issuing server can verify
+// them without storing anything in between. Requester identification
+// has its own IDP nonce, so that an approval can't be passed off as an
+// identification or the other way around, and must be by the requester
+// named at workflow start.
+type issuingNonceClaims struct {
+	Role              string `json:"role"`
+	IdpNonce          string `json:"idp_nonce"`
+	IdentifyNonce     string `json:"identify_nonce,omitempty"`
+	RequesterUsername string `json:"requester_username,omitempty"`
+	RequesterEmail    string `json:"requester_email,omitempty"`
+	jwt.StandardClaims
+}
+
+func (s *Server) issuingNonceKey() ([]byte, error) {
+	if s.Config.IssuingNonce.SigningKey == "" {
+		return nil, api.Errorf(api.ErrorCodeConfig, "no issuing nonce signing key configured")
+	}
+	key, err := util.Load(s.Config.IssuingNonce.SigningKey)
+	if err != nil {
+		return nil, api.WrapError(err, api.ErrorCodeConfig, "error loading issuing nonce signing key")
+	}
+	return key, nil
+}
+
+// newIssuingNonce sets the standard claims and signs the nonce
+func (s *Server) newIssuingNonce(claims *issuingNonceClaims) (string, error) {
+	key, err := s.issuingNonceKey()
+	if err != nil {
+		return "", err
+	}
+	now := s.now()
+	validFor := time.Duration(s.Config.IssuingNonce.ValidForSeconds) * time.Second
+	claims.StandardClaims = jwt.StandardClaims{
+		Id:        uuid.New().String(),
+		Issuer:    issuingNonceIssuer,
+		Audience:  s.Config.Name,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		ExpiresAt: now.Add(validFor).Unix(),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(key)
+}
+
+func (s *Server) verifyIssuingNonce(issuingNonce string, role string, idpNonce string) (*issuingNonceClaims, error) {
+	key, err := s.issuingNonceKey()
+	if err != nil {
+		return nil, err
+	}
+	// Expiry is checked below against s.now(), which tests can move
+	parser := jwt.Parser{
+		ValidMethods:         []string{jwt.SigningMethodHS256.Alg()},
+		SkipClaimsValidation: true,
+	}
+	var claims issuingNonceClaims
+	_, err = parser.ParseWithClaims(issuingNonce, &claims, func(token *jwt.Token) (interface{}, error) {
+		return key, nil
+	})
+	if err != nil {
+		return nil, api.WrapError(err, api.ErrorCodeInvalidNonce, "invalid issuing nonce")
+	}
+	now := s.now().Unix()
+	if !claims.VerifyExpiresAt(now, true) {
+		return nil, api.Errorf(api.ErrorCodeInvalidNonce, "issuing nonce has expired")
+	}
+	if !claims.VerifyNotBefore(now, true) {
+		return nil, api.Errorf(api.ErrorCodeInvalidNonce, "issuing nonce is not yet valid")
+	}
+	if !claims.VerifyIssuer(issuingNonceIssuer, true) {
+		return nil, api.Errorf(api.ErrorCodeInvalidNonce, "issuing nonce has wrong issuer: %s", claims.Issuer)
+	}
+	if !claims.VerifyAudience(s.Config.Name, true) {
+		return nil, api.Errorf(api.ErrorCodeInvalidNonce, "issuing nonce is for another environment: %s", claims.Audience)
+	}
+	if claims.Role != role {
+		return nil, api.Errorf(api.ErrorCodeInvalidNonce, "issuing nonce is for another role: %s", claims.Role)
+	}
+	if claims.IdpNonce != idpNonce {
+		return nil, api.Errorf(api.ErrorCodeInvalidNonce, "issuing nonce does not match idp nonce")
+	}
+	return &claims, nil
+}
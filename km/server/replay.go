@@ -0,0 +1,61 @@
+package server
+
+import (
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/idp"
+	"github.com/bsycorp/keymaster/km/replay"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// redeem marks the issuing nonce and the assertions submitted with it
+// as used, so that a captured set of approvals can only be used once.
+//
+// Every entry is kept until the issuing nonce expires. Assertions are
+// bound to the nonce (via the idp nonce) and are useless after that.
+func (s *Server) redeem(nonce *issuingNonceClaims, idpName string, userInfos []idp.UserInfo) error {
+	keys := []string{s.Config.Name + "/nonce/" + nonce.Id}
+	return s.redeemKeys(keys, idpName, userInfos, time.Unix(nonce.ExpiresAt, 0))
+}
+
+// redeemDirect marks an assertion presented for direct auth as used.
+// There's no issuing nonce bounding its lifetime, so it is kept until
+// the assertion expires or, if that isn't known, for as long as an
+// issuing nonce would be (longer than IDPs make assertions valid for).
+func (s *Server) redeemDirect(idpName string, userInfo *idp.UserInfo) error {
+	expiry := userInfo.Expiry
+	if expiry.IsZero() {
+		validFor := time.Duration(s.Config.IssuingNonce.ValidForSeconds) * time.Second
+		expiry = s.now().Add(validFor)
+	}
+	return s.redeemKeys(nil, idpName, []idp.UserInfo{*userInfo}, expiry)
+}
+
+func (s *Server) redeemKeys(keys []string, idpName string, userInfos []idp.UserInfo, expiry time.Time) error {
+	if s.Replay == nil {
+		return api.Errorf(api.ErrorCodeConfig, "no replay cache configured")
+	}
+	for _, userInfo := range userInfos {
+		if userInfo.AssertionID == "" {
+			return api.Errorf(api.ErrorCodeInvalidAssertion, "assertion from %s has no ID", userInfo.Username)
+		}
+		keys = append(keys, s.Config.Name+"/idp/"+idpName+"/"+userInfo.AssertionID)
+	}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if seen[key] {
+			return api.Errorf(api.ErrorCodeReplayed, "approval submitted more than once: %s", key)
+		}
+		seen[key] = true
+	}
+	// All or nothing, so that a request which fails here doesn't use up
+	// the approvals which were fine
+	err := s.Replay.Redeem(keys, expiry)
+	var redeemed *replay.RedeemedError
+	if errors.As(err, &redeemed) {
+		return api.Errorf(api.ErrorCodeReplayed, "approval has already been redeemed: %s", redeemed.Key)
+	} else if err != nil {
+		return api.WrapError(err, api.ErrorCodeUnavailable, "replay cache error")
+	}
+	return nil
+}
@@ -4,17 +4,44 @@ import (
 	"encoding/json"
 	"github.com/bsycorp/keymaster/km/api"
 	"github.com/bsycorp/keymaster/km/creds"
+	"github.com/bsycorp/keymaster/km/idp"
+	"github.com/bsycorp/keymaster/km/idp/oidc"
 	"github.com/bsycorp/keymaster/km/idp/saml"
+	"github.com/bsycorp/keymaster/km/replay"
 	"github.com/bsycorp/keymaster/km/util"
+	"github.com/bsycorp/keymaster/km/workflow"
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/ghodss/yaml"
 	"github.com/google/uuid"
+	"github.com/jonboulle/clockwork"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"sort"
 	"strings"
+	"time"
 )
 
+// UnidentifiedUsername is used as the username for credentials issued
+// by policies which do not identify the requester.
+const UnidentifiedUsername = "unidentified"
+
+// Version is the server version reported by discovery. Release builds
+// set it with -ldflags "-X github.com/bsycorp/keymaster/km/server.Version=..."
+var Version = "dev"
+
 type Server struct {
 	Config api.Config
+	Clock  clockwork.Clock
+	Replay replay.Store
+	// Signs policies for the workflow engine, if configured
+	PolicySigner *workflow.PolicySigner
+}
+
+func (s *Server) now() time.Time {
+	if s.Clock == nil {
+		return time.Now()
+	}
+	return s.Clock.Now()
 }
 
 func (s *Server) Configure(config string) error {
@@ -45,15 +72,113 @@ func (s *Server) Configure(config string) error {
 	if err != nil {
 		return err
 	}
+	if s.Replay == nil {
+		s.Replay, err = replay.NewFromConfig(&tmpConfig.ReplayCache)
+		if err != nil {
+			return errors.Wrap(err, "error configuring replay cache")
+		}
+	}
+	if s.PolicySigner == nil {
+		s.PolicySigner, err = workflow.NewPolicySigner(&tmpConfig.WorkflowPolicySigning)
+		if err != nil {
+			return errors.Wrap(err, "error configuring workflow policy signing")
+		}
+	}
 	s.Config = tmpConfig
 	return nil
 }
 
+// Handle dispatches a request to its handler.
+func (s *Server) Handle(req *api.Request) (interface{}, error) {
+	switch r := req.Payload.(type) {
+	case *api.DiscoveryRequest:
+		return s.HandleDiscovery(r)
+	case *api.ConfigRequest:
+		return s.HandleConfig(r)
+	case *api.DirectSamlAuthRequest:
+		return s.HandleDirectSamlAuth(r)
+	case *api.DirectOidcAuthRequest:
+		return s.HandleDirectOidcAuth(r)
+	case *api.GitlabJobAuthRequest:
+		return s.HandleGitlabJobAuth(r)
+	case *api.GithubActionsAuthRequest:
+		return s.HandleGithubActionsAuth(r)
+	case *api.IAMAuthRequest:
+		return s.HandleIAMAuth(r)
+	case *api.KubernetesAuthRequest:
+		return s.HandleKubernetesAuth(r)
+	case *api.WorkflowStartRequest:
+		return s.HandleWorkflowStart(r)
+	case *api.WorkflowAuthRequest:
+		return s.HandleWorkflowAuth(r)
+	default:
+		return nil, api.Errorf(api.ErrorCodeBadRequest, "unexpected request")
+	}
+}
+
 func (s *Server) HandleDiscovery(req *api.DiscoveryRequest) (*api.DiscoveryResponse, error) {
-	var resp api.DiscoveryResponse
+	resp := api.DiscoveryResponse{
+		Version:          Version,
+		ProtocolVersions: []string{api.ProtocolVersion},
+		RequestTypes:     s.requestTypes(),
+		CredentialTypes:  s.credentialTypes(),
+		ServerTime:       s.now().Unix(),
+		IPOracleRequired: len(s.Config.AccessControl.IPOracle.WhiteListCidrs) > 0,
+	}
 	return &resp, nil
 }
 
+// requestTypes lists the request types which some role is configured
+// to allow.
+func (s *Server) requestTypes() []string {
+	enabled := map[string]bool{
+		"discovery": true,
+		"config":    true,
+	}
+	for _, role := range s.Config.Roles {
+		if policy := s.Config.Workflow.FindPolicyByName(role.Workflow); policy != nil {
+			enabled["workflow_start"] = true
+			enabled["workflow_auth"] = true
+			if policy.SelfService && len(policy.IdentifyRoles) > 0 {
+				if idpConfig := s.Config.FindIdpByName(policy.IdpName); idpConfig != nil {
+					enabled["direct_"+idpConfig.Type+"_auth"] = true
+				}
+			}
+		}
+		if len(role.GitlabClaims) > 0 {
+			enabled["gitlab_job_auth"] = true
+		}
+		if len(role.GithubClaims) > 0 {
+			enabled["github_actions_auth"] = true
+		}
+		if len(role.IAMPrincipals) > 0 {
+			enabled["iam_auth"] = true
+		}
+		if len(role.KubernetesServiceAccounts) > 0 {
+			enabled["kubernetes_auth"] = true
+		}
+	}
+	var result []string
+	for requestType := range enabled {
+		result = append(result, requestType)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (s *Server) credentialTypes() []string {
+	var result []string
+	seen := map[string]bool{}
+	for _, cred := range s.Config.Credentials {
+		if !seen[cred.Type] {
+			seen[cred.Type] = true
+			result = append(result, cred.Type)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
 func (s *Server) HandleConfig(req *api.ConfigRequest) (*api.ConfigResponse, error) {
 	// Copy the public parts of our configuration.
 	var resp api.ConfigResponse
@@ -66,126 +191,365 @@ func (s *Server) HandleConfig(req *api.ConfigRequest) (*api.ConfigResponse, erro
 	return &resp, nil
 }
 
-func (s *Server) HandleDirectSamlAuth(eq *api.DirectSamlAuthRequest) (*api.DirectAuthResponse, error) {
-	return nil, errors.New("Not implemented")
+// directAuthPolicy finds the requested role and its policy, which must
+// allow self service, and the policy's IDP.
+func (s *Server) directAuthPolicy(roleName string) (*api.RoleConfig, *api.WorkflowPolicyConfig, *api.IdpConfig, error) {
+	role := s.Config.FindRoleByName(roleName)
+	if role == nil {
+		return nil, nil, nil, roleNotFound(roleName)
+	}
+	rolePolicy := s.Config.Workflow.FindPolicyByName(role.Workflow)
+	if rolePolicy == nil {
+		return nil, nil, nil, api.Errorf(api.ErrorCodeConfig, "requested role policy not found: %s", role.Workflow)
+	}
+	if !rolePolicy.SelfService || len(rolePolicy.IdentifyRoles) == 0 {
+		return nil, nil, nil, api.Errorf(api.ErrorCodeForbidden, "requested role does not allow direct auth: %s", roleName)
+	}
+	idpConfig := s.Config.FindIdpByName(rolePolicy.IdpName)
+	if idpConfig == nil {
+		return nil, nil, nil, api.Errorf(api.ErrorCodeConfig, "requested role policy idp not found: %s", rolePolicy.IdpName)
+	}
+	return role, rolePolicy, idpConfig, nil
+}
+
+// directAuth issues credentials to a user who has authenticated
+// themselves, if they are in one of the identify roles of a self service
+// policy.
+func (s *Server) directAuth(role *api.RoleConfig, policy *api.WorkflowPolicyConfig, idpName string, user *idp.UserInfo) (*api.DirectAuthResponse, error) {
+	if !idp.InAnyGroup(policy.IdentifyRoles, user.Groups) {
+		return nil, api.Errorf(api.ErrorCodeForbidden, "user %s is not in any identify group, got: %s want: %s",
+			user.Username, user.Groups, idp.GroupNames(policy.IdentifyRoles))
+	}
+	err := s.redeemDirect(idpName, user)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Direct auth:", user.Username, "role:", role.Name)
+	issuedCreds, err := s.issue(role, user)
+	if err != nil {
+		return nil, err
+	}
+	return &api.DirectAuthResponse{
+		Credentials: issuedCreds,
+	}, nil
+}
+
+func (s *Server) HandleDirectSamlAuth(req *api.DirectSamlAuthRequest) (*api.DirectAuthResponse, error) {
+	role, rolePolicy, idpConfig, err := s.directAuthPolicy(req.RequestedRole)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := idpConfig.Config.(*api.IdpConfigSaml); !ok {
+		return nil, api.Errorf(api.ErrorCodeBadRequest, "requested role idp is not a saml idp: %s", idpConfig.Name)
+	}
+	relayState := req.RelayState
+	var query *saml.RedirectQuery
+	if req.Query != "" {
+		if req.SAMLResponse != "" || req.RelayState != nil {
+			return nil, api.Errorf(api.ErrorCodeBadRequest, "saml response and relay state must be in the query, not beside it")
+		}
+		query, err = saml.ParseRedirectQuery(req.Query)
+		if err != nil {
+			return nil, api.WrapError(err, api.ErrorCodeBadRequest, "invalid query")
+		}
+		relayState = query.RelayState
+	}
+	// The relay state, if any, says which role the IDP initiated login
+	// was for.
+	if relayState != nil && *relayState != role.Name {
+		return nil, api.Errorf(api.ErrorCodeBadRequest, "relay state does not match requested role: %s", *relayState)
+	}
+	processor, err := s.idpProcessor(idpConfig)
+	if err != nil {
+		return nil, err
+	}
+	sp := processor.(*saml.AssertionProcessor)
+	var user *idp.UserInfo
+	if query != nil {
+		user, err = sp.ProcessRedirect(query)
+	} else {
+		user, err = sp.ProcessDirect(req.SAMLResponse)
+	}
+	if err != nil {
+		return nil, api.WrapError(err, api.ErrorCodeInvalidAssertion, "saml validation error")
+	}
+	return s.directAuth(role, rolePolicy, idpConfig.Name, user)
 }
 
 func (s *Server) HandleDirectOidcAuth(req *api.DirectOidcAuthRequest) (*api.DirectAuthResponse, error) {
-	return nil, errors.New("Not implemented")
+	role, rolePolicy, idpConfig, err := s.directAuthPolicy(req.RequestedRole)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := idpConfig.Config.(*api.IdpConfigOidc); !ok {
+		return nil, api.Errorf(api.ErrorCodeBadRequest, "requested role idp is not an oidc idp: %s", idpConfig.Name)
+	}
+	processor, err := s.idpProcessor(idpConfig)
+	if err != nil {
+		return nil, err
+	}
+	user, err := processor.(*oidc.TokenProcessor).ProcessDirect(req.IdToken)
+	if err != nil {
+		return nil, api.WrapError(err, api.ErrorCodeInvalidAssertion, "oidc validation error")
+	}
+	return s.directAuth(role, rolePolicy, idpConfig.Name, user)
+}
+
+func roleNotFound(roleName string) error {
+	err := api.Errorf(api.ErrorCodeRoleNotFound, "requested role not found: %s", roleName)
+	err.Details = &api.ErrorDetails{Role: roleName}
+	return err
 }
 
 func (s *Server) HandleWorkflowStart(req *api.WorkflowStartRequest) (*api.WorkflowStartResponse, error) {
-	// TODO: this will be a JWT in future
-	uu := uuid.New()
-	uu2 := uuid.New()
+	role := s.Config.FindRoleByName(req.Role)
+	if role == nil {
+		return nil, roleNotFound(req.Role)
+	}
+	nonce := &issuingNonceClaims{
+		Role:              role.Name,
+		IdpNonce:          uuid.New().String(),
+		IdentifyNonce:     uuid.New().String(),
+		RequesterUsername: req.RequesterUsername,
+		RequesterEmail:    req.RequesterEmail,
+	}
+	issuingNonce, err := s.newIssuingNonce(nonce)
+	if err != nil {
+		return nil, api.WrapError(err, api.ErrorCodeConfig, "error creating issuing nonce")
+	}
+	signedPolicy, err := s.signPolicy(role, nonce)
+	if err != nil {
+		return nil, err
+	}
 	return &api.WorkflowStartResponse{
-		IssuingNonce: uu.String(),
-		IdpNonce:     uu2.String(),
+		IssuingNonce:  issuingNonce,
+		IdpNonce:      nonce.IdpNonce,
+		IdentifyNonce: nonce.IdentifyNonce,
+		SignedPolicy:  signedPolicy,
 	}, nil
 }
 
+// signPolicy signs the role's workflow policy for the workflow engine,
+// for the workflow with the nonce's IDP nonces and requester. It
+// returns "" if policy signing isn't configured.
+func (s *Server) signPolicy(role *api.RoleConfig, nonce *issuingNonceClaims) (string, error) {
+	if s.PolicySigner == nil {
+		return "", nil
+	}
+	policy := s.Config.Workflow.FindPolicyByName(role.Workflow)
+	if policy == nil {
+		return "", api.Errorf(api.ErrorCodeConfig, "workflow policy %s not found for role %s", role.Workflow, role.Name)
+	}
+	now := s.now()
+	validFor := time.Duration(s.Config.IssuingNonce.ValidForSeconds) * time.Second
+	signedPolicy, err := s.PolicySigner.Sign(&workflow.PolicyClaims{
+		Policy:            workflow.PolicyFromConfig(policy),
+		Role:              role.Name,
+		IdpNonce:          nonce.IdpNonce,
+		IdentifyNonce:     nonce.IdentifyNonce,
+		RequesterUsername: nonce.RequesterUsername,
+		RequesterEmail:    nonce.RequesterEmail,
+		StandardClaims: jwt.StandardClaims{
+			Id:        uuid.New().String(),
+			Issuer:    s.Config.Name,
+			Audience:  s.Config.Workflow.BaseUrl,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(validFor).Unix(),
+		},
+	})
+	if err != nil {
+		return "", api.WrapError(err, api.ErrorCodeInternal, "error signing workflow policy")
+	}
+	return signedPolicy, nil
+}
+
+// identify verifies the requester's own IDP assertion. If the policy has
+// identify roles, the requester must be in at least one of them.
+// Policies which don't let requesters approve need identification too,
+// but from anyone. Otherwise identification is optional and nil may be
+// returned.
+// The assertion must be in response to the workflow's identify nonce,
+// not the IDP nonce the approvals answer, and be from the requester
+// named at workflow start.
+func (s *Server) identify(policy *api.WorkflowPolicyConfig, processor idp.Processor, nonce *issuingNonceClaims, assertion string) (*idp.UserInfo, error) {
+	if assertion == "" {
+		if policy.RequiresIdentification() {
+			return nil, api.Errorf(api.ErrorCodeBadRequest, "requested role requires identification; no identify assertion submitted")
+		}
+		return nil, nil
+	}
+	if nonce.IdentifyNonce == "" {
+		return nil, api.Errorf(api.ErrorCodeInvalidNonce, "issuing nonce has no identify nonce")
+	}
+	userInfos, err := processor.Process(nonce.IdentifyNonce, []string{assertion})
+	if err != nil {
+		return nil, api.WrapError(err, api.ErrorCodeInvalidAssertion, "identification error")
+	}
+	requester := userInfos[0]
+	named := idp.UserInfo{Username: nonce.RequesterUsername, Email: nonce.RequesterEmail}
+	if !idp.SamePerson(requester, named) {
+		return nil, api.Errorf(api.ErrorCodeForbidden, "%s is not the requester named at workflow start: %s",
+			requester.Username, named.Username)
+	}
+	if len(policy.IdentifyRoles) == 0 {
+		return &requester, nil
+	}
+	if idp.InAnyGroup(policy.IdentifyRoles, requester.Groups) {
+		log.Println("Identified requester:", requester.Username)
+		return &requester, nil
+	}
+	return nil, api.Errorf(api.ErrorCodeForbidden, "requester %s is not in any identify group, got: %s want: %s",
+		requester.Username, requester.Groups, idp.GroupNames(policy.IdentifyRoles))
+}
+
+// idpProcessor returns a processor for assertions from the given IDP:
+// SAML responses or OIDC ID tokens.
+func (s *Server) idpProcessor(idpConfig *api.IdpConfig) (idp.Processor, error) {
+	switch c := idpConfig.Config.(type) {
+	case *api.IdpConfigSaml:
+		sp := &saml.AssertionProcessor{
+			CAData:                  []byte(c.Certificate),
+			Audience:                c.Audience,
+			UsernameAttr:            c.UsernameAttr,
+			EmailAttr:               c.EmailAttr,
+			GroupsAttr:              c.GroupsAttr,
+			RedirectURI:             c.RedirectURI,
+			DisableNameIDValidation: true,
+		}
+		err := sp.Init()
+		if err != nil {
+			return nil, api.WrapError(err, api.ErrorCodeConfig, "saml init error")
+		}
+		return sp, nil
+	case *api.IdpConfigOidc:
+		jwks, err := util.Load(c.Jwks)
+		if err != nil {
+			return nil, api.WrapError(err, api.ErrorCodeConfig, "error loading oidc jwks")
+		}
+		tp := &oidc.TokenProcessor{
+			Issuer:        c.Issuer,
+			Audience:      c.Audience,
+			JWKSData:      jwks,
+			UsernameClaim: c.UsernameClaim,
+			EmailClaim:    c.EmailClaim,
+			GroupsClaim:   c.GroupsClaim,
+			Clock:         s.Clock,
+		}
+		err = tp.Init()
+		if err != nil {
+			return nil, api.WrapError(err, api.ErrorCodeConfig, "oidc init error")
+		}
+		return tp, nil
+	}
+	return nil, api.Errorf(api.ErrorCodeConfig, "unsupported idp type: %s", idpConfig.Type)
+}
+
 func (s *Server) HandleWorkflowAuth(req *api.WorkflowAuthRequest) (*api.WorkflowAuthResponse, error) {
 	// Find the requested role
 	role := s.Config.FindRoleByName(req.Role)
 	if role == nil {
-		return nil, errors.Errorf("requested role not found: %s", req.Role)
+		return nil, roleNotFound(req.Role)
 	}
 	// Find the workflow policy for the requested role
 	rolePolicy := s.Config.Workflow.FindPolicyByName(role.Workflow)
 	if rolePolicy == nil {
-		return nil, errors.Errorf("requested role policy not found: %s", role.Workflow)
-	}
-	// Validate that there are no identify roles
-	if len(rolePolicy.IdentifyRoles) > 0 {
-		return nil, errors.New("requested role requires identification; not supported")
+		return nil, api.Errorf(api.ErrorCodeConfig, "requested role policy not found: %s", role.Workflow)
 	}
-	// Validate that there is just one approval role
-	if len(rolePolicy.ApproverRoles) > 1 {
-		return nil, errors.New("multiple approver support not implemented")
+	// There should be at least as many IDP assertions as required approvals
+	requiredApprovals := 0
+	for _, n := range rolePolicy.ApproverRoles {
+		requiredApprovals += n
 	}
-	// There should be as many IDP assertions as approvers
-	if len(req.Assertions) != len(rolePolicy.ApproverRoles) {
-		return nil, errors.New("wrong number of saml assertions submitted")
+	if len(req.Assertions) < requiredApprovals {
+		return nil, api.Errorf(api.ErrorCodeBadRequest, "not enough idp assertions submitted, want: %d, got: %d",
+			requiredApprovals, len(req.Assertions))
 	}
-	// Ensure there is just 1 IDP in configuration
-	if len(s.Config.Idp) > 1 {
-		return nil, errors.New("multiple IDP support not implemented")
+	// Assertions are validated against the IDP named by the policy
+	idpConfig := s.Config.FindIdpByName(rolePolicy.IdpName)
+	if idpConfig == nil {
+		return nil, api.Errorf(api.ErrorCodeConfig, "requested role policy idp not found: %s", rolePolicy.IdpName)
 	}
 
-	// TODO: verify issuing nonce
-	// TODO: verify idp nonce
+	// The issuing nonce proves that we handed out this idp nonce for
+	// this role; the idp nonce is then checked against the assertions.
+	nonce, err := s.verifyIssuingNonce(req.IssuingNonce, req.Role, req.IdpNonce)
+	if err != nil {
+		return nil, err
+	}
+	// The issuing nonce was issued when the workflow was started
+	if maxAge := int64(rolePolicy.MaxApprovalAgeSeconds); maxAge > 0 && s.now().Unix()-nonce.IssuedAt > maxAge {
+		return nil, api.Errorf(api.ErrorCodeWorkflowExpired, "workflow is older than the policy allows: %ds", maxAge)
+	}
 
-	idpConfig := s.Config.Idp[0]
-	idpSamlConfig := idpConfig.Config.(*api.IdpConfigSaml)
-	sp := &saml.AssertionProcessor{
-		CAData:       []byte(idpSamlConfig.Certificate),
-		Audience:     idpSamlConfig.Audience,
-		UsernameAttr: idpSamlConfig.UsernameAttr,
-		EmailAttr:    idpSamlConfig.EmailAttr,
-		GroupsAttr:   idpSamlConfig.GroupsAttr,
-		RedirectURI:  idpSamlConfig.RedirectURI,
-		DisableNameIDValidation: true,
+	processor, err := s.idpProcessor(idpConfig)
+	if err != nil {
+		return nil, err
 	}
-	err := sp.Init()
+	userInfos, err := processor.Process(req.IdpNonce, req.Assertions)
 	if err != nil {
-		return nil, errors.Wrap(err, "saml init error")
+		return nil, api.WrapError(err, api.ErrorCodeInvalidAssertion, "approval validation error")
 	}
-	userInfos, err := sp.Process(req.IdpNonce, req.Assertions)
+	requester, err := s.identify(rolePolicy, processor, nonce, req.IdentifyAssertion)
 	if err != nil {
-		return nil, errors.Wrap(err, "saml validation error")
+		return nil, err
 	}
 
-	// Count approvals from IDP assertions
-	approvals := make(map[string]int)
-	for _, userInfo := range userInfos {
-		log.Println("Processing assertion from:", userInfo)
-		approvalsFromUser := 0
-		for _, groupName := range userInfo.Groups {
-			_, found := rolePolicy.ApproverRoles[groupName]
-			if found {
-				approvals[groupName]++
-				approvalsFromUser++
-			}
-		}
-		// One assertion should represent just 1 approval from relevant group
-		if approvalsFromUser == 0 {
-			i := 0
-			requiredGroups := make([]string, len(rolePolicy.ApproverRoles))
-			for k := range rolePolicy.ApproverRoles {
-				requiredGroups[i] = k
-				i++
-			}
-			return nil, errors.Errorf("assertion with no valid approval groups from: %s got: %s want: %s",
-				userInfo.Username, userInfo.Groups, requiredGroups)
-		}
-		if approvalsFromUser > 1 {
-			return nil, errors.Errorf("assertion meets more than 1 approval group from: %s", userInfo.Username)
-		}
+	// Each person approves at most once, and each approval counts
+	// towards exactly one approver group. The workflow engine is not
+	// trusted to have enforced any of this.
+	approvers, err := distinctApprovers(userInfos, requester, rolePolicy.RequesterCanApprove)
+	if err != nil {
+		return nil, err
 	}
-	// Validate that the required number of approvals were met
-	for groupName, requiredApprovals := range rolePolicy.ApproverRoles {
-		actualApprovals := approvals[groupName]
-		if actualApprovals < requiredApprovals {
-			return nil, errors.Errorf("not enough approvals, want: %d, got: %d",
-				requiredApprovals, actualApprovals)
-		}
+	approvals, err := countApprovals(rolePolicy.ApproverRoles, approvers)
+	if err != nil {
+		return nil, err
 	}
+	log.Println("Approvals:", approvals)
 
+	// Approvals (and identification) are single use
+	redeemed := userInfos
+	if requester != nil {
+		redeemed = append(redeemed, *requester)
+	}
+	err = s.redeem(nonce, idpConfig.Name, redeemed)
+	if err != nil {
+		return nil, err
+	}
+
+	issuedCreds, err := s.issue(role, requester)
+	if err != nil {
+		return nil, err
+	}
+	return &api.WorkflowAuthResponse{
+		Credentials: issuedCreds,
+	}, nil
+}
+
+// issue issues the credentials for a role, to the given user (or to
+// UnidentifiedUsername if nil).
+func (s *Server) issue(role *api.RoleConfig, user *idp.UserInfo) ([]api.Cred, error) {
 	userInfo := api.AuthInfo{
 		Environment: s.Config.Name,
-		Role:        req.Role,
-		Username:    req.Username,
+		Role:        role.Name,
+		Username:    UnidentifiedUsername,
 		ValidFor:    role.ValidForSeconds,
 	}
+	if user != nil {
+		userInfo.Username = user.Username
+		userInfo.Groups = user.Groups
+	}
+	return s.issueFor(role, &userInfo)
+}
+
+func (s *Server) issueFor(role *api.RoleConfig, userInfo *api.AuthInfo) ([]api.Cred, error) {
 	credIssuer, err := creds.NewFromConfig(role, &s.Config)
 	if err != nil {
-		return nil, errors.Wrap(err, "during issuer configuration")
+		return nil, api.WrapError(err, api.ErrorCodeConfig, "during issuer configuration")
 	}
-	issuedCreds, err := credIssuer.IssueFor(&userInfo)
+	issuedCreds, err := credIssuer.IssueFor(userInfo)
 	if err != nil {
 		return nil, errors.Wrap(err, "during issuance")
 	}
-	return &api.WorkflowAuthResponse{
-		Credentials: issuedCreds,
-	}, nil
+	return issuedCreds, nil
 }
@@ -1,2 +1,662 @@
 package server
 
+import (
+	"crypto/rsa"
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/idp"
+	"github.com/bsycorp/keymaster/km/replay"
+	"github.com/bsycorp/keymaster/km/workflow"
+	"github.com/jonboulle/clockwork"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer() *Server {
+	clock := clockwork.NewFakeClockAt(time.Now())
+	store := replay.NewMemoryStore()
+	store.Clock = clock
+	s := &Server{
+		Config: api.Config{
+			Name: "foo.io",
+			Idp:  []api.IdpConfig{testIdpConfig("nonprod")},
+			Roles: []api.RoleConfig{
+				{
+					Name:            "deployment",
+					Credentials:     []string{"ssh"},
+					Workflow:        "deploy_with_approval",
+					ValidForSeconds: 3600,
+				},
+				{
+					Name:            "developer",
+					Credentials:     []string{"ssh"},
+					Workflow:        "developer",
+					ValidForSeconds: 3600,
+				},
+			},
+			Credentials: []api.CredentialsConfig{
+				{
+					Name: "ssh",
+					Type: "ssh_ca",
+					Config: &api.CredentialsConfigSSH{
+						CAKey:      "file://testdata/ssh_ca.key",
+						Principals: []string{"$idpuser"},
+					},
+				},
+			},
+			Workflow: api.WorkflowConfig{
+				Policies: []api.WorkflowPolicyConfig{
+					{
+						Name:          "deploy_with_approval",
+						ApproverRoles: map[string]int{"approvers": 1},
+					},
+					{
+						Name:          "developer",
+						IdentifyRoles: map[string]int{"developers": 1},
+					},
+				},
+			},
+			IssuingNonce: api.IssuingNonceConfig{
+				SigningKey: "data://c3VwZXItc2VjcmV0LWtleQ==",
+			},
+		},
+		Clock:  clock,
+		Replay: store,
+	}
+	s.Config.Normalise()
+	return s
+}
+
+func TestServer_HandleDiscovery(t *testing.T) {
+	s := newTestServer()
+	resp, err := s.HandleDiscovery(&api.DiscoveryRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, Version, resp.Version)
+	assert.Equal(t, []string{api.ProtocolVersion}, resp.ProtocolVersions)
+	assert.Equal(t, []string{"config", "discovery", "workflow_auth", "workflow_start"}, resp.RequestTypes)
+	assert.Equal(t, []string{"ssh_ca"}, resp.CredentialTypes)
+	assert.Equal(t, s.Clock.Now().Unix(), resp.ServerTime)
+	assert.False(t, resp.IPOracleRequired)
+
+	s.Config.Workflow.Policies[1].SelfService = true
+	s.Config.Workflow.Policies[1].IdpName = "nonprod"
+	s.Config.Roles[0].IAMPrincipals = []string{"arn:aws:iam::123456789012:role/ci"}
+	s.Config.AccessControl.IPOracle.WhiteListCidrs = []string{"10.0.0.0/8"}
+	resp, err = s.HandleDiscovery(&api.DiscoveryRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"config", "direct_saml_auth", "discovery", "iam_auth", "workflow_auth", "workflow_start"}, resp.RequestTypes)
+	assert.True(t, resp.IPOracleRequired)
+}
+
+func TestServer_HandleWorkflowStart(t *testing.T) {
+	s := newTestServer()
+	resp, err := s.HandleWorkflowStart(&api.WorkflowStartRequest{Role: "deployment"})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, resp.IdpNonce)
+	assert.NotEmpty(t, resp.IssuingNonce)
+
+	claims, err := s.verifyIssuingNonce(resp.IssuingNonce, "deployment", resp.IdpNonce)
+	assert.NoError(t, err)
+	assert.Equal(t, "deployment", claims.Role)
+	assert.Equal(t, "foo.io", claims.Audience)
+	assert.NotEmpty(t, resp.IdentifyNonce)
+	assert.NotEqual(t, resp.IdpNonce, resp.IdentifyNonce)
+	assert.Equal(t, resp.IdentifyNonce, claims.IdentifyNonce)
+
+	_, err = s.HandleWorkflowStart(&api.WorkflowStartRequest{Role: "does-not-exist"})
+	assert.Error(t, err)
+
+	s.Config.IssuingNonce.SigningKey = ""
+	_, err = s.HandleWorkflowStart(&api.WorkflowStartRequest{Role: "deployment"})
+	assert.Error(t, err)
+}
+
+func TestServer_HandleWorkflowStartSignedPolicy(t *testing.T) {
+	s := newTestServer()
+	s.Config.Workflow.BaseUrl = "https://workflow.example.com"
+	s.Config.WorkflowPolicySigning.SigningKey = "file://testdata/idp.key"
+	var err error
+	s.PolicySigner, err = workflow.NewPolicySigner(&s.Config.WorkflowPolicySigning)
+	assert.NoError(t, err)
+	resp, err := s.HandleWorkflowStart(&api.WorkflowStartRequest{Role: "deployment", RequesterUsername: "dave", RequesterEmail: "dave@example.com"})
+	assert.NoError(t, err)
+
+	key, ok := s.PolicySigner.Key.(*rsa.PrivateKey)
+	assert.True(t, ok)
+	verifier := &workflow.PolicyVerifier{
+		Keys:     map[string]interface{}{"foo.io": &key.PublicKey},
+		Audience: "https://workflow.example.com",
+		Clock:    s.Clock,
+	}
+	claims, err := verifier.Verify(resp.SignedPolicy)
+	assert.NoError(t, err)
+	assert.Equal(t, "deployment", claims.Role)
+	assert.Equal(t, resp.IdpNonce, claims.IdpNonce)
+	assert.Equal(t, resp.IdentifyNonce, claims.IdentifyNonce)
+	assert.Equal(t, "dave", claims.RequesterUsername)
+	assert.Equal(t, "dave@example.com", claims.RequesterEmail)
+	assert.Equal(t, map[string]int{"approvers": 1}, claims.Policy.ApproverRoles)
+
+	s.Config.Roles[0].Workflow = "does-not-exist"
+	_, err = s.HandleWorkflowStart(&api.WorkflowStartRequest{Role: "deployment"})
+	assert.Equal(t, api.ErrorCodeConfig, api.ErrorCodeOf(err))
+}
+
+func TestServer_VerifyIssuingNonce(t *testing.T) {
+	s := newTestServer()
+	resp, err := s.HandleWorkflowStart(&api.WorkflowStartRequest{Role: "deployment"})
+	assert.NoError(t, err)
+
+	// Mismatched role or idp nonce
+	_, err = s.verifyIssuingNonce(resp.IssuingNonce, "developer", resp.IdpNonce)
+	assert.Error(t, err)
+	_, err = s.verifyIssuingNonce(resp.IssuingNonce, "deployment", "some-other-nonce")
+	assert.Error(t, err)
+
+	// Forged (tampered signature, or signed with another key)
+	_, err = s.verifyIssuingNonce(resp.IssuingNonce+"x", "deployment", resp.IdpNonce)
+	assert.Error(t, err)
+	other := newTestServer()
+	other.Config.IssuingNonce.SigningKey = "another-key"
+	forged, err := other.newIssuingNonce(&issuingNonceClaims{Role: "deployment", IdpNonce: resp.IdpNonce})
+	assert.NoError(t, err)
+	_, err = s.verifyIssuingNonce(forged, "deployment", resp.IdpNonce)
+	assert.Error(t, err)
+
+	// Another environment sharing the same key
+	other = newTestServer()
+	other.Config.Name = "bar.io"
+	foreign, err := other.newIssuingNonce(&issuingNonceClaims{Role: "deployment", IdpNonce: resp.IdpNonce})
+	assert.NoError(t, err)
+	_, err = s.verifyIssuingNonce(foreign, "deployment", resp.IdpNonce)
+	assert.Error(t, err)
+
+	// Expired
+	s.Clock.(clockwork.FakeClock).Advance(time.Duration(api.DefaultIssuingNonceValidForSeconds+1) * time.Second)
+	_, err = s.verifyIssuingNonce(resp.IssuingNonce, "deployment", resp.IdpNonce)
+	assert.Error(t, err)
+}
+
+func TestServer_HandleWorkflowAuthRejectsBadNonce(t *testing.T) {
+	s := newTestServer()
+	resp, err := s.HandleWorkflowStart(&api.WorkflowStartRequest{Role: "deployment"})
+	assert.NoError(t, err)
+
+	_, err = s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+		Role:         "deployment",
+		IssuingNonce: resp.IssuingNonce,
+		IdpNonce:     "not-the-idp-nonce",
+		Assertions:   []string{"assertion"},
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "idp nonce")
+	assert.Equal(t, api.ErrorCodeInvalidNonce, api.ErrorCodeOf(err))
+
+	_, err = s.HandleWorkflowAuth(&api.WorkflowAuthRequest{Role: "does-not-exist"})
+	assert.Equal(t, api.ErrorCodeRoleNotFound, api.ErrorCodeOf(err))
+}
+
+func TestServer_Redeem(t *testing.T) {
+	s := newTestServer()
+	resp, err := s.HandleWorkflowStart(&api.WorkflowStartRequest{Role: "deployment"})
+	assert.NoError(t, err)
+	nonce, err := s.verifyIssuingNonce(resp.IssuingNonce, "deployment", resp.IdpNonce)
+	assert.NoError(t, err)
+	approvals := []idp.UserInfo{{Username: "alice", AssertionID: "id-1"}}
+
+	err = s.redeem(nonce, "nonprod", approvals)
+	assert.NoError(t, err)
+
+	// The same approval can't be redeemed twice
+	err = s.redeem(nonce, "nonprod", approvals)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "already been redeemed")
+	assert.Equal(t, api.ErrorCodeReplayed, api.ErrorCodeOf(err))
+
+	// Nor can the same assertion be used with another nonce
+	resp, err = s.HandleWorkflowStart(&api.WorkflowStartRequest{Role: "deployment"})
+	assert.NoError(t, err)
+	nonce, err = s.verifyIssuingNonce(resp.IssuingNonce, "deployment", resp.IdpNonce)
+	assert.NoError(t, err)
+	err = s.redeem(nonce, "nonprod", approvals)
+	assert.Error(t, err)
+	// That redeemed nothing, so the nonce can still be used
+	err = s.redeem(nonce, "nonprod", []idp.UserInfo{{Username: "bob", AssertionID: "id-2"}})
+	assert.NoError(t, err)
+
+	// The same assertion twice in one request
+	resp, err = s.HandleWorkflowStart(&api.WorkflowStartRequest{Role: "deployment"})
+	assert.NoError(t, err)
+	nonce, err = s.verifyIssuingNonce(resp.IssuingNonce, "deployment", resp.IdpNonce)
+	assert.NoError(t, err)
+	err = s.redeem(nonce, "nonprod", []idp.UserInfo{{Username: "carol", AssertionID: "id-3"}, {Username: "carol", AssertionID: "id-3"}})
+	assert.Equal(t, api.ErrorCodeReplayed, api.ErrorCodeOf(err))
+
+	// Assertions must have an ID to be tracked
+	err = s.redeem(nonce, "nonprod", []idp.UserInfo{{Username: "bob"}})
+	assert.Error(t, err)
+
+	// Replay protection is required
+	s.Replay = nil
+	err = s.redeem(nonce, "nonprod", []idp.UserInfo{{Username: "dave", AssertionID: "id-4"}})
+	assert.Error(t, err)
+}
+
+// workflowAuth runs a workflow start & auth for the given role and
+// requester, with assertions produced by makeAssertions from the idp
+// nonces.
+func workflowAuth(s *Server, role string, requester string, makeAssertions func(idpNonce, identifyNonce string) (approvals []string, identify string)) (*api.WorkflowAuthResponse, error) {
+	start, err := s.HandleWorkflowStart(&api.WorkflowStartRequest{Role: role, RequesterUsername: requester})
+	if err != nil {
+		return nil, err
+	}
+	approvals, identify := makeAssertions(start.IdpNonce, start.IdentifyNonce)
+	return s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+		Role:              role,
+		IssuingNonce:      start.IssuingNonce,
+		IdpNonce:          start.IdpNonce,
+		Assertions:        approvals,
+		IdentifyAssertion: identify,
+	})
+}
+
+func sshUsername(t *testing.T, resp *api.WorkflowAuthResponse) string {
+	if !assert.Len(t, resp.Credentials, 1) {
+		return ""
+	}
+	return resp.Credentials[0].Value.(*api.SSHCred).Username
+}
+
+func TestServer_HandleWorkflowAuth(t *testing.T) {
+	s := newTestServer()
+	resp, err := workflowAuth(s, "deployment", "dave", func(idpNonce, identifyNonce string) ([]string, string) {
+		return []string{samlResponse(idpNonce, "alice", "approvers")}, samlResponse(identifyNonce, "dave")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "dave", sshUsername(t, resp))
+
+	// Requesters can't approve their own requests, so they have to
+	// identify themselves, even without identify roles
+	_, err = workflowAuth(s, "deployment", "dave", func(idpNonce, identifyNonce string) ([]string, string) {
+		return []string{samlResponse(idpNonce, "dave", "approvers")}, ""
+	})
+	assert.Equal(t, api.ErrorCodeBadRequest, api.ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "requires identification")
+
+	// Unless they may approve
+	s.Config.Workflow.Policies[0].RequesterCanApprove = true
+	resp, err = workflowAuth(s, "deployment", "dave", func(idpNonce, identifyNonce string) ([]string, string) {
+		return []string{samlResponse(idpNonce, "dave", "approvers")}, ""
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, UnidentifiedUsername, sshUsername(t, resp))
+	s.Config.Workflow.Policies[0].RequesterCanApprove = false
+
+	// Not an approver
+	_, err = workflowAuth(s, "deployment", "dave", func(idpNonce, identifyNonce string) ([]string, string) {
+		return []string{samlResponse(idpNonce, "alice", "developers")}, samlResponse(identifyNonce, "dave")
+	})
+	assert.Error(t, err)
+
+	// Assertion for some other request
+	_, err = workflowAuth(s, "deployment", "dave", func(idpNonce, identifyNonce string) ([]string, string) {
+		return []string{samlResponse("another-nonce", "alice", "approvers")}, samlResponse(identifyNonce, "dave")
+	})
+	assert.Error(t, err)
+}
+
+func TestServer_HandleWorkflowAuthMaxApprovalAge(t *testing.T) {
+	s := newTestServer()
+	s.Config.Workflow.Policies[0].MaxApprovalAgeSeconds = 600
+	start, err := s.HandleWorkflowStart(&api.WorkflowStartRequest{Role: "deployment"})
+	assert.NoError(t, err)
+	s.Clock.(clockwork.FakeClock).Advance(601 * time.Second)
+
+	// Well within the issuing nonce's lifetime, but not the policy's
+	_, err = s.HandleWorkflowAuth(&api.WorkflowAuthRequest{
+		Role:         "deployment",
+		IssuingNonce: start.IssuingNonce,
+		IdpNonce:     start.IdpNonce,
+		Assertions:   []string{samlResponse(start.IdpNonce, "alice", "approvers")},
+	})
+	assert.Equal(t, api.ErrorCodeWorkflowExpired, api.ErrorCodeOf(err))
+
+	resp, err := workflowAuth(s, "deployment", "dave", func(idpNonce, identifyNonce string) ([]string, string) {
+		return []string{samlResponse(idpNonce, "alice", "approvers")}, samlResponse(identifyNonce, "dave")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "dave", sshUsername(t, resp))
+}
+
+func TestServer_HandleWorkflowAuthIdentify(t *testing.T) {
+	s := newTestServer()
+	resp, err := workflowAuth(s, "developer", "bob", func(idpNonce, identifyNonce string) ([]string, string) {
+		return nil, samlResponse(identifyNonce, "bob", "everyone", "developers")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", sshUsername(t, resp))
+
+	// Identification is required
+	_, err = workflowAuth(s, "developer", "bob", func(idpNonce, identifyNonce string) ([]string, string) {
+		return nil, ""
+	})
+	assert.Error(t, err)
+
+	// By someone in an identify group
+	_, err = workflowAuth(s, "developer", "bob", func(idpNonce, identifyNonce string) ([]string, string) {
+		return nil, samlResponse(identifyNonce, "bob", "everyone")
+	})
+	assert.Error(t, err)
+
+	// Identification and approvals answer different nonces, so one
+	// can't stand in for the other
+	_, err = workflowAuth(s, "developer", "bob", func(idpNonce, identifyNonce string) ([]string, string) {
+		return nil, samlResponse(idpNonce, "bob", "everyone", "developers")
+	})
+	assert.Equal(t, api.ErrorCodeInvalidAssertion, api.ErrorCodeOf(err))
+	_, err = workflowAuth(s, "deployment", "dave", func(idpNonce, identifyNonce string) ([]string, string) {
+		return []string{samlResponse(identifyNonce, "alice", "approvers")}, samlResponse(identifyNonce, "dave")
+	})
+	assert.Equal(t, api.ErrorCodeInvalidAssertion, api.ErrorCodeOf(err))
+
+	// Without identify roles, anyone can identify as the requester
+	resp, err = workflowAuth(s, "deployment", "bob", func(idpNonce, identifyNonce string) ([]string, string) {
+		return []string{samlResponse(idpNonce, "alice", "approvers")}, samlResponse(identifyNonce, "bob")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", sshUsername(t, resp))
+
+	// But only the requester named at workflow start can identify
+	_, err = workflowAuth(s, "developer", "dave", func(idpNonce, identifyNonce string) ([]string, string) {
+		return nil, samlResponse(identifyNonce, "bob", "everyone", "developers")
+	})
+	assert.Equal(t, api.ErrorCodeForbidden, api.ErrorCodeOf(err))
+	_, err = workflowAuth(s, "developer", "", func(idpNonce, identifyNonce string) ([]string, string) {
+		return nil, samlResponse(identifyNonce, "bob", "everyone", "developers")
+	})
+	assert.Equal(t, api.ErrorCodeForbidden, api.ErrorCodeOf(err))
+}
+
+func TestServer_HandleWorkflowAuthMultipleApproverGroups(t *testing.T) {
+	s := newTestServer()
+	s.Config.Workflow.Policies[0].ApproverRoles = map[string]int{"security": 1, "platform-leads": 2}
+
+	_, err := workflowAuth(s, "deployment", "dave", func(idpNonce, identifyNonce string) ([]string, string) {
+		return []string{
+			samlResponse(idpNonce, "alice", "security", "platform-leads"),
+			samlResponse(idpNonce, "bob", "platform-leads"),
+			samlResponse(idpNonce, "carol", "platform-leads"),
+		}, samlResponse(identifyNonce, "dave")
+	})
+	assert.NoError(t, err)
+
+	_, err = workflowAuth(s, "deployment", "dave", func(idpNonce, identifyNonce string) ([]string, string) {
+		return []string{
+			samlResponse(idpNonce, "alice", "security", "platform-leads"),
+			samlResponse(idpNonce, "bob", "platform-leads"),
+		}, samlResponse(identifyNonce, "dave")
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not enough idp assertions submitted")
+
+	_, err = workflowAuth(s, "deployment", "dave", func(idpNonce, identifyNonce string) ([]string, string) {
+		return []string{
+			samlResponse(idpNonce, "alice", "security"),
+			samlResponse(idpNonce, "bob", "platform-leads"),
+			samlResponse(idpNonce, "carol", "security"),
+		}, samlResponse(identifyNonce, "dave")
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "platform-leads (want: 2, got: 1)")
+}
+
+func TestServer_HandleWorkflowAuthDistinctApprovers(t *testing.T) {
+	s := newTestServer()
+	s.Config.Workflow.Policies[0].ApproverRoles = map[string]int{"approvers": 2}
+
+	// One person can't approve twice
+	_, err := workflowAuth(s, "deployment", "dave", func(idpNonce, identifyNonce string) ([]string, string) {
+		return []string{
+			samlResponse(idpNonce, "alice", "approvers"),
+			samlResponse(idpNonce, "alice", "approvers"),
+		}, samlResponse(identifyNonce, "dave")
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "approvers (want: 2, got: 1)")
+
+	// Nor approve their own request
+	_, err = workflowAuth(s, "deployment", "bob", func(idpNonce, identifyNonce string) ([]string, string) {
+		return []string{
+			samlResponse(idpNonce, "alice", "approvers"),
+			samlResponse(idpNonce, "bob", "approvers"),
+		}, samlResponse(identifyNonce, "bob")
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot approve their own request")
+
+	// Unless the policy allows it
+	s.Config.Workflow.Policies[0].RequesterCanApprove = true
+	resp, err := workflowAuth(s, "deployment", "bob", func(idpNonce, identifyNonce string) ([]string, string) {
+		return []string{
+			samlResponse(idpNonce, "alice", "approvers"),
+			samlResponse(idpNonce, "bob", "approvers"),
+		}, samlResponse(identifyNonce, "bob")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", sshUsername(t, resp))
+}
+
+func TestServer_HandleWorkflowAuthMultipleIdps(t *testing.T) {
+	s := newTestServer()
+	contractors := testIdpConfig("contractors")
+	cert, err := ioutil.ReadFile("testdata/other_idp.crt")
+	assert.NoError(t, err)
+	contractors.Config.(*api.IdpConfigSaml).Certificate = string(cert)
+	s.Config.Idp = append(s.Config.Idp, contractors)
+	s.Config.Workflow.Policies[1].IdpName = "contractors"
+	assert.NoError(t, s.Config.Validate())
+
+	// Assertions from the "nonprod" IDP aren't valid for a policy using
+	// the "contractors" IDP
+	_, err = workflowAuth(s, "developer", "bob", func(idpNonce, identifyNonce string) ([]string, string) {
+		return nil, samlResponse(identifyNonce, "bob", "developers")
+	})
+	assert.Error(t, err)
+
+	// But are still valid for a policy using "nonprod"
+	_, err = workflowAuth(s, "deployment", "dave", func(idpNonce, identifyNonce string) ([]string, string) {
+		return []string{samlResponse(idpNonce, "alice", "approvers")}, samlResponse(identifyNonce, "dave")
+	})
+	assert.NoError(t, err)
+
+	s.Config.Workflow.Policies[1].IdpName = "does-not-exist"
+	_, err = workflowAuth(s, "developer", "bob", func(idpNonce, identifyNonce string) ([]string, string) {
+		return nil, samlResponse(identifyNonce, "bob", "developers")
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "idp not found")
+}
+
+func TestServer_HandleWorkflowAuthOidc(t *testing.T) {
+	s := newTestServer()
+	ti := newTestOidcIdp()
+	s.Config.Idp = []api.IdpConfig{ti.config("oidc")}
+	s.Config.Workflow.Policies[0].IdpName = "oidc"
+	s.Config.Workflow.Policies[0].ApproverRoles = map[string]int{"approvers": 2}
+	s.Config.Workflow.Policies[1].IdpName = "oidc"
+	assert.NoError(t, s.Config.Validate())
+
+	// The same quorum rules apply to OIDC approvals
+	resp, err := workflowAuth(s, "deployment", "bob", func(idpNonce, identifyNonce string) ([]string, string) {
+		return []string{
+			ti.idToken(idpNonce, "alice", "approvers"),
+			ti.idToken(idpNonce, "carol", "approvers"),
+		}, ti.idToken(identifyNonce, "bob")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", sshUsername(t, resp))
+
+	_, err = workflowAuth(s, "deployment", "dave", func(idpNonce, identifyNonce string) ([]string, string) {
+		return []string{
+			ti.idToken(idpNonce, "alice", "approvers"),
+			ti.idToken(idpNonce, "alice", "approvers"),
+		}, ti.idToken(identifyNonce, "dave")
+	})
+	assert.Error(t, err)
+
+	// ID tokens are bound to the workflow idp nonce
+	_, err = workflowAuth(s, "developer", "bob", func(idpNonce, identifyNonce string) ([]string, string) {
+		return nil, ti.idToken("another-nonce", "bob", "developers")
+	})
+	assert.Error(t, err)
+	resp, err = workflowAuth(s, "developer", "bob", func(idpNonce, identifyNonce string) ([]string, string) {
+		return nil, ti.idToken(identifyNonce, "bob", "developers")
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", sshUsername(t, resp))
+
+	// SAML assertions aren't accepted by an OIDC IDP
+	_, err = workflowAuth(s, "developer", "bob", func(idpNonce, identifyNonce string) ([]string, string) {
+		return nil, samlResponse(identifyNonce, "bob", "developers")
+	})
+	assert.Error(t, err)
+}
+
+func TestServer_HandleDirectSamlAuth(t *testing.T) {
+	s := newTestServer()
+	s.Config.Workflow.Policies[1].SelfService = true
+	assert.NoError(t, s.Config.Validate())
+	directAuth := func(role string, samlResponse string) (*api.DirectAuthResponse, error) {
+		return s.HandleDirectSamlAuth(&api.DirectSamlAuthRequest{
+			RequestedRole: role,
+			SAMLResponse:  samlResponse,
+		})
+	}
+
+	resp, err := directAuth("developer", samlResponse("", "bob", "developers"))
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", sshUsername(t, &api.WorkflowAuthResponse{Credentials: resp.Credentials}))
+
+	// Only for self service roles, and users in an identify group
+	_, err = directAuth("deployment", samlResponse("", "bob", "approvers"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "does not allow direct auth")
+	_, err = directAuth("developer", samlResponse("", "bob", "everyone"))
+	assert.Error(t, err)
+
+	// Only unsolicited responses, each used once
+	_, err = directAuth("developer", samlResponse("some-request", "bob", "developers"))
+	assert.Error(t, err)
+	response := samlResponse("", "bob", "developers")
+	_, err = directAuth("developer", response)
+	assert.NoError(t, err)
+	_, err = directAuth("developer", response)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "already been redeemed")
+
+	// SHA-1 signatures are not accepted
+	_, err = directAuth("developer", signedSamlResponse(dsig.RSASHA1SignatureMethod, "", "_sha1", "bob", "developers"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported signature algorithm")
+}
+
+func TestServer_HandleDirectSamlAuthBinding(t *testing.T) {
+	s := newTestServer()
+	s.Config.Workflow.Policies[1].SelfService = true
+	sigAlg := dsig.RSASHA256SignatureMethod
+	directAuth := func(query string) (*api.DirectAuthResponse, error) {
+		return s.HandleDirectSamlAuth(&api.DirectSamlAuthRequest{RequestedRole: "developer", Query: query})
+	}
+
+	resp, err := directAuth(redirectQuery(samlResponse("", "bob", "developers"), "developer", sigAlg, url.QueryEscape))
+	assert.NoError(t, err)
+	assert.Len(t, resp.Credentials, 1)
+
+	// The signature is over the parameters as the IDP encoded them
+	resp, err = directAuth(redirectQuery(samlResponse("", "bob", "developers"), "developer", sigAlg, lowerHexEscape))
+	assert.NoError(t, err)
+	assert.Len(t, resp.Credentials, 1)
+	query := redirectQuery(samlResponse("", "bob", "developers"), "developer", sigAlg, url.QueryEscape)
+	_, err = directAuth(strings.Replace(query, "RelayState=developer", "RelayState=%64eveloper", 1))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid binding signature")
+
+	// Signature over a different response
+	other := redirectQuery(samlResponse("", "carol", "developers"), "developer", sigAlg, url.QueryEscape)
+	_, err = directAuth(strings.SplitN(other, "&", 2)[0] + "&" + strings.SplitN(query, "&", 2)[1])
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid binding signature")
+
+	// Relay state for another role
+	_, err = directAuth(redirectQuery(samlResponse("", "bob", "developers"), "deployment", sigAlg, url.QueryEscape))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "relay state")
+
+	// The response can't also be given beside the query
+	relayState := "developer"
+	_, err = s.HandleDirectSamlAuth(&api.DirectSamlAuthRequest{RequestedRole: "developer", RelayState: &relayState, Query: query})
+	assert.Equal(t, api.ErrorCodeBadRequest, api.ErrorCodeOf(err))
+
+	// Weak or missing signature algorithms, or signatures
+	_, err = directAuth(redirectQuery(samlResponse("", "bob", "developers"), "developer", dsig.RSASHA1SignatureMethod, url.QueryEscape))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported sig alg")
+	_, err = directAuth(strings.SplitN(query, "&Signature=", 2)[0])
+	assert.Error(t, err)
+	_, err = directAuth(query + "&SigAlg=" + url.QueryEscape(sigAlg))
+	assert.Error(t, err)
+}
+
+func TestServer_HandleDirectOidcAuth(t *testing.T) {
+	s := newTestServer()
+	ti := newTestOidcIdp()
+	s.Config.Idp = append(s.Config.Idp, ti.config("oidc"))
+	s.Config.Workflow.Policies[1].IdpName = "oidc"
+	s.Config.Workflow.Policies[1].SelfService = true
+	assert.NoError(t, s.Config.Validate())
+
+	idToken := ti.idToken("", "bob", "developers")
+	resp, err := s.HandleDirectOidcAuth(&api.DirectOidcAuthRequest{RequestedRole: "developer", IdToken: idToken})
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", sshUsername(t, &api.WorkflowAuthResponse{Credentials: resp.Credentials}))
+
+	// Each token is used once
+	_, err = s.HandleDirectOidcAuth(&api.DirectOidcAuthRequest{RequestedRole: "developer", IdToken: idToken})
+	assert.Error(t, err)
+
+	// Tokens from a workflow (approvals or identification) have its IDP
+	// nonce, and are only good for that workflow
+	start, err := s.HandleWorkflowStart(&api.WorkflowStartRequest{Role: "developer"})
+	assert.NoError(t, err)
+	_, err = s.HandleDirectOidcAuth(&api.DirectOidcAuthRequest{
+		RequestedRole: "developer",
+		IdToken:       ti.idToken(start.IdentifyNonce, "bob", "developers"),
+	})
+	assert.Equal(t, api.ErrorCodeInvalidAssertion, api.ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "must not have a nonce")
+
+	// Users must be in an identify group of a self service role
+	_, err = s.HandleDirectOidcAuth(&api.DirectOidcAuthRequest{
+		RequestedRole: "developer",
+		IdToken:       ti.idToken("", "bob", "everyone"),
+	})
+	assert.Error(t, err)
+	_, err = s.HandleDirectOidcAuth(&api.DirectOidcAuthRequest{
+		RequestedRole: "deployment",
+		IdToken:       ti.idToken("", "bob", "approvers"),
+	})
+	assert.Error(t, err)
+
+	// And the role's idp must be an oidc idp
+	s.Config.Workflow.Policies[1].IdpName = "nonprod"
+	_, err = s.HandleDirectOidcAuth(&api.DirectOidcAuthRequest{
+		RequestedRole: "developer",
+		IdToken:       ti.idToken("", "bob", "developers"),
+	})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not an oidc idp")
+}
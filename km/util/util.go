@@ -8,6 +8,8 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"io/ioutil"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -45,3 +47,26 @@ func LoadFromS3(sess *session.Session, s3uri string) ([]byte, error) {
 	}
 	return buf.Bytes(), nil
 }
+
+// MaxRequestBytes limits the bodies the km and workflow HTTP servers
+// read; their requests are small JSON documents and form posts
+const MaxRequestBytes = 1 << 20
+
+// WriteFileAtomic writes the file by writing a temporary file beside it
+// and renaming that over it, so that a crash never leaves a truncated
+// file behind
+func WriteFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -2,6 +2,9 @@ package util
 
 import (
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -13,4 +16,22 @@ func TestLoad(t *testing.T) {
 	v, err = Load("file://testdata/load_data.txt")
 	assert.NoError(t, err)
 	assert.Equal(t, []byte("sasquatch"), v)
-}
\ No newline at end of file
+}
+func TestWriteFileAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "util")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	assert.NoError(t, WriteFileAtomic(path, []byte("one")))
+	assert.NoError(t, WriteFileAtomic(path, []byte("two")))
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("two"), data)
+	// No temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	assert.Error(t, WriteFileAtomic(filepath.Join(dir, "missing", "state.json"), []byte("three")))
+}
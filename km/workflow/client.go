@@ -4,20 +4,24 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/pkg/errors"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
+	"time"
 )
 
 type Client struct {
-	BaseURL         *url.URL
-	HttpClient      *http.Client
-	PolicyEncrypter string // TODO: key, signingmethod etc
-	Debug           int
+	BaseURL    *url.URL
+	HttpClient *http.Client
+	Debug      int
 }
 
 func NewClient(baseUrl string) (*Client, error) {
@@ -26,12 +30,23 @@ func NewClient(baseUrl string) (*Client, error) {
 		return nil, errors.Wrap(err, "error parsing workflow client URL")
 	}
 	return &Client{
-		BaseURL:         u,
-		HttpClient:      http.DefaultClient,
-		PolicyEncrypter: "", // TODO
+		BaseURL:    u,
+		HttpClient: http.DefaultClient,
 	}, nil
 }
 
+// Workflow statuses
+const (
+	// Waiting for approvals
+	StatusCreated   = "CREATED"
+	StatusCompleted = "COMPLETED"
+	StatusRejected  = "REJECTED"
+	// Not approved in time
+	StatusExpired = "EXPIRED"
+	// Withdrawn by the requester
+	StatusCancelled = "CANCELLED"
+)
+
 type Requester struct {
 	Name     string `json:"name"`
 	Username string `json:"username"`
@@ -55,6 +70,15 @@ type Policy struct {
 	RequesterCanApprove bool           `json:"requester_can_approve"`
 	IdentifyRoles       map[string]int `json:"identify_roles"`
 	ApproverRoles       map[string]int `json:"approver_roles"`
+	// The issuing server refuses approvals for workflows older than
+	// this; 0 for no limit beyond the issuing nonce's
+	MaxApprovalAgeSeconds int `json:"max_approval_age_seconds,omitempty"`
+}
+
+// RequiresIdentification is true if the requester must identify
+// themselves (see api.WorkflowPolicyConfig)
+func (p *Policy) RequiresIdentification() bool {
+	return len(p.IdentifyRoles) > 0 || (len(p.ApproverRoles) > 0 && !p.RequesterCanApprove)
 }
 
 type CreateRequest struct {
@@ -62,9 +86,18 @@ type CreateRequest struct {
 	Requester Requester `json:"requester"`
 	Source    Source    `json:"source"`
 	Target    Target    `json:"target"`
-	// To be encrypted with workflow public key
-	// TODO: change type here, separation of concerns...
+	// The IDP nonce for the requester to identify with, from workflow
+	// start. Needed if the policy requires identification.
+	IdentifyNonce string `json:"identify_nonce,omitempty"`
+	// Engines which verify signed policies use the signed policy
+	// instead, and may ignore this
 	Policy Policy `json:"policy"`
+	// The signed (and maybe encrypted) policy from the issuing server,
+	// passed on unchanged. See PolicyClaims.
+	SignedPolicy string `json:"signed_policy,omitempty"`
+	// The longest the requester will wait for approval. The workflow
+	// expires after this, or sooner if the engine or policy says so.
+	ExpiresInSeconds int `json:"expires_in_seconds,omitempty"`
 }
 
 type CreateResponse struct {
@@ -73,17 +106,87 @@ type CreateResponse struct {
 	WorkflowNonce string `json:"workflow_nonce"`
 }
 
+type CancelRequest struct {
+	WorkflowId    string `json:"workflow_id"`
+	WorkflowNonce string `json:"workflow_nonce"`
+}
+
+type CancelResponse struct {
+	// CANCELLED, or EXPIRED if it had already expired
+	Status string `json:"status"`
+}
+
 type GetDetailsRequest struct {
-	// Workflow id
+	WorkflowId    string `json:"workflow_id"`
+	WorkflowNonce string `json:"workflow_nonce"`
 }
 
 type GetDetailsResponse struct {
-	// State: pending / completed
+	Status    string    `json:"status"`
+	Requester Requester `json:"requester"`
+	Source    Source    `json:"source"`
+	Target    Target    `json:"target"`
+	// Approvals collected so far
+	Approvals []Approval `json:"approvals"`
+	// Approvals still needed, by approver group
+	MissingApprovals map[string]int `json:"missing_approvals,omitempty"`
+	// The requester has yet to identify themselves
+	MissingIdentification bool       `json:"missing_identification,omitempty"`
+	Rejection             *Rejection `json:"rejection,omitempty"`
+	CreatedAt             time.Time  `json:"created_at"`
+	// After this the workflow can no longer be approved
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type Approval struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	// The approver group the approval counts towards, or empty if it
+	// isn't needed
+	Group      string    `json:"group"`
+	Comment    string    `json:"comment,omitempty"`
+	ApprovedAt time.Time `json:"approved_at"`
+}
+
+type Rejection struct {
+	Username   string    `json:"username"`
+	Email      string    `json:"email"`
+	Reason     string    `json:"reason,omitempty"`
+	RejectedAt time.Time `json:"rejected_at"`
+}
+
+// WaitingOn describes the approvals the workflow still needs, e.g.
+// "waiting on 1 more approval from security", or "" if there are none.
+func (d *GetDetailsResponse) WaitingOn() string {
+	groups := make([]string, 0, len(d.MissingApprovals))
+	for group := range d.MissingApprovals {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	var parts []string
+	for _, group := range groups {
+		n := d.MissingApprovals[group]
+		if n == 1 {
+			parts = append(parts, fmt.Sprintf("1 more approval from %s", group))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d more approvals from %s", n, group))
+		}
+	}
+	if d.MissingIdentification {
+		parts = append(parts, "the requester to identify themselves")
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "waiting on " + strings.Join(parts, " and ")
 }
 
 type GetAssertionsRequest struct {
 	WorkflowId    string `json:"workflow_id"`
 	WorkflowNonce string `json:"workflow_nonce"`
+	// Engines which support long polling hold the request open for up
+	// to this long, until the workflow changes. Others ignore it.
+	WaitSeconds int `json:"wait_seconds,omitempty"`
 }
 
 type GetAssertionsResponse struct {
@@ -91,6 +194,10 @@ type GetAssertionsResponse struct {
 	//Workflow Workflow `json:"workflow"` //???
 	Status     string   `json:"status"`     //???
 	Assertions []string `json:"assertions"` // Resulting IDP assertions
+	// The requester's own IDP assertion, if the policy identifies them
+	IdentifyAssertion string `json:"identify_assertion"`
+	// Set by engines which held the request open (see WaitSeconds)
+	LongPoll bool `json:"long_poll,omitempty"`
 }
 
 func (c *Client) Create(ctx context.Context, req *CreateRequest) (*CreateResponse, error) {
@@ -102,6 +209,18 @@ func (c *Client) Create(ctx context.Context, req *CreateRequest) (*CreateRespons
 	return &resp, err
 }
 
+// Cancel withdraws a workflow which is waiting for approval, so that it
+// can no longer be approved. Workflows which are already finished
+// can't be cancelled.
+func (c *Client) Cancel(ctx context.Context, req *CancelRequest) (*CancelResponse, error) {
+	var resp CancelResponse
+	err := c.call(ctx, "POST", "/1/workflow/cancel", req, &resp)
+	if err != nil {
+		return nil, errors.Wrap(err, "workflow cancel error")
+	}
+	return &resp, err
+}
+
 func (c *Client) GetDetails(ctx context.Context, req *GetDetailsRequest) (*GetDetailsResponse, error) {
 	var resp GetDetailsResponse
 	err := c.call(ctx, "POST", "/1/workflow/getDetails", req, &resp)
@@ -176,8 +295,7 @@ func (c *Client) do(req *http.Request, v interface{}) (*http.Response, error) {
 		log.Printf("raw response: %s", string(body))
 	}
 	if resp.StatusCode >= 400 { // http 4xx, 5xx
-		return nil, errors.Errorf("server error: StatusCode: %d: Body: %s",
-			resp.StatusCode, string(body))
+		return nil, &HTTPError{StatusCode: resp.StatusCode, Body: string(body)}
 	}
 	err = json.Unmarshal(body, v)
 	if err != nil {
@@ -186,3 +304,29 @@ func (c *Client) do(req *http.Request, v interface{}) (*http.Response, error) {
 
 	return resp, nil
 }
+
+// HTTPError is an error response from the workflow engine
+type HTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("server error: StatusCode: %d: Body: %s", e.StatusCode, e.Body)
+}
+
+// IsTemporary reports whether a request which failed with err may
+// succeed if retried: network errors, and server errors which are
+// usually transient.
+func IsTemporary(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -1,2 +1,18 @@
 package workflow
 
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGetDetailsResponse_WaitingOn(t *testing.T) {
+	d := &GetDetailsResponse{}
+	assert.Equal(t, "", d.WaitingOn())
+	d.MissingApprovals = map[string]int{"security": 1}
+	assert.Equal(t, "waiting on 1 more approval from security", d.WaitingOn())
+	d.MissingApprovals = map[string]int{"security": 1, "platform": 2}
+	assert.Equal(t, "waiting on 2 more approvals from platform and 1 more approval from security", d.WaitingOn())
+	d.MissingApprovals = nil
+	d.MissingIdentification = true
+	assert.Equal(t, "waiting on the requester to identify themselves", d.WaitingOn())
+}
@@ -0,0 +1,816 @@
+// Package engine is a reference implementation of the workflow engine
+// API used by workflow.Client. It collects SAML approvals for keymaster
+// requests: approvers log in to the IDP with the workflow's IDP nonce as
+// the request ID, and the engine keeps the resulting SAML responses
+// until the requester collects them.
+//
+// The engine checks approvals so that it can tell the requester when a
+// workflow is complete, but the issuing server does not trust it and
+// checks them again.
+package engine
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/idp"
+	"github.com/bsycorp/keymaster/km/idp/saml"
+	"github.com/bsycorp/keymaster/km/util"
+	"github.com/bsycorp/keymaster/km/workflow"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/ghodss/yaml"
+	"github.com/google/uuid"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ApprovePath is where IDPs post SAML responses to (the ACS URL). The
+// redirect_uri of each IDP must be the engine's base URL plus this.
+const ApprovePath = "/1/saml/approve"
+
+// Actions an approver (or the requester) can take on a workflow
+const (
+	ActionApprove  = "approve"
+	ActionReject   = "reject"
+	ActionIdentify = "identify"
+)
+
+// DefaultWorkflowValidForSeconds matches the issuing server's default
+// issuing nonce lifetime; approvals after that are no use.
+const DefaultWorkflowValidForSeconds = api.DefaultIssuingNonceValidForSeconds
+
+// Limits on approver comments, which are stored before the approver has
+// logged in
+const (
+	maxCommentLength   = 1000
+	maxPendingComments = 10
+)
+
+type Config struct {
+	// The engine's public URL, for approval links
+	BaseURL string          `json:"base_url"`
+	Idp     []api.IdpConfig `json:"idp"`
+	Storage StorageConfig   `json:"storage"`
+	// How long workflows can be approved for
+	WorkflowValidForSeconds int `json:"workflow_valid_for_seconds"`
+	// Issuing servers whose signed policies are trusted. Every workflow
+	// needs a signed policy from one of them.
+	PolicyIssuers []PolicyIssuerConfig `json:"policy_issuers"`
+	// Accept any workflow, with the policy the client sends, if there
+	// are no policy issuers. Anyone who can reach the engine can then
+	// have notifications sent to approvers; only for local development.
+	InsecureUnsignedPolicies bool `json:"insecure_unsigned_policies"`
+	// For encrypted policies, the PEM encoded RSA private key matching
+	// the issuing servers' encryption_key. Can be s3:// file:// data://
+	// or raw data
+	PolicyDecryptionKey string `json:"policy_decryption_key"`
+	// How approvers are told about new workflows
+	Notify []NotifierConfig `json:"notify"`
+}
+
+type PolicyIssuerConfig struct {
+	// The issuing server's environment name (its config name)
+	Name string `json:"name"`
+	// PEM encoded RSA or EC public key. Can be s3:// file:// data:// or
+	// raw data
+	PublicKey string `json:"public_key"`
+}
+
+type StorageConfig struct {
+	// One of: memory, file
+	Type string `json:"type"`
+	Path string `json:"path"`
+	// How long workflows are kept after they expire; default
+	// DefaultRetainSeconds
+	RetainSeconds int `json:"retain_seconds"`
+}
+
+// Workflow is the engine's record of a workflow
+type Workflow struct {
+	ID string `json:"id"`
+	// Secret given to the requester, needed to collect the assertions
+	Nonce     string             `json:"nonce"`
+	IdpNonce  string             `json:"idp_nonce"`
+	Requester workflow.Requester `json:"requester"`
+	Source    workflow.Source    `json:"source"`
+	Target    workflow.Target    `json:"target"`
+	Policy    workflow.Policy    `json:"policy"`
+	Status    string             `json:"status"`
+	CreatedAt time.Time          `json:"created_at"`
+	ExpiresAt time.Time          `json:"expires_at"`
+	Approvals []Approval         `json:"approvals"`
+	// The IDP nonce for the requester's identification, kept apart from
+	// approvals
+	IdentifyNonce string `json:"identify_nonce,omitempty"`
+	// The requester's own verified identity, if they identified
+	Identity  *Approval `json:"identity,omitempty"`
+	Rejection *Approval `json:"rejection,omitempty"`
+	// Comments entered by approvers who are off logging in to the IDP
+	PendingComments []PendingComment `json:"pending_comments,omitempty"`
+}
+
+// PendingComment is held until the SAML response with the token in its
+// relay state comes back, so the comment is attributed to a verified
+// approver.
+type PendingComment struct {
+	Token   string `json:"token"`
+	Comment string `json:"comment"`
+}
+
+// Approval is a verified SAML response from an approver (or, for
+// identification, the requester).
+type Approval struct {
+	Username string    `json:"username"`
+	Email    string    `json:"email"`
+	Groups   []string  `json:"groups"`
+	At       time.Time `json:"at"`
+	// The approver's comment, or reason for rejecting
+	Comment string `json:"comment,omitempty"`
+	// The raw SAML response, for the issuing server
+	Assertion string `json:"assertion"`
+}
+
+func (a *Approval) userInfo() idp.UserInfo {
+	return idp.UserInfo{Username: a.Username, Email: a.Email, Groups: a.Groups}
+}
+
+// Error is an engine error with the HTTP status to return for it
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func errorf(status int, format string, args ...interface{}) error {
+	return &Error{Status: status, Message: errors.Errorf(format, args...).Error()}
+}
+
+type Engine struct {
+	Config Config
+	Store  Store
+	Clock  clockwork.Clock
+	// Told about each new workflow; from the config if nil
+	Notifiers []Notifier
+
+	processors     map[string]*saml.AssertionProcessor
+	policyVerifier *workflow.PolicyVerifier
+
+	// Closed and replaced whenever a workflow changes, to wake long polls.
+	// Only changes made by this instance are seen.
+	updateMu sync.Mutex
+	updated  chan struct{}
+
+	notifying sync.WaitGroup
+}
+
+func (e *Engine) now() time.Time {
+	if e.Clock == nil {
+		return time.Now()
+	}
+	return e.Clock.Now()
+}
+
+// Configure loads the config (which may be a reference, as for the
+// issuing server) and sets up the IDPs and storage.
+func (e *Engine) Configure(config string) error {
+	configData, err := util.Load(config)
+	if err != nil {
+		return err
+	}
+	var tmpConfig Config
+	if strings.HasPrefix(string(configData), "{") {
+		err = json.Unmarshal(configData, &tmpConfig)
+	} else {
+		err = yaml.Unmarshal(configData, &tmpConfig)
+	}
+	if err != nil {
+		return err
+	}
+	return e.Init(tmpConfig)
+}
+
+// Init sets up the engine with the config.
+func (e *Engine) Init(config Config) error {
+	if config.BaseURL == "" {
+		return errors.New("no base_url configured")
+	}
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+	if config.WorkflowValidForSeconds == 0 {
+		config.WorkflowValidForSeconds = DefaultWorkflowValidForSeconds
+	}
+	processors := make(map[string]*saml.AssertionProcessor)
+	for _, idpConfig := range config.Idp {
+		c, ok := idpConfig.Config.(*api.IdpConfigSaml)
+		if !ok {
+			return errors.Errorf("idp %s: only saml idps are supported", idpConfig.Name)
+		}
+		if c.SSOURL == "" {
+			return errors.Errorf("idp %s: no sso_url configured", idpConfig.Name)
+		}
+		if c.RedirectURI != config.BaseURL+ApprovePath {
+			return errors.Errorf("idp %s: redirect_uri must be %s", idpConfig.Name, config.BaseURL+ApprovePath)
+		}
+		sp := &saml.AssertionProcessor{
+			CAData:                  []byte(c.Certificate),
+			Audience:                c.Audience,
+			UsernameAttr:            c.UsernameAttr,
+			EmailAttr:               c.EmailAttr,
+			GroupsAttr:              c.GroupsAttr,
+			RedirectURI:             c.RedirectURI,
+			SSOURL:                  c.SSOURL,
+			DisableNameIDValidation: true,
+		}
+		if err := sp.Init(); err != nil {
+			return errors.Wrapf(err, "idp %s", idpConfig.Name)
+		}
+		processors[idpConfig.Name] = sp
+	}
+	policyVerifier, err := newPolicyVerifier(&config)
+	if err != nil {
+		return err
+	}
+	if e.Store == nil {
+		store, err := NewStoreFromConfig(&config.Storage, e.Clock)
+		if err != nil {
+			return err
+		}
+		e.Store = store
+	}
+	if e.Notifiers == nil {
+		notifiers, err := NewNotifiersFromConfig(config.Notify)
+		if err != nil {
+			return err
+		}
+		e.Notifiers = notifiers
+	}
+	e.Config = config
+	e.processors = processors
+	e.policyVerifier = policyVerifier
+	return nil
+}
+
+func newPolicyVerifier(config *Config) (*workflow.PolicyVerifier, error) {
+	if len(config.PolicyIssuers) == 0 {
+		if config.PolicyDecryptionKey != "" {
+			return nil, errors.New("policy_decryption_key is configured without policy_issuers")
+		}
+		if !config.InsecureUnsignedPolicies {
+			return nil, errors.New("policy_issuers are required, unless insecure_unsigned_policies is set")
+		}
+		return nil, nil
+	}
+	verifier := &workflow.PolicyVerifier{
+		Keys:     make(map[string]interface{}),
+		Audience: config.BaseURL,
+	}
+	for _, issuer := range config.PolicyIssuers {
+		keyData, err := util.Load(issuer.PublicKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error loading public key for policy issuer %s", issuer.Name)
+		}
+		verifier.Keys[issuer.Name], err = workflow.ParsePublicKey(keyData)
+		if err != nil {
+			return nil, errors.Wrapf(err, "policy issuer %s", issuer.Name)
+		}
+	}
+	if config.PolicyDecryptionKey != "" {
+		keyData, err := util.Load(config.PolicyDecryptionKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "error loading policy decryption key")
+		}
+		verifier.DecryptionKey, err = jwt.ParseRSAPrivateKeyFromPEM(keyData)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid policy decryption key")
+		}
+	}
+	return verifier, nil
+}
+
+// policy returns the policy for a new workflow: the signed policy if
+// policy issuers are configured, otherwise the one the client sent.
+func (e *Engine) policy(req *workflow.CreateRequest) (*workflow.Policy, error) {
+	if e.policyVerifier == nil {
+		return &req.Policy, nil
+	}
+	if req.SignedPolicy == "" {
+		return nil, errorf(http.StatusBadRequest, "no signed policy")
+	}
+	verifier := *e.policyVerifier
+	verifier.Clock = e.Clock
+	claims, err := verifier.Verify(req.SignedPolicy)
+	if err != nil {
+		return nil, errorf(http.StatusForbidden, "%s", err)
+	}
+	if claims.IdpNonce != req.IdpNonce || claims.IdentifyNonce != req.IdentifyNonce {
+		return nil, errorf(http.StatusForbidden, "signed policy is for another workflow")
+	}
+	if !strings.EqualFold(claims.RequesterUsername, req.Requester.Username) || !strings.EqualFold(claims.RequesterEmail, req.Requester.Email) {
+		return nil, errorf(http.StatusForbidden, "signed policy is for another requester")
+	}
+	// Approvers are shown the target, so it has to be right
+	if claims.Issuer != req.Target.EnvironmentName {
+		return nil, errorf(http.StatusForbidden, "signed policy is from %s, not the target environment %s", claims.Issuer, req.Target.EnvironmentName)
+	}
+	return &claims.Policy, nil
+}
+
+// WorkflowURL is the approval page for the workflow
+func (e *Engine) WorkflowURL(id string) string {
+	return e.Config.BaseURL + "/workflow/" + id
+}
+
+func (e *Engine) Create(req *workflow.CreateRequest) (*workflow.CreateResponse, error) {
+	if req.IdpNonce == "" {
+		return nil, errorf(http.StatusBadRequest, "no idp nonce")
+	}
+	policy, err := e.policy(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, found := e.processors[policy.IdpName]; !found {
+		return nil, errorf(http.StatusBadRequest, "unknown idp: %s", policy.IdpName)
+	}
+	if len(policy.ApproverRoles) == 0 && len(policy.IdentifyRoles) == 0 {
+		return nil, errorf(http.StatusBadRequest, "policy %s needs no approval", policy.Name)
+	}
+	if policy.RequiresIdentification() && (req.IdentifyNonce == "" || req.IdentifyNonce == req.IdpNonce) {
+		return nil, errorf(http.StatusBadRequest, "policy %s needs a separate identify nonce", policy.Name)
+	}
+	nonce, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	// The shortest of the engine's limit, the policy's (which the issuing
+	// server enforces anyway) and the requester's
+	validFor := e.Config.WorkflowValidForSeconds
+	for _, limit := range []int{policy.MaxApprovalAgeSeconds, req.ExpiresInSeconds} {
+		if limit > 0 && limit < validFor {
+			validFor = limit
+		}
+	}
+	now := e.now()
+	wf := &Workflow{
+		ID:            uuid.New().String(),
+		Nonce:         nonce,
+		IdpNonce:      req.IdpNonce,
+		IdentifyNonce: req.IdentifyNonce,
+		Requester:     req.Requester,
+		Source:        req.Source,
+		Target:        req.Target,
+		Policy:        *policy,
+		Status:        workflow.StatusCreated,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(time.Duration(validFor) * time.Second),
+	}
+	if err := e.Store.Create(wf); err != nil {
+		return nil, errors.Wrap(err, "error storing workflow")
+	}
+	log.Println("Created workflow:", wf.ID, "for:", wf.Requester.Username, "policy:", wf.Policy.Name)
+	e.notify(wf)
+	return &workflow.CreateResponse{
+		WorkflowId:    wf.ID,
+		WorkflowUrl:   e.WorkflowURL(wf.ID),
+		WorkflowNonce: wf.Nonce,
+	}, nil
+}
+
+// notify tells approvers about a new workflow, in the background so
+// that slow or failing notifiers don't hold up the requester. Failures
+// are only logged; the requester has the approval link anyway.
+func (e *Engine) notify(wf *Workflow) {
+	n := newNotification(wf, e.WorkflowURL(wf.ID))
+	for _, notifier := range e.Notifiers {
+		e.notifying.Add(1)
+		go func(notifier Notifier) {
+			defer e.notifying.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+			defer cancel()
+			if err := notifier.Notify(ctx, n); err != nil {
+				log.Println("Error notifying approvers of workflow:", n.WorkflowID, err)
+			}
+		}(notifier)
+	}
+}
+
+// WaitForNotifications waits for notifications which are being sent,
+// e.g. before shutting down.
+func (e *Engine) WaitForNotifications() {
+	e.notifying.Wait()
+}
+
+// get returns the workflow if the nonce is right
+func (e *Engine) get(id string, nonce string) (*Workflow, error) {
+	wf, err := e.Store.Get(id)
+	if err == ErrNotFound {
+		return nil, errorf(http.StatusNotFound, "workflow not found: %s", id)
+	} else if err != nil {
+		return nil, err
+	}
+	if err := checkNonce(wf, nonce); err != nil {
+		return nil, err
+	}
+	e.expire(wf)
+	return wf, nil
+}
+
+func checkNonce(wf *Workflow, nonce string) error {
+	if subtle.ConstantTimeCompare([]byte(wf.Nonce), []byte(nonce)) != 1 {
+		return errorf(http.StatusForbidden, "wrong workflow nonce")
+	}
+	return nil
+}
+
+// expire marks the workflow EXPIRED if it is past its expiry and still
+// waiting for approval. Stored workflows aren't expired until they are
+// next updated, so this is done whenever one is read too.
+func (e *Engine) expire(wf *Workflow) {
+	if wf.Status != workflow.StatusCreated || wf.ExpiresAt.IsZero() || e.now().Before(wf.ExpiresAt) {
+		return
+	}
+	wf.Status = workflow.StatusExpired
+	wf.PendingComments = nil
+}
+
+// Cancel withdraws a workflow for the requester. Cancelling a workflow
+// which has already been cancelled or has expired does nothing.
+func (e *Engine) Cancel(req *workflow.CancelRequest) (*workflow.CancelResponse, error) {
+	wf, err := e.Store.Update(req.WorkflowId, func(wf *Workflow) error {
+		if err := checkNonce(wf, req.WorkflowNonce); err != nil {
+			return err
+		}
+		e.expire(wf)
+		switch wf.Status {
+		case workflow.StatusCreated:
+			wf.Status = workflow.StatusCancelled
+			wf.PendingComments = nil
+		case workflow.StatusCancelled, workflow.StatusExpired:
+		default:
+			return errorf(http.StatusConflict, "workflow is %s", wf.Status)
+		}
+		return nil
+	})
+	if err == ErrNotFound {
+		return nil, errorf(http.StatusNotFound, "workflow not found: %s", req.WorkflowId)
+	} else if err != nil {
+		return nil, err
+	}
+	e.notifyUpdate()
+	log.Println("Workflow:", wf.ID, "cancel", "status:", wf.Status)
+	return &workflow.CancelResponse{Status: wf.Status}, nil
+}
+
+// updates returns a channel which is closed at the next workflow update
+func (e *Engine) updates() <-chan struct{} {
+	e.updateMu.Lock()
+	defer e.updateMu.Unlock()
+	if e.updated == nil {
+		e.updated = make(chan struct{})
+	}
+	return e.updated
+}
+
+func (e *Engine) notifyUpdate() {
+	e.updateMu.Lock()
+	defer e.updateMu.Unlock()
+	if e.updated != nil {
+		close(e.updated)
+		e.updated = nil
+	}
+}
+
+// GetAssertions returns the workflow's status, and its assertions once
+// it is complete. If the request has WaitSeconds, an incomplete workflow
+// is only returned after it changes, the wait is up or ctx is done.
+func (e *Engine) GetAssertions(ctx context.Context, req *workflow.GetAssertionsRequest) (*workflow.GetAssertionsResponse, error) {
+	// Before reading, so no update is missed
+	updated := e.updates()
+	wf, err := e.get(req.WorkflowId, req.WorkflowNonce)
+	if err != nil {
+		return nil, err
+	}
+	wait := req.WaitSeconds
+	if wait > workflow.MaxWaitSeconds {
+		wait = workflow.MaxWaitSeconds
+	}
+	if wait > 0 && wf.Status == workflow.StatusCreated {
+		// Nothing else changes a workflow when it expires, so wake up then
+		timeout := time.Duration(wait) * time.Second
+		if untilExpiry := wf.ExpiresAt.Sub(e.now()); !wf.ExpiresAt.IsZero() && untilExpiry < timeout {
+			timeout = untilExpiry
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-updated:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		wf, err = e.get(req.WorkflowId, req.WorkflowNonce)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp := &workflow.GetAssertionsResponse{
+		Status:   wf.Status,
+		LongPoll: wait > 0,
+	}
+	if wf.Status == workflow.StatusCompleted {
+		for _, approval := range wf.Approvals {
+			resp.Assertions = append(resp.Assertions, approval.Assertion)
+		}
+		if wf.Identity != nil {
+			resp.IdentifyAssertion = wf.Identity.Assertion
+		}
+	}
+	return resp, nil
+}
+
+func (e *Engine) GetDetails(req *workflow.GetDetailsRequest) (*workflow.GetDetailsResponse, error) {
+	wf, err := e.get(req.WorkflowId, req.WorkflowNonce)
+	if err != nil {
+		return nil, err
+	}
+	resp := &workflow.GetDetailsResponse{
+		Status:    wf.Status,
+		Requester: wf.Requester,
+		Source:    wf.Source,
+		Target:    wf.Target,
+		Approvals: []workflow.Approval{},
+		CreatedAt: wf.CreatedAt,
+		ExpiresAt: wf.ExpiresAt,
+	}
+	groups := idp.AssignApprovers(wf.Policy.ApproverRoles, wf.approvers())
+	for i, approval := range wf.Approvals {
+		resp.Approvals = append(resp.Approvals, workflow.Approval{
+			Username:   approval.Username,
+			Email:      approval.Email,
+			Group:      groups[i],
+			Comment:    approval.Comment,
+			ApprovedAt: approval.At,
+		})
+	}
+	if wf.Status == workflow.StatusCreated {
+		resp.MissingApprovals = wf.MissingApprovals()
+		resp.MissingIdentification = wf.Policy.RequiresIdentification() && wf.Identity == nil
+	}
+	if wf.Rejection != nil {
+		resp.Rejection = &workflow.Rejection{
+			Username:   wf.Rejection.Username,
+			Email:      wf.Rejection.Email,
+			Reason:     wf.Rejection.Comment,
+			RejectedAt: wf.Rejection.At,
+		}
+	}
+	return resp, nil
+}
+
+// LoginRequest returns an SP initiated SAML login for an action on the
+// workflow: the request, the IDP's SSO URL to post it to, and the relay
+// state which brings the response back to the workflow. Any comment is
+// kept until the response arrives.
+func (e *Engine) LoginRequest(id string, action string, comment string) (ssoURL string, samlRequest string, relayState string, err error) {
+	if len(comment) > maxCommentLength {
+		return "", "", "", errorf(http.StatusBadRequest, "comment is too long (max %d characters)", maxCommentLength)
+	}
+	relayState = id + "/" + action
+	var wf *Workflow
+	if comment == "" {
+		wf, err = e.Store.Get(id)
+		if err == nil {
+			err = e.checkAction(wf, action)
+		}
+	} else {
+		// Relay state is limited to 80 bytes, so it gets a short token
+		// for the comment rather than the comment itself
+		token, tokenErr := randomToken(9)
+		if tokenErr != nil {
+			return "", "", "", tokenErr
+		}
+		relayState += "/" + token
+		wf, err = e.Store.Update(id, func(wf *Workflow) error {
+			if err := e.checkAction(wf, action); err != nil {
+				return err
+			}
+			wf.PendingComments = append(wf.PendingComments, PendingComment{Token: token, Comment: comment})
+			if len(wf.PendingComments) > maxPendingComments {
+				wf.PendingComments = wf.PendingComments[len(wf.PendingComments)-maxPendingComments:]
+			}
+			return nil
+		})
+	}
+	if err == ErrNotFound {
+		return "", "", "", errorf(http.StatusNotFound, "workflow not found: %s", id)
+	} else if err != nil {
+		return "", "", "", err
+	}
+	// The response will be InResponseTo the IDP nonce, which is what
+	// the issuing server checks
+	ssoURL, samlRequest, err = e.processors[wf.Policy.IdpName].AuthnRequest(wf.idpNonceFor(action))
+	if err != nil {
+		return "", "", "", err
+	}
+	return ssoURL, samlRequest, relayState, nil
+}
+
+// idpNonceFor is the IDP nonce for logins for the action. The issuing
+// server checks approvals against one and identification against the
+// other.
+func (wf *Workflow) idpNonceFor(action string) string {
+	if action == ActionIdentify {
+		return wf.IdentifyNonce
+	}
+	return wf.IdpNonce
+}
+
+func (e *Engine) checkAction(wf *Workflow, action string) error {
+	e.expire(wf)
+	switch action {
+	case ActionApprove, ActionReject:
+	case ActionIdentify:
+		if !wf.Policy.RequiresIdentification() {
+			return errorf(http.StatusBadRequest, "workflow does not need identification")
+		}
+	default:
+		return errorf(http.StatusNotFound, "unknown action: %s", action)
+	}
+	if wf.Status != workflow.StatusCreated {
+		return errorf(http.StatusConflict, "workflow is %s", wf.Status)
+	}
+	return nil
+}
+
+// HandleResponse verifies a SAML response posted back by the IDP and
+// carries out the action named in the relay state.
+func (e *Engine) HandleResponse(samlResponse string, relayState string) (*Workflow, error) {
+	parts := strings.SplitN(relayState, "/", 3)
+	if len(parts) < 2 {
+		return nil, errorf(http.StatusBadRequest, "invalid relay state: %s", relayState)
+	}
+	id, action := parts[0], parts[1]
+	var token string
+	if len(parts) == 3 {
+		token = parts[2]
+	}
+	wf, err := e.Store.Update(id, func(wf *Workflow) error {
+		if err := e.checkAction(wf, action); err != nil {
+			return err
+		}
+		users, err := e.processors[wf.Policy.IdpName].Process(wf.idpNonceFor(action), []string{samlResponse})
+		if err != nil {
+			return errorf(http.StatusForbidden, "invalid saml response: %s", err)
+		}
+		user := users[0]
+		approval := Approval{
+			Username:  user.Username,
+			Email:     user.Email,
+			Groups:    user.Groups,
+			At:        e.now(),
+			Comment:   takeComment(wf, token),
+			Assertion: samlResponse,
+		}
+		switch action {
+		case ActionApprove:
+			err = approve(wf, approval)
+		case ActionReject:
+			err = reject(wf, approval)
+		case ActionIdentify:
+			err = identify(wf, approval)
+		}
+		if err != nil {
+			return err
+		}
+		updateStatus(wf)
+		if wf.Status != workflow.StatusCreated {
+			wf.PendingComments = nil
+		}
+		return nil
+	})
+	if err == ErrNotFound {
+		return nil, errorf(http.StatusNotFound, "workflow not found: %s", id)
+	} else if err != nil {
+		return nil, err
+	}
+	e.notifyUpdate()
+	log.Println("Workflow:", wf.ID, action, "status:", wf.Status)
+	return wf, nil
+}
+
+// takeComment removes and returns the pending comment with the token
+func takeComment(wf *Workflow, token string) string {
+	if token == "" {
+		return ""
+	}
+	for i, pending := range wf.PendingComments {
+		if subtle.ConstantTimeCompare([]byte(pending.Token), []byte(token)) == 1 {
+			wf.PendingComments = append(wf.PendingComments[:i], wf.PendingComments[i+1:]...)
+			return pending.Comment
+		}
+	}
+	return ""
+}
+
+func isRequester(wf *Workflow, user idp.UserInfo) bool {
+	if wf.Identity != nil && idp.SamePerson(user, wf.Identity.userInfo()) {
+		return true
+	}
+	return idp.SamePerson(user, idp.UserInfo{Username: wf.Requester.Username, Email: wf.Requester.Email})
+}
+
+func approve(wf *Workflow, approval Approval) error {
+	user := approval.userInfo()
+	if !idp.InAnyGroup(wf.Policy.ApproverRoles, user.Groups) {
+		return errorf(http.StatusForbidden, "%s is not in any approver group: %s", user.Username, idp.GroupNames(wf.Policy.ApproverRoles))
+	}
+	if !wf.Policy.RequesterCanApprove && isRequester(wf, user) {
+		return errorf(http.StatusForbidden, "%s cannot approve their own request", user.Username)
+	}
+	for _, existing := range wf.Approvals {
+		if idp.SamePerson(user, existing.userInfo()) {
+			// Already counted; nothing to do
+			return nil
+		}
+	}
+	wf.Approvals = append(wf.Approvals, approval)
+	return nil
+}
+
+func reject(wf *Workflow, approval Approval) error {
+	user := approval.userInfo()
+	if !idp.InAnyGroup(wf.Policy.ApproverRoles, user.Groups) {
+		return errorf(http.StatusForbidden, "%s is not in any approver group: %s", user.Username, idp.GroupNames(wf.Policy.ApproverRoles))
+	}
+	wf.Rejection = &approval
+	wf.Status = workflow.StatusRejected
+	return nil
+}
+
+func identify(wf *Workflow, approval Approval) error {
+	user := approval.userInfo()
+	// Otherwise anyone who followed the link could make the workflow
+	// theirs
+	if !idp.SamePerson(user, idp.UserInfo{Username: wf.Requester.Username, Email: wf.Requester.Email}) {
+		return errorf(http.StatusForbidden, "%s is not the requester", user.Username)
+	}
+	if len(wf.Policy.IdentifyRoles) > 0 && !idp.InAnyGroup(wf.Policy.IdentifyRoles, user.Groups) {
+		return errorf(http.StatusForbidden, "%s is not in any identify group: %s", user.Username, idp.GroupNames(wf.Policy.IdentifyRoles))
+	}
+	wf.Identity = &approval
+	if !wf.Policy.RequesterCanApprove {
+		// The issuing server would reject the lot
+		approvals := wf.Approvals[:0]
+		for _, existing := range wf.Approvals {
+			if !idp.SamePerson(existing.userInfo(), user) {
+				approvals = append(approvals, existing)
+			}
+		}
+		wf.Approvals = approvals
+	}
+	return nil
+}
+
+// MissingApprovals returns the approvals the workflow still needs from
+// each approver group.
+func (wf *Workflow) MissingApprovals() map[string]int {
+	approvals := idp.MatchApprovals(wf.Policy.ApproverRoles, wf.approvers())
+	return idp.MissingApprovals(wf.Policy.ApproverRoles, approvals)
+}
+
+func (wf *Workflow) approvers() []idp.UserInfo {
+	approvers := make([]idp.UserInfo, 0, len(wf.Approvals))
+	for _, approval := range wf.Approvals {
+		approvers = append(approvers, approval.userInfo())
+	}
+	return approvers
+}
+
+func updateStatus(wf *Workflow) {
+	if wf.Status != workflow.StatusCreated {
+		return
+	}
+	if len(wf.MissingApprovals()) > 0 {
+		return
+	}
+	if wf.Policy.RequiresIdentification() && wf.Identity == nil {
+		return
+	}
+	wf.Status = workflow.StatusCompleted
+}
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "error generating nonce")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
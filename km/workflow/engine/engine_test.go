@@ -0,0 +1,689 @@
+package engine
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/beevik/etree"
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/workflow"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/google/uuid"
+	"github.com/jonboulle/clockwork"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testBaseURL     = "https://workflow.example.com"
+	testIdpAudience = "keymaster-saml"
+	testIdpSSOURL   = "https://idp.example.com/sso"
+)
+
+func testConfig() Config {
+	cert, err := ioutil.ReadFile("testdata/idp.crt")
+	if err != nil {
+		panic(err)
+	}
+	return Config{
+		BaseURL:                  testBaseURL,
+		InsecureUnsignedPolicies: true,
+		Idp: []api.IdpConfig{
+			{
+				Name: "nonprod",
+				Type: "saml",
+				Config: &api.IdpConfigSaml{
+					Certificate:  string(cert),
+					Audience:     testIdpAudience,
+					UsernameAttr: "name",
+					EmailAttr:    "email",
+					GroupsAttr:   "groups",
+					RedirectURI:  testBaseURL + ApprovePath,
+					SSOURL:       testIdpSSOURL,
+				},
+			},
+		},
+	}
+}
+
+func newTestEngine() *Engine {
+	e := &Engine{}
+	if err := e.Init(testConfig()); err != nil {
+		panic(err)
+	}
+	return e
+}
+
+func testCreateRequest(idpNonce string) *workflow.CreateRequest {
+	return &workflow.CreateRequest{
+		IdpNonce:      idpNonce,
+		IdentifyNonce: "identify-" + idpNonce,
+		Requester: workflow.Requester{
+			Name:     "Dave",
+			Username: "dave",
+			Email:    "dave@example.com",
+		},
+		Source: workflow.Source{
+			Description: "Deploy version 3.2",
+			DetailsURI:  "https://gitlab.example.com/platform/deploy/-/jobs/42",
+		},
+		Target: workflow.Target{
+			EnvironmentName: "nonprod",
+		},
+		Policy: workflow.Policy{
+			Name:          "deploy_with_approval",
+			IdpName:       "nonprod",
+			ApproverRoles: map[string]int{"security": 1, "platform": 1},
+		},
+	}
+}
+
+type testKeyStore struct {
+	key  *rsa.PrivateKey
+	cert []byte
+}
+
+func (ks *testKeyStore) GetKeyPair() (*rsa.PrivateKey, []byte, error) {
+	return ks.key, ks.cert, nil
+}
+
+// samlResponse builds a base64 encoded, signed SAML response for the
+// given user & groups, in response to inResponseTo.
+func samlResponse(inResponseTo string, username string, groups ...string) string {
+	now := time.Now().UTC()
+	ts := func(t time.Time) string { return t.Format("2006-01-02T15:04:05Z") }
+	var groupValues strings.Builder
+	for _, g := range groups {
+		fmt.Fprintf(&groupValues, `<saml:AttributeValue>%s</saml:AttributeValue>`, g)
+	}
+	redirectURI := testBaseURL + ApprovePath
+	doc := fmt.Sprintf(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_%s" Version="2.0" IssueInstant="%s" InResponseTo="%s" Destination="%s">
+<saml:Issuer>test-idp</saml:Issuer>
+<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>
+<saml:Assertion ID="_%s" Version="2.0" IssueInstant="%s">
+<saml:Issuer>test-idp</saml:Issuer>
+<saml:Subject>
+<saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">%s@example.com</saml:NameID>
+<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
+<saml:SubjectConfirmationData InResponseTo="%s" NotOnOrAfter="%s" Recipient="%s"/>
+</saml:SubjectConfirmation>
+</saml:Subject>
+<saml:Conditions NotBefore="%s" NotOnOrAfter="%s">
+<saml:AudienceRestriction><saml:Audience>%s</saml:Audience></saml:AudienceRestriction>
+</saml:Conditions>
+<saml:AttributeStatement>
+<saml:Attribute Name="name"><saml:AttributeValue>%s</saml:AttributeValue></saml:Attribute>
+<saml:Attribute Name="email"><saml:AttributeValue>%s@example.com</saml:AttributeValue></saml:Attribute>
+<saml:Attribute Name="groups">%s</saml:Attribute>
+</saml:AttributeStatement>
+</saml:Assertion>
+</samlp:Response>`,
+		uuid.New().String(), ts(now), inResponseTo, redirectURI,
+		uuid.New().String(), ts(now),
+		username,
+		inResponseTo, ts(now.Add(5*time.Minute)), redirectURI,
+		ts(now.Add(-time.Minute)), ts(now.Add(5*time.Minute)),
+		testIdpAudience,
+		username, username, groupValues.String())
+
+	kp, err := tls.LoadX509KeyPair("testdata/idp.crt", "testdata/idp.key")
+	if err != nil {
+		panic(err)
+	}
+	xml := etree.NewDocument()
+	if err := xml.ReadFromString(doc); err != nil {
+		panic(err)
+	}
+	ctx := dsig.NewDefaultSigningContext(&testKeyStore{key: kp.PrivateKey.(*rsa.PrivateKey), cert: kp.Certificate[0]})
+	if err := ctx.SetSignatureMethod(dsig.RSASHA256SignatureMethod); err != nil {
+		panic(err)
+	}
+	signed, err := ctx.SignEnveloped(xml.Root())
+	if err != nil {
+		panic(err)
+	}
+	xml.SetRoot(signed)
+	b, err := xml.WriteToBytes()
+	if err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func statusOfErr(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	return statusOf(err)
+}
+
+func TestEngine_Approvals(t *testing.T) {
+	e := newTestEngine()
+	idpNonce := uuid.New().String()
+	created, err := e.Create(testCreateRequest(idpNonce))
+	assert.NoError(t, err)
+	assert.Equal(t, testBaseURL+"/workflow/"+created.WorkflowId, created.WorkflowUrl)
+	id := created.WorkflowId
+
+	getAssertions := func() *workflow.GetAssertionsResponse {
+		resp, err := e.GetAssertions(context.Background(), &workflow.GetAssertionsRequest{WorkflowId: id, WorkflowNonce: created.WorkflowNonce})
+		assert.NoError(t, err)
+		return resp
+	}
+	assert.Equal(t, workflow.StatusCreated, getAssertions().Status)
+
+	wf, err := e.HandleResponse(samlResponse(idpNonce, "alice", "security"), id+"/approve")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"platform": 1}, wf.MissingApprovals())
+
+	// Approving twice counts once
+	wf, err = e.HandleResponse(samlResponse(idpNonce, "alice", "security"), id+"/approve")
+	assert.NoError(t, err)
+	assert.Len(t, wf.Approvals, 1)
+
+	// Not an approver, the requester, or a response to another nonce
+	_, err = e.HandleResponse(samlResponse(idpNonce, "eve", "everyone"), id+"/approve")
+	assert.Equal(t, http.StatusForbidden, statusOfErr(err))
+	_, err = e.HandleResponse(samlResponse(idpNonce, "dave", "platform"), id+"/approve")
+	assert.Equal(t, http.StatusForbidden, statusOfErr(err))
+	_, err = e.HandleResponse(samlResponse("another-nonce", "carol", "platform"), id+"/approve")
+	assert.Equal(t, http.StatusForbidden, statusOfErr(err))
+	resp := getAssertions()
+	assert.Equal(t, workflow.StatusCreated, resp.Status)
+	assert.Empty(t, resp.Assertions)
+
+	wf, err = e.HandleResponse(samlResponse(idpNonce, "carol", "platform"), id+"/approve")
+	assert.NoError(t, err)
+	assert.Empty(t, wf.MissingApprovals())
+
+	// The requester can't approve, so they have to say who they are
+	// before the issuing server will accept the approvals
+	assert.Equal(t, workflow.StatusCreated, wf.Status)
+	wf, err = e.HandleResponse(samlResponse("identify-"+idpNonce, "dave", "everyone"), id+"/identify")
+	assert.NoError(t, err)
+	assert.Equal(t, workflow.StatusCompleted, wf.Status)
+	resp = getAssertions()
+	assert.Equal(t, workflow.StatusCompleted, resp.Status)
+	assert.Len(t, resp.Assertions, 2)
+	assert.NotEmpty(t, resp.IdentifyAssertion)
+
+	// Completed workflows can't be changed
+	_, err = e.HandleResponse(samlResponse(idpNonce, "bob", "security"), id+"/reject")
+	assert.Equal(t, http.StatusConflict, statusOfErr(err))
+
+	_, err = e.GetAssertions(context.Background(), &workflow.GetAssertionsRequest{WorkflowId: id, WorkflowNonce: "wrong"})
+	assert.Equal(t, http.StatusForbidden, statusOfErr(err))
+	_, err = e.GetAssertions(context.Background(), &workflow.GetAssertionsRequest{WorkflowId: "unknown", WorkflowNonce: "wrong"})
+	assert.Equal(t, http.StatusNotFound, statusOfErr(err))
+}
+
+func TestEngine_Reject(t *testing.T) {
+	e := newTestEngine()
+	idpNonce := uuid.New().String()
+	created, err := e.Create(testCreateRequest(idpNonce))
+	assert.NoError(t, err)
+
+	_, err = e.HandleResponse(samlResponse(idpNonce, "eve", "everyone"), created.WorkflowId+"/reject")
+	assert.Equal(t, http.StatusForbidden, statusOfErr(err))
+	wf, err := e.HandleResponse(samlResponse(idpNonce, "bob", "security"), created.WorkflowId+"/reject")
+	assert.NoError(t, err)
+	assert.Equal(t, workflow.StatusRejected, wf.Status)
+	assert.Equal(t, "bob", wf.Rejection.Username)
+
+	resp, err := e.GetAssertions(context.Background(), &workflow.GetAssertionsRequest{WorkflowId: created.WorkflowId, WorkflowNonce: created.WorkflowNonce})
+	assert.NoError(t, err)
+	assert.Equal(t, workflow.StatusRejected, resp.Status)
+	assert.Empty(t, resp.Assertions)
+}
+
+func TestEngine_Identify(t *testing.T) {
+	e := newTestEngine()
+	idpNonce := uuid.New().String()
+	req := testCreateRequest(idpNonce)
+	req.Policy.ApproverRoles = map[string]int{"security": 1}
+	req.Policy.IdentifyRoles = map[string]int{"developers": 1}
+	req.IdentifyNonce = ""
+	_, err := e.Create(req)
+	assert.Equal(t, http.StatusBadRequest, statusOfErr(err))
+	req.IdentifyNonce = idpNonce
+	_, err = e.Create(req)
+	assert.Equal(t, http.StatusBadRequest, statusOfErr(err))
+	identifyNonce := uuid.New().String()
+	req.IdentifyNonce = identifyNonce
+	created, err := e.Create(req)
+	assert.NoError(t, err)
+	id := created.WorkflowId
+
+	// Identification logins answer the identify nonce
+	_, samlRequest, _, err := e.LoginRequest(id, ActionIdentify, "")
+	assert.NoError(t, err)
+	request, err := base64.StdEncoding.DecodeString(samlRequest)
+	assert.NoError(t, err)
+	assert.Contains(t, string(request), `ID="`+identifyNonce+`"`)
+	_, err = e.HandleResponse(samlResponse(idpNonce, "dave", "developers"), id+"/identify")
+	assert.Equal(t, http.StatusForbidden, statusOfErr(err))
+	_, err = e.HandleResponse(samlResponse(identifyNonce, "alice", "security"), id+"/approve")
+	assert.Equal(t, http.StatusForbidden, statusOfErr(err))
+
+	// The requester can't approve, identified or not
+	_, err = e.HandleResponse(samlResponse(idpNonce, "dave", "developers", "security"), id+"/approve")
+	assert.Equal(t, http.StatusForbidden, statusOfErr(err))
+	_, err = e.HandleResponse(samlResponse(identifyNonce, "eve", "everyone"), id+"/identify")
+	assert.Equal(t, http.StatusForbidden, statusOfErr(err))
+	// Only the requester can identify, whatever their groups
+	_, err = e.HandleResponse(samlResponse(identifyNonce, "carol", "developers"), id+"/identify")
+	assert.Equal(t, http.StatusForbidden, statusOfErr(err))
+	wf, err := e.HandleResponse(samlResponse(identifyNonce, "dave", "developers"), id+"/identify")
+	assert.NoError(t, err)
+	assert.Empty(t, wf.Approvals)
+	assert.Equal(t, workflow.StatusCreated, wf.Status)
+
+	wf, err = e.HandleResponse(samlResponse(idpNonce, "alice", "security"), id+"/approve")
+	assert.NoError(t, err)
+	assert.Equal(t, workflow.StatusCompleted, wf.Status)
+	resp, err := e.GetAssertions(context.Background(), &workflow.GetAssertionsRequest{WorkflowId: id, WorkflowNonce: created.WorkflowNonce})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Assertions, 1)
+	assert.NotEmpty(t, resp.IdentifyAssertion)
+}
+
+func TestEngine_LongPoll(t *testing.T) {
+	e := newTestEngine()
+	idpNonce := uuid.New().String()
+	req := testCreateRequest(idpNonce)
+	req.Policy.ApproverRoles = map[string]int{"security": 1}
+	req.Policy.RequesterCanApprove = true
+	created, err := e.Create(req)
+	assert.NoError(t, err)
+	getReq := &workflow.GetAssertionsRequest{
+		WorkflowId:    created.WorkflowId,
+		WorkflowNonce: created.WorkflowNonce,
+		WaitSeconds:   workflow.MaxWaitSeconds,
+	}
+
+	// Times out with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	resp, err := e.GetAssertions(ctx, getReq)
+	assert.NoError(t, err)
+	assert.Equal(t, workflow.StatusCreated, resp.Status)
+	assert.True(t, resp.LongPoll)
+
+	// Returns as soon as the workflow changes
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, err := e.HandleResponse(samlResponse(idpNonce, "alice", "security"), created.WorkflowId+"/approve")
+		assert.NoError(t, err)
+	}()
+	start := time.Now()
+	resp, err = e.GetAssertions(context.Background(), getReq)
+	assert.NoError(t, err)
+	assert.Equal(t, workflow.StatusCompleted, resp.Status)
+	assert.Len(t, resp.Assertions, 1)
+	assert.True(t, time.Since(start) < workflow.MaxWaitSeconds*time.Second)
+}
+
+func TestEngine_Create(t *testing.T) {
+	e := newTestEngine()
+	req := testCreateRequest("")
+	_, err := e.Create(req)
+	assert.Equal(t, http.StatusBadRequest, statusOfErr(err))
+	req = testCreateRequest("nonce")
+	req.Policy.IdpName = "prod"
+	_, err = e.Create(req)
+	assert.Equal(t, http.StatusBadRequest, statusOfErr(err))
+	req = testCreateRequest("nonce")
+	req.Policy.ApproverRoles = nil
+	_, err = e.Create(req)
+	assert.Equal(t, http.StatusBadRequest, statusOfErr(err))
+}
+
+func TestEngine_LoginRequest(t *testing.T) {
+	e := newTestEngine()
+	req := testCreateRequest("the-idp-nonce")
+	req.Policy.RequesterCanApprove = true
+	created, err := e.Create(req)
+	assert.NoError(t, err)
+
+	ssoURL, samlRequest, relayState, err := e.LoginRequest(created.WorkflowId, ActionApprove, "")
+	assert.NoError(t, err)
+	assert.Equal(t, testIdpSSOURL, ssoURL)
+	assert.Equal(t, created.WorkflowId+"/approve", relayState)
+	request, err := base64.StdEncoding.DecodeString(samlRequest)
+	assert.NoError(t, err)
+	assert.Contains(t, string(request), `ID="the-idp-nonce"`)
+	assert.Contains(t, string(request), `AssertionConsumerServiceURL="`+testBaseURL+ApprovePath+`"`)
+
+	_, _, _, err = e.LoginRequest(created.WorkflowId, ActionIdentify, "")
+	assert.Equal(t, http.StatusBadRequest, statusOfErr(err))
+	_, _, _, err = e.LoginRequest(created.WorkflowId, "delete", "")
+	assert.Equal(t, http.StatusNotFound, statusOfErr(err))
+}
+
+func TestEngine_GetDetails(t *testing.T) {
+	e := newTestEngine()
+	clock := clockwork.NewFakeClockAt(time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC))
+	e.Clock = clock
+	idpNonce := uuid.New().String()
+	req := testCreateRequest(idpNonce)
+	req.Policy.ApproverRoles = map[string]int{"security": 1, "platform": 1}
+	created, err := e.Create(req)
+	assert.NoError(t, err)
+	id := created.WorkflowId
+	getDetails := func() *workflow.GetDetailsResponse {
+		resp, err := e.GetDetails(&workflow.GetDetailsRequest{WorkflowId: id, WorkflowNonce: created.WorkflowNonce})
+		assert.NoError(t, err)
+		return resp
+	}
+
+	details := getDetails()
+	assert.Equal(t, workflow.StatusCreated, details.Status)
+	assert.Equal(t, req.Requester, details.Requester)
+	assert.Equal(t, req.Source, details.Source)
+	assert.Equal(t, req.Target, details.Target)
+	assert.Empty(t, details.Approvals)
+	assert.Equal(t, map[string]int{"security": 1, "platform": 1}, details.MissingApprovals)
+	assert.Equal(t, clock.Now().Add(time.Hour), details.ExpiresAt)
+
+	clock.Advance(time.Minute)
+	_, err = e.HandleResponse(samlResponse(idpNonce, "carol", "security"), id+"/approve")
+	assert.NoError(t, err)
+	details = getDetails()
+	assert.Equal(t, "waiting on 1 more approval from platform and the requester to identify themselves", details.WaitingOn())
+
+	// alice is in both groups, and counts towards the one still missing
+	_, _, relayState, err := e.LoginRequest(id, ActionApprove, "Looks fine")
+	assert.NoError(t, err)
+	_, err = e.HandleResponse(samlResponse(idpNonce, "alice", "security", "platform"), relayState)
+	assert.NoError(t, err)
+	details = getDetails()
+	assert.Equal(t, workflow.StatusCreated, details.Status)
+	assert.Empty(t, details.MissingApprovals)
+	assert.Equal(t, "waiting on the requester to identify themselves", details.WaitingOn())
+	_, err = e.HandleResponse(samlResponse("identify-"+idpNonce, "dave"), id+"/identify")
+	assert.NoError(t, err)
+	details = getDetails()
+	assert.Equal(t, workflow.StatusCompleted, details.Status)
+	assert.False(t, details.MissingIdentification)
+	assert.Equal(t, []workflow.Approval{
+		{Username: "carol", Email: "carol@example.com", Group: "security", ApprovedAt: clock.Now()},
+		{Username: "alice", Email: "alice@example.com", Group: "platform", Comment: "Looks fine", ApprovedAt: clock.Now()},
+	}, details.Approvals)
+
+	_, err = e.GetDetails(&workflow.GetDetailsRequest{WorkflowId: id, WorkflowNonce: "wrong"})
+	assert.Equal(t, http.StatusForbidden, statusOfErr(err))
+}
+
+func TestEngine_RejectReason(t *testing.T) {
+	e := newTestEngine()
+	idpNonce := uuid.New().String()
+	created, err := e.Create(testCreateRequest(idpNonce))
+	assert.NoError(t, err)
+	id := created.WorkflowId
+
+	_, _, _, err = e.LoginRequest(id, ActionReject, strings.Repeat("x", maxCommentLength+1))
+	assert.Equal(t, http.StatusBadRequest, statusOfErr(err))
+	_, _, relayState, err := e.LoginRequest(id, ActionReject, "Not during the freeze")
+	assert.NoError(t, err)
+	assert.True(t, len(relayState) <= 80)
+	// Someone else's login doesn't get the comment
+	_, err = e.HandleResponse(samlResponse(idpNonce, "eve", "everyone"), relayState)
+	assert.Equal(t, http.StatusForbidden, statusOfErr(err))
+	wf, err := e.HandleResponse(samlResponse(idpNonce, "bob", "security"), relayState)
+	assert.NoError(t, err)
+	assert.Empty(t, wf.PendingComments)
+
+	details, err := e.GetDetails(&workflow.GetDetailsRequest{WorkflowId: id, WorkflowNonce: created.WorkflowNonce})
+	assert.NoError(t, err)
+	assert.Equal(t, workflow.StatusRejected, details.Status)
+	assert.Equal(t, "bob", details.Rejection.Username)
+	assert.Equal(t, "Not during the freeze", details.Rejection.Reason)
+	assert.Empty(t, details.MissingApprovals)
+}
+
+func TestEngine_Expiry(t *testing.T) {
+	e := newTestEngine()
+	clock := clockwork.NewFakeClock()
+	e.Clock = clock
+	idpNonce := uuid.New().String()
+	created, err := e.Create(testCreateRequest(idpNonce))
+	assert.NoError(t, err)
+
+	clock.Advance(time.Duration(DefaultWorkflowValidForSeconds) * time.Second)
+	_, _, _, err = e.LoginRequest(created.WorkflowId, ActionApprove, "")
+	assert.Equal(t, http.StatusConflict, statusOfErr(err))
+	_, err = e.HandleResponse(samlResponse(idpNonce, "alice", "security"), created.WorkflowId+"/approve")
+	assert.Equal(t, http.StatusConflict, statusOfErr(err))
+	resp, err := e.GetAssertions(context.Background(), &workflow.GetAssertionsRequest{
+		WorkflowId:    created.WorkflowId,
+		WorkflowNonce: created.WorkflowNonce,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, workflow.StatusExpired, resp.Status)
+
+	// The requester and the policy can both ask for less time
+	for _, test := range []struct {
+		requested, policy int
+		want              time.Duration
+	}{
+		{0, 0, time.Duration(DefaultWorkflowValidForSeconds) * time.Second},
+		{600, 0, 10 * time.Minute},
+		{600, 300, 5 * time.Minute},
+		{7200, 0, time.Duration(DefaultWorkflowValidForSeconds) * time.Second},
+	} {
+		req := testCreateRequest(uuid.New().String())
+		req.ExpiresInSeconds = test.requested
+		req.Policy.MaxApprovalAgeSeconds = test.policy
+		created, err := e.Create(req)
+		assert.NoError(t, err)
+		details, err := e.GetDetails(&workflow.GetDetailsRequest{WorkflowId: created.WorkflowId, WorkflowNonce: created.WorkflowNonce})
+		assert.NoError(t, err)
+		assert.Equal(t, test.want, details.ExpiresAt.Sub(clock.Now()))
+	}
+}
+
+func TestEngine_Cancel(t *testing.T) {
+	e := newTestEngine()
+	clock := clockwork.NewFakeClock()
+	e.Clock = clock
+	idpNonce := uuid.New().String()
+	created, err := e.Create(testCreateRequest(idpNonce))
+	assert.NoError(t, err)
+	cancelReq := &workflow.CancelRequest{WorkflowId: created.WorkflowId, WorkflowNonce: created.WorkflowNonce}
+
+	_, err = e.Cancel(&workflow.CancelRequest{WorkflowId: created.WorkflowId, WorkflowNonce: "wrong"})
+	assert.Equal(t, http.StatusForbidden, statusOfErr(err))
+	_, err = e.Cancel(&workflow.CancelRequest{WorkflowId: "unknown", WorkflowNonce: created.WorkflowNonce})
+	assert.Equal(t, http.StatusNotFound, statusOfErr(err))
+
+	resp, err := e.Cancel(cancelReq)
+	assert.NoError(t, err)
+	assert.Equal(t, workflow.StatusCancelled, resp.Status)
+	_, err = e.HandleResponse(samlResponse(idpNonce, "alice", "security"), created.WorkflowId+"/approve")
+	assert.Equal(t, http.StatusConflict, statusOfErr(err))
+	// Cancelling again is fine
+	resp, err = e.Cancel(cancelReq)
+	assert.NoError(t, err)
+	assert.Equal(t, workflow.StatusCancelled, resp.Status)
+
+	// As is cancelling an expired workflow, which stays expired
+	created, err = e.Create(testCreateRequest(uuid.New().String()))
+	assert.NoError(t, err)
+	clock.Advance(time.Duration(DefaultWorkflowValidForSeconds) * time.Second)
+	resp, err = e.Cancel(&workflow.CancelRequest{WorkflowId: created.WorkflowId, WorkflowNonce: created.WorkflowNonce})
+	assert.NoError(t, err)
+	assert.Equal(t, workflow.StatusExpired, resp.Status)
+}
+
+func TestEngine_SignedPolicy(t *testing.T) {
+	config := testConfig()
+	config.PolicyIssuers = []PolicyIssuerConfig{{Name: "nonprod", PublicKey: "file://testdata/idp.crt"}}
+	config.PolicyDecryptionKey = "file://testdata/idp.key"
+	e := &Engine{}
+	assert.NoError(t, e.Init(config))
+	signer, err := workflow.NewPolicySigner(&api.WorkflowPolicySigningConfig{
+		SigningKey:    "file://testdata/idp.key",
+		EncryptionKey: "file://testdata/idp.crt",
+	})
+	assert.NoError(t, err)
+	signedPolicy := func(idpNonce string, issuer string) string {
+		now := time.Now()
+		signed, err := signer.Sign(&workflow.PolicyClaims{
+			Policy: workflow.Policy{
+				Name:          "deploy_with_approval",
+				IdpName:       "nonprod",
+				ApproverRoles: map[string]int{"security": 2},
+			},
+			Role:              "deployment",
+			IdpNonce:          idpNonce,
+			IdentifyNonce:     "identify-" + idpNonce,
+			RequesterUsername: "dave",
+			RequesterEmail:    "dave@example.com",
+			StandardClaims: jwt.StandardClaims{
+				Issuer:    issuer,
+				Audience:  testBaseURL,
+				IssuedAt:  now.Unix(),
+				ExpiresAt: now.Add(time.Hour).Unix(),
+			},
+		})
+		assert.NoError(t, err)
+		return signed
+	}
+
+	// The signed policy is used, not the one the client sent
+	req := testCreateRequest("nonce-1")
+	req.SignedPolicy = signedPolicy("nonce-1", "nonprod")
+	created, err := e.Create(req)
+	assert.NoError(t, err)
+	wf, err := e.Store.Get(created.WorkflowId)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"security": 2}, wf.Policy.ApproverRoles)
+
+	req = testCreateRequest("nonce-2")
+	_, err = e.Create(req)
+	assert.Equal(t, http.StatusBadRequest, statusOfErr(err))
+	req.SignedPolicy = signedPolicy("nonce-1", "nonprod")
+	_, err = e.Create(req)
+	assert.Equal(t, http.StatusForbidden, statusOfErr(err))
+	req.SignedPolicy = signedPolicy("nonce-2", "prod")
+	_, err = e.Create(req)
+	assert.Equal(t, http.StatusForbidden, statusOfErr(err))
+	req.SignedPolicy = signedPolicy("nonce-2", "nonprod")
+	req.IdentifyNonce = "another-identify-nonce"
+	_, err = e.Create(req)
+	assert.Equal(t, http.StatusForbidden, statusOfErr(err))
+	req = testCreateRequest("nonce-2")
+	req.SignedPolicy = signedPolicy("nonce-2", "nonprod")
+	req.Requester.Username = "eve"
+	_, err = e.Create(req)
+	assert.Equal(t, http.StatusForbidden, statusOfErr(err))
+	req.SignedPolicy = "garbage"
+	_, err = e.Create(req)
+	assert.Equal(t, http.StatusForbidden, statusOfErr(err))
+
+	config = testConfig()
+	config.PolicyDecryptionKey = "file://testdata/idp.key"
+	assert.Error(t, (&Engine{}).Init(config))
+}
+
+func TestEngine_Init(t *testing.T) {
+	config := testConfig()
+	config.Idp[0].Config.(*api.IdpConfigSaml).RedirectURI = "https://elsewhere.example.com/1/saml/approve"
+	assert.Error(t, (&Engine{}).Init(config))
+
+	config = testConfig()
+	config.Idp[0].Config.(*api.IdpConfigSaml).SSOURL = ""
+	assert.Error(t, (&Engine{}).Init(config))
+
+	config = testConfig()
+	config.BaseURL = ""
+	assert.Error(t, (&Engine{}).Init(config))
+
+	// Unsigned policies have to be asked for
+	config = testConfig()
+	config.InsecureUnsignedPolicies = false
+	assert.EqualError(t, (&Engine{}).Init(config), "policy_issuers are required, unless insecure_unsigned_policies is set")
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workflow")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "workflows.json")
+
+	clock := clockwork.NewFakeClock()
+	s := NewFileStore(path)
+	s.Clock = clock
+	expiresAt := clock.Now().Add(time.Hour)
+	assert.NoError(t, s.Create(&Workflow{ID: "a", Status: workflow.StatusCreated, ExpiresAt: expiresAt}))
+	assert.Error(t, s.Create(&Workflow{ID: "a"}))
+	_, err = s.Update("a", func(wf *Workflow) error {
+		wf.Status = workflow.StatusCompleted
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// A fresh store sees the first one's workflows
+	s2 := NewFileStore(path)
+	wf, err := s2.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, workflow.StatusCompleted, wf.Status)
+	_, err = s2.Get("b")
+	assert.Equal(t, ErrNotFound, err)
+
+	// Failed updates are not saved
+	_, err = s2.Update("a", func(wf *Workflow) error {
+		wf.Status = workflow.StatusRejected
+		return errorf(http.StatusConflict, "no")
+	})
+	assert.Error(t, err)
+	wf, err = s.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, workflow.StatusCompleted, wf.Status)
+
+	// Workflows are dropped once they have been expired for Retain
+	clock.Advance(time.Hour + s.Retain)
+	assert.NoError(t, s.Create(&Workflow{ID: "b", ExpiresAt: clock.Now().Add(time.Hour)}))
+	_, err = s.Get("a")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = NewFileStore(path).Get("a")
+	assert.Equal(t, ErrNotFound, err)
+
+	// SAML responses are kept only while they can be collected
+	approvals := []Approval{{Username: "alice", Assertion: "<samlp:Response/>"}}
+	assert.NoError(t, s.Create(&Workflow{ID: "c", ExpiresAt: clock.Now().Add(time.Hour), Approvals: approvals}))
+	wf, err = s.Get("c")
+	assert.NoError(t, err)
+	assert.Equal(t, "<samlp:Response/>", wf.Approvals[0].Assertion)
+	_, err = s.Update("c", func(wf *Workflow) error {
+		wf.Status = workflow.StatusRejected
+		return nil
+	})
+	assert.NoError(t, err)
+	for _, store := range []*MemoryStore{s, NewFileStore(path)} {
+		wf, err = store.Get("c")
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", wf.Approvals[0].Username)
+		assert.Empty(t, wf.Approvals[0].Assertion)
+	}
+
+	// Updates which can't be saved don't change the store
+	assert.NoError(t, os.RemoveAll(dir))
+	_, err = s.Update("b", func(wf *Workflow) error {
+		wf.Status = workflow.StatusCancelled
+		return nil
+	})
+	assert.Error(t, err)
+	wf, err = s.Get("b")
+	assert.NoError(t, err)
+	assert.Equal(t, "", wf.Status)
+}
@@ -0,0 +1,291 @@
+package engine
+
+import (
+	"encoding/json"
+	"github.com/bsycorp/keymaster/km/util"
+	"github.com/bsycorp/keymaster/km/workflow"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// NewHandler serves the workflow API (as used by workflow.Client), the
+// approval pages and the SAML ACS endpoint.
+func NewHandler(e *Engine) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/1/workflow/create", func(w http.ResponseWriter, r *http.Request) {
+		var req workflow.CreateRequest
+		serveAPI(w, r, &req, func() (interface{}, error) { return e.Create(&req) })
+	})
+	mux.HandleFunc("/1/workflow/getAssertions", func(w http.ResponseWriter, r *http.Request) {
+		var req workflow.GetAssertionsRequest
+		serveAPI(w, r, &req, func() (interface{}, error) { return e.GetAssertions(r.Context(), &req) })
+	})
+	mux.HandleFunc("/1/workflow/cancel", func(w http.ResponseWriter, r *http.Request) {
+		var req workflow.CancelRequest
+		serveAPI(w, r, &req, func() (interface{}, error) { return e.Cancel(&req) })
+	})
+	mux.HandleFunc("/1/workflow/getDetails", func(w http.ResponseWriter, r *http.Request) {
+		var req workflow.GetDetailsRequest
+		serveAPI(w, r, &req, func() (interface{}, error) { return e.GetDetails(&req) })
+	})
+	mux.HandleFunc(ApprovePath, func(w http.ResponseWriter, r *http.Request) {
+		serveApprove(e, w, r)
+	})
+	mux.HandleFunc("/workflow/", func(w http.ResponseWriter, r *http.Request) {
+		serveWorkflow(e, w, r)
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+func serveAPI(w http.ResponseWriter, r *http.Request, req interface{}, handle func() (interface{}, error)) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, errorf(http.StatusMethodNotAllowed, "method not allowed: %s", r.Method))
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, util.MaxRequestBytes))
+	if err != nil {
+		writeJSONError(w, errorf(http.StatusBadRequest, "error reading request: %s", err))
+		return
+	}
+	if err := json.Unmarshal(body, req); err != nil {
+		writeJSONError(w, errorf(http.StatusBadRequest, "invalid request: %s", err))
+		return
+	}
+	resp, err := handle()
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func statusOf(err error) int {
+	var engineErr *Error
+	if errors.As(err, &engineErr) {
+		return engineErr.Status
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSONError(w http.ResponseWriter, err error) {
+	status := statusOf(err)
+	if status == http.StatusInternalServerError {
+		log.Println("Error:", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// serveWorkflow serves /workflow/<id>, the page approvers are sent to,
+// and /workflow/<id>/<action>, which asks approvers for a comment then
+// starts a login to the IDP.
+func serveWorkflow(e *Engine, w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/workflow/"), "/")
+	if r.Method != http.MethodGet && !(r.Method == http.MethodPost && len(parts) == 2) {
+		writePage(w, http.StatusMethodNotAllowed, messageTemplate, "Method not allowed")
+		return
+	}
+	switch len(parts) {
+	case 1:
+		wf, err := e.Store.Get(parts[0])
+		if err == ErrNotFound {
+			writePage(w, http.StatusNotFound, messageTemplate, "Workflow not found")
+			return
+		} else if err != nil {
+			writePageError(w, err)
+			return
+		}
+		e.expire(wf)
+		writePage(w, http.StatusOK, workflowTemplate, workflowPage{
+			Workflow: wf,
+			URL:      e.WorkflowURL(wf.ID),
+			Missing:  wf.MissingApprovals(),
+		})
+	case 2:
+		id, action := parts[0], parts[1]
+		// Logins start with a POST from the confirmation page, so a
+		// link can't sign someone in without them knowing why
+		if r.Method == http.MethodGet {
+			serveCommentForm(e, w, id, action)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, util.MaxRequestBytes)
+		if err := r.ParseForm(); err != nil {
+			writePage(w, http.StatusBadRequest, messageTemplate, "Invalid form")
+			return
+		}
+		comment := strings.TrimSpace(r.PostForm.Get("comment"))
+		if action == ActionIdentify && comment != "" {
+			writePage(w, http.StatusBadRequest, messageTemplate, "Identification takes no comment")
+			return
+		}
+		ssoURL, samlRequest, relayState, err := e.LoginRequest(id, action, comment)
+		if err != nil {
+			writePageError(w, err)
+			return
+		}
+		writePage(w, http.StatusOK, loginTemplate, loginPage{
+			SSOURL:      ssoURL,
+			SAMLRequest: samlRequest,
+			RelayState:  relayState,
+		})
+	default:
+		writePage(w, http.StatusNotFound, messageTemplate, "Not found")
+	}
+}
+
+func serveCommentForm(e *Engine, w http.ResponseWriter, id string, action string) {
+	wf, err := e.Store.Get(id)
+	if err == ErrNotFound {
+		writePage(w, http.StatusNotFound, messageTemplate, "Workflow not found")
+		return
+	} else if err != nil {
+		writePageError(w, err)
+		return
+	}
+	if err := e.checkAction(wf, action); err != nil {
+		writePageError(w, err)
+		return
+	}
+	writePage(w, http.StatusOK, commentTemplate, commentPage{
+		Workflow:         wf,
+		Action:           action,
+		MaxCommentLength: maxCommentLength,
+	})
+}
+
+// serveApprove is the SAML assertion consumer service
+func serveApprove(e *Engine, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writePage(w, http.StatusMethodNotAllowed, messageTemplate, "Method not allowed")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, util.MaxRequestBytes)
+	if err := r.ParseForm(); err != nil {
+		writePage(w, http.StatusBadRequest, messageTemplate, "Invalid form")
+		return
+	}
+	wf, err := e.HandleResponse(r.PostForm.Get("SAMLResponse"), r.PostForm.Get("RelayState"))
+	if err != nil {
+		writePageError(w, err)
+		return
+	}
+	http.Redirect(w, r, e.WorkflowURL(wf.ID), http.StatusSeeOther)
+}
+
+func writePageError(w http.ResponseWriter, err error) {
+	status := statusOf(err)
+	message := err.Error()
+	if status == http.StatusInternalServerError {
+		log.Println("Error:", err)
+		message = "Internal error"
+	}
+	writePage(w, status, messageTemplate, message)
+}
+
+func writePage(w http.ResponseWriter, status int, t *template.Template, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := t.Execute(w, data); err != nil {
+		log.Println("Error rendering page:", err)
+	}
+}
+
+type workflowPage struct {
+	Workflow *Workflow
+	URL      string
+	Missing  map[string]int
+}
+
+type commentPage struct {
+	Workflow         *Workflow
+	Action           string
+	MaxCommentLength int
+}
+
+type loginPage struct {
+	SSOURL      string
+	SAMLRequest string
+	RelayState  string
+}
+
+const pageHeader = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Keymaster workflow</title></head><body>
+`
+
+const pageFooter = `</body></html>
+`
+
+var messageTemplate = template.Must(template.New("message").Parse(pageHeader + `<p>{{.}}</p>
+` + pageFooter))
+
+var workflowTemplate = template.Must(template.New("workflow").Parse(pageHeader + `{{with .Workflow}}
+<h1>Access request: {{.Target.EnvironmentName}}</h1>
+<p>Status: <strong>{{.Status}}</strong></p>
+<table>
+<tr><th>Requester</th><td>{{.Requester.Name}} ({{.Requester.Username}}, {{.Requester.Email}})
+{{- with .Identity}}, identified as {{.Username}}{{end}}</td></tr>
+<tr><th>Description</th><td>{{.Source.Description}}</td></tr>
+<tr><th>Details</th><td><a href="{{.Source.DetailsURI}}">{{.Source.DetailsURI}}</a></td></tr>
+<tr><th>Policy</th><td>{{.Policy.Name}}</td></tr>
+<tr><th>Requested</th><td>{{.CreatedAt.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><th>Expires</th><td>{{.ExpiresAt.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+</table>
+<h2>Approvals</h2>
+<ul>
+{{- range .Approvals}}
+<li>{{.Username}} at {{.At.Format "2006-01-02 15:04:05 MST"}}{{with .Comment}}: {{.}}{{end}}</li>
+{{- else}}
+<li>None yet</li>
+{{- end}}
+</ul>
+{{- with .Rejection}}
+<p>Rejected by {{.Username}} at {{.At.Format "2006-01-02 15:04:05 MST"}}{{with .Comment}}: {{.}}{{end}}</p>
+{{- end}}
+{{- if eq .Status "CREATED"}}
+{{- if $.Missing}}
+<p>Waiting on:{{range $group, $n := $.Missing}} {{$n}} from {{$group}};{{end}}</p>
+{{- end}}
+<p>
+<a href="{{$.URL}}/approve">Approve</a> |
+<a href="{{$.URL}}/reject">Reject</a>
+{{- if .Policy.RequiresIdentification}} | <a href="{{$.URL}}/identify">Identify yourself (requester)</a>{{end}}
+</p>
+{{- end}}
+{{end}}
+` + pageFooter))
+
+var commentTemplate = template.Must(template.New("comment").Parse(pageHeader + `{{if eq .Action "identify"}}<h1>Identify yourself for access request: {{.Workflow.Target.EnvironmentName}}</h1>
+<p>{{.Workflow.Source.Description}}</p>
+<p>Only continue if you are {{.Workflow.Requester.Name}} ({{.Workflow.Requester.Username}}) and you started this request.</p>
+<form method="post">
+<p><input type="submit" value="Continue to login"></p>
+</form>
+{{- else}}<h1>{{if eq .Action "reject"}}Reject{{else}}Approve{{end}} access request: {{.Workflow.Target.EnvironmentName}}</h1>
+<p>{{.Workflow.Source.Description}}</p>
+<form method="post">
+<p><label for="comment">{{if eq .Action "reject"}}Reason{{else}}Comment{{end}} (optional)</label><br>
+<textarea id="comment" name="comment" rows="4" cols="60" maxlength="{{.MaxCommentLength}}"></textarea></p>
+<p><input type="submit" value="Continue to login"></p>
+</form>
+{{- end}}
+` + pageFooter))
+
+// Posts the AuthnRequest to the IDP (the SAML HTTP-POST binding)
+var loginTemplate = template.Must(template.New("login").Parse(pageHeader + `<form method="post" action="{{.SSOURL}}">
+<input type="hidden" name="SAMLRequest" value="{{.SAMLRequest}}">
+<input type="hidden" name="RelayState" value="{{.RelayState}}">
+<noscript><input type="submit" value="Continue to login"></noscript>
+</form>
+<script>document.forms[0].submit();</script>
+` + pageFooter))
@@ -0,0 +1,129 @@
+package engine
+
+import (
+	"context"
+	"github.com/bsycorp/keymaster/km/workflow"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	e := newTestEngine()
+	ts := httptest.NewServer(NewHandler(e))
+	defer ts.Close()
+	client, err := workflow.NewClient(ts.URL)
+	assert.NoError(t, err)
+
+	idpNonce := uuid.New().String()
+	created, err := client.Create(context.Background(), testCreateRequest(idpNonce))
+	assert.NoError(t, err)
+	id := created.WorkflowId
+
+	// The approval page, and the login form it links to
+	page := func(path string) (int, string) {
+		resp, err := http.Get(ts.URL + path)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	status, body := page("/workflow/" + id)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "Deploy version 3.2")
+	assert.Contains(t, body, testBaseURL+"/workflow/"+id+"/approve")
+	assert.Contains(t, body, testBaseURL+"/workflow/"+id+"/identify")
+	status, body = page("/workflow/" + id + "/approve")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `name="comment"`)
+	// Identification is confirmed by a POST, not started by the link
+	status, body = page("/workflow/" + id + "/identify")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `<form method="post">`)
+	assert.Contains(t, body, "Only continue if you are Dave (dave)")
+	assert.NotContains(t, body, "SAMLRequest")
+	assert.NotContains(t, body, `name="comment"`)
+	resp, err := http.PostForm(ts.URL+"/workflow/"+id+"/identify", url.Values{})
+	assert.NoError(t, err)
+	body = readBody(resp)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `name="RelayState" value="`+id+`/identify"`)
+	status, _ = page("/workflow/" + id + "/delete")
+	assert.Equal(t, http.StatusNotFound, status)
+	resp, err = http.PostForm(ts.URL+"/workflow/"+id+"/approve", url.Values{"comment": {""}})
+	assert.NoError(t, err)
+	body = readBody(resp)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `action="`+testIdpSSOURL+`"`)
+	assert.Contains(t, body, `name="RelayState" value="`+id+`/approve"`)
+	status, _ = page("/workflow/unknown")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// The IDP posts approvals back to the ACS, which redirects to the page
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	for _, login := range []struct{ nonce, name, group, action string }{
+		{idpNonce, "alice", "security", ActionApprove},
+		{idpNonce, "carol", "platform", ActionApprove},
+		{"identify-" + idpNonce, "dave", "everyone", ActionIdentify},
+	} {
+		resp, err := noRedirect.PostForm(ts.URL+ApprovePath, url.Values{
+			"SAMLResponse": {samlResponse(login.nonce, login.name, login.group)},
+			"RelayState":   {id + "/" + login.action},
+		})
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+		assert.Equal(t, testBaseURL+"/workflow/"+id, resp.Header.Get("Location"))
+	}
+	resp, err = noRedirect.PostForm(ts.URL+ApprovePath, url.Values{
+		"SAMLResponse": {"garbage"},
+		"RelayState":   {id + "/approve"},
+	})
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	assertions, err := client.GetAssertions(context.Background(), &workflow.GetAssertionsRequest{
+		WorkflowId:    id,
+		WorkflowNonce: created.WorkflowNonce,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, workflow.StatusCompleted, assertions.Status)
+	assert.Len(t, assertions.Assertions, 2)
+
+	_, err = client.GetAssertions(context.Background(), &workflow.GetAssertionsRequest{
+		WorkflowId:    id,
+		WorkflowNonce: "wrong",
+	})
+	assert.Error(t, err)
+
+	details, err := client.GetDetails(context.Background(), &workflow.GetDetailsRequest{
+		WorkflowId:    id,
+		WorkflowNonce: created.WorkflowNonce,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, workflow.StatusCompleted, details.Status)
+	assert.Len(t, details.Approvals, 2)
+
+	// Too late to cancel
+	_, err = client.Cancel(context.Background(), &workflow.CancelRequest{
+		WorkflowId:    id,
+		WorkflowNonce: created.WorkflowNonce,
+	})
+	var httpErr *workflow.HTTPError
+	assert.True(t, errors.As(err, &httpErr))
+	assert.Equal(t, http.StatusConflict, httpErr.StatusCode)
+}
+
+func readBody(resp *http.Response) string {
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return string(body)
+}
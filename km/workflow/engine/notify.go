@@ -0,0 +1,340 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/bsycorp/keymaster/km/util"
+	"github.com/bsycorp/keymaster/km/workflow"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Allowed for each notification to be delivered
+const notifyTimeout = 30 * time.Second
+
+// Webhook responses are only drained so the connection can be reused
+const maxNotifyResponseBytes = 64 << 10
+
+// Headers on webhook notifications. The signature is the hex encoded
+// HMAC-SHA256 of the timestamp, a ".", and the body, prefixed with
+// "sha256=". Receivers should check it, and that the timestamp is
+// recent.
+const (
+	WebhookSignatureHeader = "X-Keymaster-Signature"
+	WebhookTimestampHeader = "X-Keymaster-Timestamp"
+)
+
+// NotifierConfig configures one way of telling approvers about new
+// workflows.
+type NotifierConfig struct {
+	// One of: webhook, slack, email
+	Type string `json:"type"`
+	// Only notify for workflows with these policies; default all
+	Policies []string `json:"policies"`
+	// webhook, slack: where to post notifications. Slack webhook URLs
+	// are secret, so this can be s3:// file:// data:// or raw data
+	URL string `json:"url"`
+	// webhook: the key to sign notifications with. Can be s3:// file://
+	// data:// or raw data
+	Secret string `json:"secret"`
+	// email: the SMTP server (host:port), and optional credentials for
+	// it. The password can be s3:// file:// data:// or raw data
+	SMTPAddr     string `json:"smtp_addr"`
+	SMTPUsername string `json:"smtp_username"`
+	SMTPPassword string `json:"smtp_password"`
+	// email: the sender and recipients
+	From string   `json:"from"`
+	To   []string `json:"to"`
+}
+
+// Notification is what approvers are told about a new workflow
+type Notification struct {
+	WorkflowID string             `json:"workflow_id"`
+	Requester  workflow.Requester `json:"requester"`
+	Source     workflow.Source    `json:"source"`
+	Target     workflow.Target    `json:"target"`
+	Policy     string             `json:"policy"`
+	// Approvals needed, by approver group
+	ApproverRoles map[string]int `json:"approver_roles"`
+	// The approval page
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func newNotification(wf *Workflow, url string) *Notification {
+	return &Notification{
+		WorkflowID:    wf.ID,
+		Requester:     wf.Requester,
+		Source:        wf.Source,
+		Target:        wf.Target,
+		Policy:        wf.Policy.Name,
+		ApproverRoles: wf.Policy.ApproverRoles,
+		URL:           url,
+		ExpiresAt:     wf.ExpiresAt,
+	}
+}
+
+// A Notifier tells approvers about new workflows
+type Notifier interface {
+	Notify(ctx context.Context, n *Notification) error
+}
+
+// NewNotifiersFromConfig returns the configured notifiers
+func NewNotifiersFromConfig(configs []NotifierConfig) ([]Notifier, error) {
+	var notifiers []Notifier
+	for i := range configs {
+		notifier, err := newNotifier(&configs[i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "notifier %d (%s)", i, configs[i].Type)
+		}
+		if len(configs[i].Policies) > 0 {
+			notifier = &policyNotifier{Notifier: notifier, Policies: configs[i].Policies}
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	return notifiers, nil
+}
+
+func newNotifier(config *NotifierConfig) (Notifier, error) {
+	switch config.Type {
+	case "webhook":
+		if config.URL == "" || config.Secret == "" {
+			return nil, errors.New("webhook notifications need a url and secret")
+		}
+		url, err := loadSetting(config.URL)
+		if err != nil {
+			return nil, errors.Wrap(err, "error loading url")
+		}
+		secret, err := loadSetting(config.Secret)
+		if err != nil {
+			return nil, errors.Wrap(err, "error loading secret")
+		}
+		return &WebhookNotifier{URL: url, Secret: []byte(secret)}, nil
+	case "slack":
+		if config.URL == "" {
+			return nil, errors.New("slack notifications need a url")
+		}
+		url, err := loadSetting(config.URL)
+		if err != nil {
+			return nil, errors.Wrap(err, "error loading url")
+		}
+		return &SlackNotifier{URL: url}, nil
+	case "email":
+		if config.SMTPAddr == "" || config.From == "" || len(config.To) == 0 {
+			return nil, errors.New("email notifications need an smtp_addr, from and to")
+		}
+		notifier := &EmailNotifier{Addr: config.SMTPAddr, From: config.From, To: config.To}
+		if config.SMTPUsername != "" {
+			password, err := loadSetting(config.SMTPPassword)
+			if err != nil {
+				return nil, errors.Wrap(err, "error loading smtp password")
+			}
+			host := strings.Split(config.SMTPAddr, ":")[0]
+			notifier.Auth = smtp.PlainAuth("", config.SMTPUsername, password, host)
+		}
+		return notifier, nil
+	default:
+		return nil, errors.Errorf("unknown notifier type: %s", config.Type)
+	}
+}
+
+// loadSetting loads a setting which may be a reference, as for keys
+func loadSetting(s string) (string, error) {
+	data, err := util.Load(s)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// policyNotifier only passes on notifications for some policies
+type policyNotifier struct {
+	Notifier
+	Policies []string
+}
+
+func (p *policyNotifier) Notify(ctx context.Context, n *Notification) error {
+	for _, policy := range p.Policies {
+		if policy == n.Policy {
+			return p.Notifier.Notify(ctx, n)
+		}
+	}
+	return nil
+}
+
+// WebhookNotifier posts notifications as JSON, signed with the secret
+// (see WebhookSignatureHeader).
+type WebhookNotifier struct {
+	URL        string
+	Secret     []byte
+	HttpClient *http.Client
+	Clock      clockwork.Clock
+}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return errors.Wrap(err, "error encoding notification")
+	}
+	now := time.Now()
+	if w.Clock != nil {
+		now = w.Clock.Now()
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	header := http.Header{}
+	header.Set(WebhookTimestampHeader, timestamp)
+	header.Set(WebhookSignatureHeader, WebhookSignature(w.Secret, timestamp, body))
+	return post(ctx, w.HttpClient, w.URL, header, body)
+}
+
+// WebhookSignature is the signature header value for a webhook
+// notification
+func WebhookSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SlackNotifier posts notifications to a Slack incoming webhook
+type SlackNotifier struct {
+	URL        string
+	HttpClient *http.Client
+}
+
+func (s *SlackNotifier) Notify(ctx context.Context, n *Notification) error {
+	var text bytes.Buffer
+	if err := slackTemplate.Execute(&text, n); err != nil {
+		return errors.Wrap(err, "error rendering notification")
+	}
+	body, err := json.Marshal(map[string]string{"text": text.String()})
+	if err != nil {
+		return errors.Wrap(err, "error encoding notification")
+	}
+	return post(ctx, s.HttpClient, s.URL, http.Header{}, body)
+}
+
+func post(ctx context.Context, client *http.Client, url string, header http.Header, body []byte) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "http request construction error")
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request error")
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxNotifyResponseBytes))
+	if resp.StatusCode >= 300 {
+		return errors.Errorf("notification rejected with status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// EmailNotifier sends notifications by email
+type EmailNotifier struct {
+	// The SMTP server, host:port
+	Addr string
+	// Optional
+	Auth smtp.Auth
+	From string
+	To   []string
+}
+
+func (m *EmailNotifier) Notify(ctx context.Context, n *Notification) error {
+	var body bytes.Buffer
+	if err := textTemplate.Execute(&body, n); err != nil {
+		return errors.Wrap(err, "error rendering notification")
+	}
+	subject := fmt.Sprintf("Access request for %s: %s", n.Target.EnvironmentName, n.Source.Description)
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", headerValue(m.From))
+	fmt.Fprintf(&msg, "To: %s\r\n", headerValue(strings.Join(m.To, ", ")))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerValue(subject)))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "\r\n")
+	msg.WriteString(strings.ReplaceAll(body.String(), "\n", "\r\n"))
+
+	// net/smtp has no context support, so give up waiting for it instead
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.Addr, m.Auth, m.From, m.To, msg.Bytes())
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return errors.Wrap(err, "error sending email")
+		}
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "error sending email")
+	}
+}
+
+// headerValue keeps requester supplied text from adding headers
+func headerValue(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+var textTemplate = template.Must(template.New("text").Parse(`{{.Requester.Name}} ({{.Requester.Username}}, {{.Requester.Email}}) is requesting access to {{.Target.EnvironmentName}}.
+
+Description: {{.Source.Description}}
+Details: {{.Source.DetailsURI}}
+Policy: {{.Policy}}
+{{- range $group, $n := .ApproverRoles}}
+Needs {{$n}} approval(s) from {{$group}}
+{{- end}}
+Expires: {{.ExpiresAt.Format "2006-01-02 15:04:05 MST"}}
+
+Approve or reject: {{.URL}}
+`))
+
+// Slack mrkdwn; text from the requester is escaped, and only linked if
+// it is an http(s) URL
+var slackTemplate = template.Must(template.New("slack").Funcs(template.FuncMap{
+	"escape": slackEscape,
+	"link":   slackLink,
+}).Parse(`*Access request for {{escape .Target.EnvironmentName}}* from {{escape .Requester.Name}} ({{escape .Requester.Username}})
+>{{escape .Source.Description}}
+Details: {{link .Source.DetailsURI}}
+Policy: {{escape .Policy}}
+{{- range $group, $n := .ApproverRoles}}, needs {{$n}} from {{escape $group}}{{end}}
+<{{escape .URL}}|Approve or reject>`))
+
+// Slack has no escape for "|", which ends the URL part of a link, so it
+// is replaced with a lookalike
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "|", "\u2223", "\n", " ")
+
+func slackEscape(s string) string {
+	return slackEscaper.Replace(s)
+}
+
+func slackLink(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.ContainsAny(s, "|<> \n") {
+		return slackEscape(s)
+	}
+	return "<" + slackEscape(s) + ">"
+}
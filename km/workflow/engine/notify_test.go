@@ -0,0 +1,280 @@
+package engine
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testNotification() *Notification {
+	req := testCreateRequest("nonce")
+	req.Source.Description = "Deploy <version> 3.2 & more"
+	return &Notification{
+		WorkflowID:    "the-id",
+		Requester:     req.Requester,
+		Source:        req.Source,
+		Target:        req.Target,
+		Policy:        "deploy_with_approval",
+		ApproverRoles: map[string]int{"security": 1},
+		URL:           testBaseURL + "/workflow/the-id",
+		ExpiresAt:     time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC),
+	}
+}
+
+// recordingServer records the requests posted to it
+type recordingServer struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   []string
+}
+
+func (s *recordingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	s.requests = append(s.requests, r)
+	s.bodies = append(s.bodies, string(body))
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	rec := &recordingServer{}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+	clock := clockwork.NewFakeClockAt(time.Unix(1790000000, 0))
+	notifier := &WebhookNotifier{URL: ts.URL, Secret: []byte("secret"), Clock: clock}
+
+	assert.NoError(t, notifier.Notify(context.Background(), testNotification()))
+	if !assert.Len(t, rec.requests, 1) {
+		return
+	}
+	req, body := rec.requests[0], rec.bodies[0]
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, "1790000000", req.Header.Get(WebhookTimestampHeader))
+	assert.Equal(t, WebhookSignature([]byte("secret"), "1790000000", []byte(body)), req.Header.Get(WebhookSignatureHeader))
+	assert.NotEqual(t, WebhookSignature([]byte("other"), "1790000000", []byte(body)), req.Header.Get(WebhookSignatureHeader))
+	var n Notification
+	assert.NoError(t, json.Unmarshal([]byte(body), &n))
+	assert.Equal(t, *testNotification(), n)
+
+	rec.status = http.StatusForbidden
+	assert.Error(t, notifier.Notify(context.Background(), testNotification()))
+}
+
+func TestSlackNotifier(t *testing.T) {
+	rec := &recordingServer{}
+	ts := httptest.NewServer(rec)
+	defer ts.Close()
+	notifier := &SlackNotifier{URL: ts.URL}
+
+	assert.NoError(t, notifier.Notify(context.Background(), testNotification()))
+	if !assert.Len(t, rec.bodies, 1) {
+		return
+	}
+	var msg map[string]string
+	assert.NoError(t, json.Unmarshal([]byte(rec.bodies[0]), &msg))
+	text := msg["text"]
+	assert.Contains(t, text, "*Access request for nonprod* from Dave (dave)")
+	assert.Contains(t, text, ">Deploy &lt;version&gt; 3.2 &amp; more")
+	assert.Contains(t, text, "<https://gitlab.example.com/platform/deploy/-/jobs/42>")
+	assert.Contains(t, text, "needs 1 from security")
+	assert.Contains(t, text, "<"+testBaseURL+"/workflow/the-id|Approve or reject>")
+}
+
+func TestSlackEscape(t *testing.T) {
+	assert.Equal(t, "a &lt;b&gt; &amp; c\u2223d e", slackEscape("a <b> & c|d\ne"))
+
+	assert.Equal(t, "<https://gitlab.example.com/jobs/42?a=1&amp;b=2>", slackLink("https://gitlab.example.com/jobs/42?a=1&b=2"))
+	// Requesters can't smuggle in their own link text or scheme
+	for _, uri := range []string{
+		"https://evil.example.com|Approve or reject",
+		"javascript:alert(1)",
+		"mailto:dave@example.com",
+		"/relative/path",
+		"https://evil.example.com> <https://other.example.com",
+	} {
+		link := slackLink(uri)
+		assert.False(t, strings.HasPrefix(link, "<"), uri)
+		assert.NotContains(t, link, "|", uri)
+	}
+}
+
+// smtpStandIn accepts mail on a local port and records it
+type smtpStandIn struct {
+	listener net.Listener
+	mu       sync.Mutex
+	auth     []string
+	from     []string
+	to       []string
+	data     []string
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStandIn{listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *smtpStandIn) serve(conn net.Conn) {
+	c := textproto.NewConn(conn)
+	defer c.Close()
+	c.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO":
+			c.PrintfLine("250-localhost")
+			c.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			s.auth = append(s.auth, line)
+			c.PrintfLine("235 Authenticated")
+		case "MAIL":
+			s.from = append(s.from, line)
+			c.PrintfLine("250 OK")
+		case "RCPT":
+			s.to = append(s.to, line)
+			c.PrintfLine("250 OK")
+		case "DATA":
+			c.PrintfLine("354 Go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				s.mu.Unlock()
+				return
+			}
+			s.data = append(s.data, string(data))
+			c.PrintfLine("250 OK")
+		case "QUIT":
+			c.PrintfLine("221 Bye")
+			s.mu.Unlock()
+			return
+		default:
+			c.PrintfLine("250 OK")
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	smtpServer := newSMTPStandIn(t)
+	defer smtpServer.listener.Close()
+	notifiers, err := NewNotifiersFromConfig([]NotifierConfig{{
+		Type:         "email",
+		SMTPAddr:     smtpServer.listener.Addr().String(),
+		SMTPUsername: "km",
+		SMTPPassword: "data://" + base64.StdEncoding.EncodeToString([]byte("hunter2\n")),
+		From:         "km@example.com",
+		To:           []string{"security@example.com", "platform@example.com"},
+	}})
+	assert.NoError(t, err)
+
+	n := testNotification()
+	n.Source.Description = "Deploy 3.2\r\nBcc: everyone@example.com"
+	assert.NoError(t, notifiers[0].Notify(context.Background(), n))
+	smtpServer.mu.Lock()
+	defer smtpServer.mu.Unlock()
+	assert.Equal(t, []string{"AUTH PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00km\x00hunter2"))}, smtpServer.auth)
+	assert.Equal(t, []string{"MAIL FROM:<km@example.com>"}, smtpServer.from)
+	assert.Equal(t, []string{"RCPT TO:<security@example.com>", "RCPT TO:<platform@example.com>"}, smtpServer.to)
+	if !assert.Len(t, smtpServer.data, 1) {
+		return
+	}
+	msg := smtpServer.data[0]
+	headers := strings.SplitN(msg, "\n\n", 2)[0]
+	assert.Contains(t, headers, "Subject: Access request for nonprod: Deploy 3.2 Bcc: everyone@example.com\n")
+	assert.NotContains(t, headers, "\nBcc:")
+	assert.Contains(t, msg, "Dave (dave, dave@example.com) is requesting access to nonprod.")
+	assert.Contains(t, msg, "Details: https://gitlab.example.com/platform/deploy/-/jobs/42\n")
+	assert.Contains(t, msg, "Needs 1 approval(s) from security\n")
+	assert.Contains(t, msg, "Approve or reject: "+testBaseURL+"/workflow/the-id\n")
+}
+
+func TestNewNotifiersFromConfig(t *testing.T) {
+	for _, config := range []NotifierConfig{
+		{Type: "webhook", URL: "https://hooks.example.com"},
+		{Type: "slack"},
+		{Type: "email", SMTPAddr: "smtp.example.com:587", From: "km@example.com"},
+		{Type: "pager"},
+	} {
+		_, err := NewNotifiersFromConfig([]NotifierConfig{config})
+		assert.Error(t, err, config.Type)
+	}
+
+	notifiers, err := NewNotifiersFromConfig([]NotifierConfig{
+		{Type: "webhook", URL: "https://hooks.example.com", Secret: "data://" + base64.StdEncoding.EncodeToString([]byte("secret\n"))},
+		{Type: "slack", URL: "https://hooks.slack.com/services/T0/B0/X", Policies: []string{"deploy_with_approval"}},
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, notifiers, 2) {
+		assert.Equal(t, []byte("secret"), notifiers[0].(*WebhookNotifier).Secret)
+		assert.Equal(t, []string{"deploy_with_approval"}, notifiers[1].(*policyNotifier).Policies)
+	}
+}
+
+// notifierFunc adapts a function to a Notifier
+type notifierFunc func(ctx context.Context, n *Notification) error
+
+func (f notifierFunc) Notify(ctx context.Context, n *Notification) error {
+	return f(ctx, n)
+}
+
+func TestEngine_Notify(t *testing.T) {
+	var mu sync.Mutex
+	var notified []*Notification
+	record := notifierFunc(func(ctx context.Context, n *Notification) error {
+		mu.Lock()
+		defer mu.Unlock()
+		notified = append(notified, n)
+		return nil
+	})
+	e := &Engine{
+		Notifiers: []Notifier{
+			record,
+			&policyNotifier{Notifier: record, Policies: []string{"other_policy"}},
+			notifierFunc(func(context.Context, *Notification) error { return errors.New("unavailable") }),
+		},
+	}
+	assert.NoError(t, e.Init(testConfig()))
+
+	created, err := e.Create(testCreateRequest(uuid.New().String()))
+	assert.NoError(t, err)
+	e.WaitForNotifications()
+	if assert.Len(t, notified, 1) {
+		assert.Equal(t, created.WorkflowId, notified[0].WorkflowID)
+		assert.Equal(t, created.WorkflowUrl, notified[0].URL)
+		assert.Equal(t, "Deploy version 3.2", notified[0].Source.Description)
+		assert.Equal(t, "nonprod", notified[0].Target.EnvironmentName)
+	}
+}
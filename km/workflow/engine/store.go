@@ -0,0 +1,252 @@
+package engine
+
+import (
+	"encoding/json"
+	"github.com/bsycorp/keymaster/km/util"
+	"github.com/bsycorp/keymaster/km/workflow"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for unknown workflow IDs
+var ErrNotFound = errors.New("workflow not found")
+
+// DefaultRetainSeconds is how long workflows are kept after they expire,
+// unless configured otherwise
+const DefaultRetainSeconds = 86400
+
+// A Store holds workflows. Workflows are returned by value (copies), and
+// changed with Update.
+type Store interface {
+	Create(wf *Workflow) error
+	Get(id string) (*Workflow, error)
+	// Update calls fn with the stored workflow and saves the changes it
+	// makes, unless it returns an error. Updates of a workflow are
+	// serialised.
+	Update(id string, fn func(wf *Workflow) error) (*Workflow, error)
+}
+
+// NewStoreFromConfig returns the configured store; the default is memory.
+// The clock, if not nil, decides when workflows are dropped.
+func NewStoreFromConfig(config *StorageConfig, clock clockwork.Clock) (Store, error) {
+	var s *MemoryStore
+	switch config.Type {
+	case "", "memory":
+		s = NewMemoryStore()
+	case "file":
+		if config.Path == "" {
+			return nil, errors.New("file storage requires a path")
+		}
+		s = NewFileStore(config.Path)
+	default:
+		return nil, errors.Errorf("unknown storage type: %s", config.Type)
+	}
+	if config.RetainSeconds < 0 {
+		return nil, errors.New("storage retain_seconds must not be negative")
+	} else if config.RetainSeconds > 0 {
+		s.Retain = time.Duration(config.RetainSeconds) * time.Second
+	}
+	if clock != nil {
+		s.Clock = clock
+	}
+	return s, nil
+}
+
+// MemoryStore keeps workflows in memory. With a Path it is the engine's
+// file storage: the file is read when the store is first used, and
+// rewritten whenever a workflow changes, so no other process may use
+// it.
+//
+// Workflows are dropped once they have been expired for Retain. Their
+// SAML responses are dropped sooner, when they can no longer be
+// collected: once the workflow is rejected or cancelled, or expires.
+type MemoryStore struct {
+	Path   string
+	Retain time.Duration
+	Clock  clockwork.Clock
+
+	mu        sync.Mutex
+	loaded    bool
+	workflows map[string]*Workflow
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		Retain:    DefaultRetainSeconds * time.Second,
+		Clock:     clockwork.NewRealClock(),
+		workflows: make(map[string]*Workflow),
+	}
+}
+
+func NewFileStore(path string) *MemoryStore {
+	s := NewMemoryStore()
+	s.Path = path
+	return s
+}
+
+func (s *MemoryStore) Create(wf *Workflow) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	if _, found := s.workflows[wf.ID]; found {
+		return errors.Errorf("workflow already exists: %s", wf.ID)
+	}
+	stored, err := clone(wf)
+	if err != nil {
+		return err
+	}
+	return s.commit(wf.ID, stored)
+}
+
+func (s *MemoryStore) Get(id string) (*Workflow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	wf, found := s.workflows[id]
+	if !found {
+		return nil, ErrNotFound
+	}
+	return clone(wf)
+}
+
+func (s *MemoryStore) Update(id string, fn func(wf *Workflow) error) (*Workflow, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	stored, found := s.workflows[id]
+	if !found {
+		return nil, ErrNotFound
+	}
+	wf, err := clone(stored)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(wf); err != nil {
+		return nil, err
+	}
+	if stored, err = clone(wf); err != nil {
+		return nil, err
+	}
+	if err := s.commit(id, stored); err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
+
+// commit saves the workflows with wf stored under id, less those past
+// their retention and assertions which can't be collected. The store
+// only changes once they are saved.
+func (s *MemoryStore) commit(id string, wf *Workflow) error {
+	now := s.Clock.Now()
+	cutoff := now.Add(-s.Retain)
+	workflows := make(map[string]*Workflow, len(s.workflows)+1)
+	for k, v := range s.workflows {
+		if v.ExpiresAt.After(cutoff) {
+			workflows[k] = v
+		}
+	}
+	workflows[id] = wf
+	for k, v := range workflows {
+		if hasAssertions(v) && !collectable(v, now) {
+			workflows[k] = withoutAssertions(v)
+		}
+	}
+	if err := s.save(workflows); err != nil {
+		return err
+	}
+	s.workflows = workflows
+	return nil
+}
+
+// collectable returns true if the workflow's assertions may still be
+// collected by the requester
+func collectable(wf *Workflow, now time.Time) bool {
+	switch wf.Status {
+	case workflow.StatusRejected, workflow.StatusCancelled, workflow.StatusExpired:
+		return false
+	}
+	return wf.ExpiresAt.IsZero() || now.Before(wf.ExpiresAt)
+}
+
+func hasAssertions(wf *Workflow) bool {
+	if wf.Identity != nil && wf.Identity.Assertion != "" {
+		return true
+	}
+	for _, approval := range wf.Approvals {
+		if approval.Assertion != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutAssertions returns a copy of the workflow without its SAML
+// responses, leaving the stored one as it is
+func withoutAssertions(wf *Workflow) *Workflow {
+	result := *wf
+	result.Approvals = make([]Approval, len(wf.Approvals))
+	for i, approval := range wf.Approvals {
+		approval.Assertion = ""
+		result.Approvals[i] = approval
+	}
+	if wf.Identity != nil {
+		identity := *wf.Identity
+		identity.Assertion = ""
+		result.Identity = &identity
+	}
+	return &result
+}
+
+func clone(wf *Workflow) (*Workflow, error) {
+	data, err := json.Marshal(wf)
+	if err != nil {
+		return nil, err
+	}
+	var result Workflow
+	err = json.Unmarshal(data, &result)
+	return &result, err
+}
+
+func (s *MemoryStore) load() error {
+	if s.Path == "" || s.loaded {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		s.loaded = true
+		return nil
+	} else if err != nil {
+		return err
+	}
+	workflows := make(map[string]*Workflow)
+	if err := json.Unmarshal(data, &workflows); err != nil {
+		return err
+	}
+	s.workflows = workflows
+	s.loaded = true
+	return nil
+}
+
+func (s *MemoryStore) save(workflows map[string]*Workflow) error {
+	if s.Path == "" {
+		return nil
+	}
+	data, err := json.Marshal(workflows)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(s.Path, data)
+}
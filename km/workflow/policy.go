@@ -0,0 +1,244 @@
+package workflow
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/bsycorp/keymaster/km/api"
+	"github.com/bsycorp/keymaster/km/util"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jonboulle/clockwork"
+	"github.com/pkg/errors"
+	"gopkg.in/square/go-jose.v2"
+	"strings"
+	"time"
+)
+
+// A signed policy lets the workflow engine check that the policy a
+// client sends it is the one the issuing server has for the role. It is
+// a JWT signed by the issuing server, optionally nested in a JWE
+// encrypted to the workflow engine so that clients can't read it either.
+
+// Only asymmetric algorithms, so engines need no secrets to verify
+var policyValidMethods = []string{"RS256", "ES256"}
+
+// PolicyClaims are the contents of a signed policy
+type PolicyClaims struct {
+	Policy Policy `json:"policy"`
+	Role   string `json:"role"`
+	// Bind the policy to one workflow, and its requester
+	IdpNonce          string `json:"idp_nonce"`
+	IdentifyNonce     string `json:"identify_nonce,omitempty"`
+	RequesterUsername string `json:"requester_username,omitempty"`
+	RequesterEmail    string `json:"requester_email,omitempty"`
+	jwt.StandardClaims
+}
+
+// PolicyFromConfig is the workflow policy for a km workflow policy
+func PolicyFromConfig(p *api.WorkflowPolicyConfig) Policy {
+	return Policy{
+		Name:                p.Name,
+		IdpName:             p.IdpName,
+		RequesterCanApprove: p.RequesterCanApprove,
+		IdentifyRoles:       p.IdentifyRoles,
+		ApproverRoles:       p.ApproverRoles,
+		// Engines use it to expire workflows the issuing server would
+		// refuse anyway
+		MaxApprovalAgeSeconds: p.MaxApprovalAgeSeconds,
+	}
+}
+
+// PolicySigner signs (and optionally encrypts) policies for the issuing
+// server.
+type PolicySigner struct {
+	Method jwt.SigningMethod
+	// Not needed for KMS
+	Key interface{}
+	// If set, policies are encrypted to this key
+	EncryptionKey *rsa.PublicKey
+}
+
+// NewPolicySigner returns a signer for the config, or nil if policy
+// signing isn't configured.
+func NewPolicySigner(config *api.WorkflowPolicySigningConfig) (*PolicySigner, error) {
+	var signer PolicySigner
+	switch {
+	case config.SigningKey != "":
+		keyData, err := util.Load(config.SigningKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "error loading policy signing key")
+		}
+		signer.Method, signer.Key, err = ParsePrivateKey(keyData)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid policy signing key")
+		}
+	case config.KmsKeyId != "":
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		signer.Method = &KMSSigningMethod{KMS: kms.New(sess), KeyId: config.KmsKeyId}
+	default:
+		return nil, nil
+	}
+	if config.EncryptionKey != "" {
+		keyData, err := util.Load(config.EncryptionKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "error loading policy encryption key")
+		}
+		signer.EncryptionKey, err = jwt.ParseRSAPublicKeyFromPEM(keyData)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid policy encryption key")
+		}
+	}
+	return &signer, nil
+}
+
+func (ps *PolicySigner) Sign(claims *PolicyClaims) (string, error) {
+	signed, err := jwt.NewWithClaims(ps.Method, claims).SignedString(ps.Key)
+	if err != nil {
+		return "", errors.Wrap(err, "error signing policy")
+	}
+	if ps.EncryptionKey == nil {
+		return signed, nil
+	}
+	encrypter, err := jose.NewEncrypter(
+		jose.A256GCM,
+		jose.Recipient{Algorithm: jose.RSA_OAEP_256, Key: ps.EncryptionKey},
+		(&jose.EncrypterOptions{}).WithContentType("JWT"),
+	)
+	if err != nil {
+		return "", errors.Wrap(err, "error encrypting policy")
+	}
+	encrypted, err := encrypter.Encrypt([]byte(signed))
+	if err != nil {
+		return "", errors.Wrap(err, "error encrypting policy")
+	}
+	return encrypted.CompactSerialize()
+}
+
+// PolicyVerifier decrypts and verifies signed policies for the
+// workflow engine.
+type PolicyVerifier struct {
+	// Public keys of the issuing servers, by issuer (environment) name
+	Keys map[string]interface{}
+	// The workflow engine's base URL
+	Audience string
+	// Needed for encrypted policies
+	DecryptionKey *rsa.PrivateKey
+	Clock         clockwork.Clock
+}
+
+// Verify returns the policy's claims if it is valid
+func (pv *PolicyVerifier) Verify(signedPolicy string) (*PolicyClaims, error) {
+	// A JWE has five parts, a JWS three
+	if strings.Count(signedPolicy, ".") == 4 {
+		if pv.DecryptionKey == nil {
+			return nil, errors.New("policy is encrypted but no decryption key is configured")
+		}
+		encrypted, err := jose.ParseEncrypted(signedPolicy)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid encrypted policy")
+		}
+		if encrypted.Header.Algorithm != string(jose.RSA_OAEP_256) {
+			return nil, errors.Errorf("unsupported policy encryption algorithm: %s", encrypted.Header.Algorithm)
+		}
+		decrypted, err := encrypted.Decrypt(pv.DecryptionKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "error decrypting policy")
+		}
+		signedPolicy = string(decrypted)
+	}
+
+	// Expiry is checked below against pv.Clock, allowing api.MaxClockSkew
+	parser := jwt.Parser{
+		ValidMethods:         policyValidMethods,
+		SkipClaimsValidation: true,
+	}
+	var claims PolicyClaims
+	_, err := parser.ParseWithClaims(signedPolicy, &claims, func(token *jwt.Token) (interface{}, error) {
+		issuer := token.Claims.(*PolicyClaims).Issuer
+		key, ok := pv.Keys[issuer]
+		if !ok {
+			return nil, errors.Errorf("unknown policy issuer: %s", issuer)
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid signed policy")
+	}
+	now := time.Now()
+	if pv.Clock != nil {
+		now = pv.Clock.Now()
+	}
+	if !claims.VerifyExpiresAt(now.Add(-api.MaxClockSkew).Unix(), true) {
+		return nil, errors.New("signed policy has expired")
+	}
+	if !claims.VerifyIssuedAt(now.Add(api.MaxClockSkew).Unix(), true) {
+		return nil, errors.New("signed policy was issued in the future")
+	}
+	if strings.TrimSuffix(claims.Audience, "/") != strings.TrimSuffix(pv.Audience, "/") {
+		return nil, errors.Errorf("signed policy has wrong audience: %s", claims.Audience)
+	}
+	return &claims, nil
+}
+
+// ParsePrivateKey parses a PEM encoded RSA or EC (P-256) private key, and
+// returns the signing method to use with it.
+func ParsePrivateKey(data []byte) (jwt.SigningMethod, interface{}, error) {
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		return jwt.SigningMethodRS256, key, nil
+	}
+	key, err := jwt.ParseECPrivateKeyFromPEM(data)
+	if err != nil {
+		return nil, nil, errors.New("not a PEM encoded RSA or EC private key")
+	}
+	if key.Curve.Params().BitSize != 256 {
+		return nil, nil, errors.New("only P-256 EC keys are supported")
+	}
+	return jwt.SigningMethodES256, key, nil
+}
+
+// ParsePublicKey parses a PEM encoded RSA or EC public key
+func ParsePublicKey(data []byte) (interface{}, error) {
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(data); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("not a PEM encoded RSA or EC public key")
+}
+
+// KMSSigningMethod signs JWTs (RS256) with an asymmetric KMS key, which
+// must be an RSA key with usage SIGN_VERIFY. Signatures are verified
+// with the key's public key as for any other RS256 JWT.
+type KMSSigningMethod struct {
+	KMS   kmsiface.KMSAPI
+	KeyId string
+}
+
+func (m *KMSSigningMethod) Alg() string {
+	return jwt.SigningMethodRS256.Alg()
+}
+
+func (m *KMSSigningMethod) Sign(signingString string, key interface{}) (string, error) {
+	digest := sha256.Sum256([]byte(signingString))
+	out, err := m.KMS.Sign(&kms.SignInput{
+		KeyId:            aws.String(m.KeyId),
+		Message:          digest[:],
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256),
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "kms sign error")
+	}
+	return jwt.EncodeSegment(out.Signature), nil
+}
+
+func (m *KMSSigningMethod) Verify(signingString string, signature string, key interface{}) error {
+	return jwt.SigningMethodRS256.Verify(signingString, signature, key)
+}
@@ -0,0 +1,182 @@
+package workflow
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/bsycorp/keymaster/km/api"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jonboulle/clockwork"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPolicyAudience = "https://workflow.example.com"
+
+var testPolicyTime = time.Date(2026, 10, 1, 9, 0, 0, 0, time.UTC)
+
+func testPolicyClaims() *PolicyClaims {
+	return &PolicyClaims{
+		Policy: Policy{
+			Name:          "deploy_with_approval",
+			IdpName:       "nonprod",
+			ApproverRoles: map[string]int{"security": 1},
+		},
+		Role:     "deployment",
+		IdpNonce: "the-idp-nonce",
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    "nonprod",
+			Audience:  testPolicyAudience + "/",
+			IssuedAt:  testPolicyTime.Unix(),
+			ExpiresAt: testPolicyTime.Add(time.Hour).Unix(),
+		},
+	}
+}
+
+func mustGenerateRSAKey() *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// fakeKMS signs with a local key
+type fakeKMS struct {
+	kmsiface.KMSAPI
+	key *rsa.PrivateKey
+}
+
+func (f *fakeKMS) Sign(input *kms.SignInput) (*kms.SignOutput, error) {
+	if aws.StringValue(input.MessageType) != kms.MessageTypeDigest {
+		return nil, api.Errorf(api.ErrorCodeBadRequest, "expected a digest")
+	}
+	sig, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, input.Message)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.SignOutput{KeyId: input.KeyId, Signature: sig}, nil
+}
+
+func TestPolicySigner(t *testing.T) {
+	rsaKey := mustGenerateRSAKey()
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	engineKey := mustGenerateRSAKey()
+
+	tests := []struct {
+		name      string
+		signer    *PolicySigner
+		publicKey interface{}
+	}{
+		{"rsa", &PolicySigner{Method: jwt.SigningMethodRS256, Key: rsaKey}, &rsaKey.PublicKey},
+		{"ec", &PolicySigner{Method: jwt.SigningMethodES256, Key: ecKey}, &ecKey.PublicKey},
+		{"kms", &PolicySigner{Method: &KMSSigningMethod{KMS: &fakeKMS{key: rsaKey}, KeyId: "alias/km"}}, &rsaKey.PublicKey},
+		{"encrypted", &PolicySigner{Method: jwt.SigningMethodRS256, Key: rsaKey, EncryptionKey: &engineKey.PublicKey}, &rsaKey.PublicKey},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signed, err := test.signer.Sign(testPolicyClaims())
+			assert.NoError(t, err)
+			verifier := &PolicyVerifier{
+				Keys:          map[string]interface{}{"nonprod": test.publicKey},
+				Audience:      testPolicyAudience,
+				DecryptionKey: engineKey,
+				Clock:         clockwork.NewFakeClockAt(testPolicyTime.Add(time.Minute)),
+			}
+			claims, err := verifier.Verify(signed)
+			if assert.NoError(t, err) {
+				assert.Equal(t, testPolicyClaims().Policy, claims.Policy)
+				assert.Equal(t, "the-idp-nonce", claims.IdpNonce)
+			}
+			if test.signer.EncryptionKey != nil {
+				assert.Equal(t, 4, strings.Count(signed, "."))
+				assert.NotContains(t, signed, "security")
+				verifier.DecryptionKey = nil
+				_, err = verifier.Verify(signed)
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestPolicyVerifier(t *testing.T) {
+	key := mustGenerateRSAKey()
+	signer := &PolicySigner{Method: jwt.SigningMethodRS256, Key: key}
+	clock := clockwork.NewFakeClockAt(testPolicyTime)
+	verifier := &PolicyVerifier{
+		Keys:     map[string]interface{}{"nonprod": &key.PublicKey},
+		Audience: testPolicyAudience,
+		Clock:    clock,
+	}
+	sign := func(modify func(*PolicyClaims)) string {
+		claims := testPolicyClaims()
+		modify(claims)
+		signed, err := signer.Sign(claims)
+		assert.NoError(t, err)
+		return signed
+	}
+
+	_, err := verifier.Verify(sign(func(*PolicyClaims) {}))
+	assert.NoError(t, err)
+	_, err = verifier.Verify(sign(func(c *PolicyClaims) { c.Issuer = "prod" }))
+	assert.Error(t, err)
+	_, err = verifier.Verify(sign(func(c *PolicyClaims) { c.Audience = "https://elsewhere.example.com" }))
+	assert.Error(t, err)
+	_, err = verifier.Verify(sign(func(c *PolicyClaims) { c.ExpiresAt = 0 }))
+	assert.Error(t, err)
+
+	// Another key, claiming to be the same issuer
+	otherSigner := &PolicySigner{Method: jwt.SigningMethodRS256, Key: mustGenerateRSAKey()}
+	forged, err := otherSigner.Sign(testPolicyClaims())
+	assert.NoError(t, err)
+	_, err = verifier.Verify(forged)
+	assert.Error(t, err)
+
+	// Unsigned
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, testPolicyClaims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	assert.NoError(t, err)
+	_, err = verifier.Verify(unsigned)
+	assert.Error(t, err)
+
+	signed := sign(func(*PolicyClaims) {})
+	clock.Advance(time.Hour + api.MaxClockSkew + time.Second)
+	_, err = verifier.Verify(signed)
+	assert.Error(t, err)
+}
+
+func TestParseKeys(t *testing.T) {
+	key := mustGenerateRSAKey()
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	method, parsed, err := ParsePrivateKey(privatePEM)
+	assert.NoError(t, err)
+	assert.Equal(t, jwt.SigningMethodRS256, method)
+	assert.Equal(t, key, parsed)
+
+	publicDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	publicKey, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+	assert.NoError(t, err)
+	assert.Equal(t, &key.PublicKey, publicKey)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	assert.NoError(t, err)
+	_, _, err = ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}))
+	assert.Error(t, err)
+
+	_, _, err = ParsePrivateKey([]byte("garbage"))
+	assert.Error(t, err)
+	_, err = ParsePublicKey([]byte("garbage"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,224 @@
+package workflow
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"math/rand"
+	"time"
+)
+
+// Defaults for Waiter
+const (
+	DefaultInitialInterval = 2 * time.Second
+	DefaultMaxInterval     = 30 * time.Second
+	DefaultMaxErrors       = 10
+	// Engines hold long polls for at most MaxWaitSeconds anyway
+	DefaultLongPoll = MaxWaitSeconds * time.Second
+)
+
+// MaxWaitSeconds is the longest an engine need hold a long poll for
+const MaxWaitSeconds = 20
+
+// Allowed for each request, on top of any long poll wait
+const requestTimeout = 30 * time.Second
+
+// Allowed for OnCancel, after the wait's own context is done
+const cancelTimeout = 10 * time.Second
+
+var (
+	ErrRejected  = errors.New("workflow was rejected")
+	ErrTimedOut  = errors.New("timed out waiting for workflow approval")
+	ErrCancelled = errors.New("cancelled waiting for workflow approval")
+	ErrExpired   = errors.New("workflow expired before it was approved")
+)
+
+// Waiter polls a workflow until it is finished, the context is done, or
+// it fails. Polls back off exponentially (with jitter) while there is
+// no change. Engines which support long polling are polled again as
+// soon as they respond.
+type Waiter struct {
+	Client *Client
+	// Delay before the second poll, doubled up to MaxInterval
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	// Consecutive temporary errors (see IsTemporary) tolerated. Other
+	// errors end the wait immediately.
+	MaxErrors int
+	// How long engines may hold each poll open; negative to not ask
+	LongPoll time.Duration
+	// Called with the workflow's details when its progress changes
+	OnProgress func(details *GetDetailsResponse)
+	// Called with errors which are retried, or which happen in OnCancel
+	OnError func(err error)
+	// Called when the wait is cancelled or times out, e.g. to cancel
+	// the workflow, with a fresh context
+	OnCancel func(ctx context.Context) error
+}
+
+// Wait returns the assertions of the completed workflow. If it ends
+// otherwise, the error is ErrRejected or ErrExpired (with the last
+// response), ErrTimedOut (the context deadline passed), ErrCancelled
+// (the context was cancelled, or the workflow was) or the error which
+// ended it.
+func (w *Waiter) Wait(ctx context.Context, workflowId string, workflowNonce string) (*GetAssertionsResponse, error) {
+	interval := w.initialInterval()
+	errorCount := 0
+	var progress string
+	for {
+		start := time.Now()
+		resp, err := w.poll(ctx, workflowId, workflowNonce)
+		if ctx.Err() != nil {
+			return nil, w.stopped(ctx)
+		}
+		if err != nil {
+			if !IsTemporary(err) {
+				return nil, err
+			}
+			errorCount++
+			if errorCount >= w.maxErrors() {
+				return nil, errors.Wrapf(err, "giving up after %d errors", errorCount)
+			}
+			w.onError(err)
+		} else {
+			errorCount = 0
+			switch resp.Status {
+			case StatusCompleted:
+				return resp, nil
+			case StatusRejected:
+				return resp, ErrRejected
+			case StatusExpired:
+				return resp, ErrExpired
+			case StatusCancelled:
+				return resp, ErrCancelled
+			case StatusCreated:
+			default:
+				return resp, errors.Errorf("unexpected workflow status: %s", resp.Status)
+			}
+			progress = w.progress(ctx, workflowId, workflowNonce, progress)
+			// An engine which held the request has already waited; one
+			// which claims to but didn't still gets a delay
+			if resp.LongPoll && time.Since(start) >= w.initialInterval() {
+				interval = w.initialInterval()
+				continue
+			}
+		}
+		if err := sleep(ctx, jitter(interval)); err != nil {
+			return nil, w.stopped(ctx)
+		}
+		interval *= 2
+		if interval > w.maxInterval() {
+			interval = w.maxInterval()
+		}
+	}
+}
+
+func (w *Waiter) poll(ctx context.Context, workflowId string, workflowNonce string) (*GetAssertionsResponse, error) {
+	req := &GetAssertionsRequest{
+		WorkflowId:    workflowId,
+		WorkflowNonce: workflowNonce,
+	}
+	timeout := requestTimeout
+	if longPoll := w.longPoll(); longPoll > 0 {
+		req.WaitSeconds = int(longPoll / time.Second)
+		timeout += longPoll
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return w.Client.GetAssertions(ctx, req)
+}
+
+// progress calls OnProgress if the workflow's progress has changed since
+// last, and returns its progress now. Progress is nice to have; engines
+// may not provide details.
+func (w *Waiter) progress(ctx context.Context, workflowId string, workflowNonce string, last string) string {
+	if w.OnProgress == nil {
+		return last
+	}
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	details, err := w.Client.GetDetails(ctx, &GetDetailsRequest{
+		WorkflowId:    workflowId,
+		WorkflowNonce: workflowNonce,
+	})
+	if err != nil {
+		return last
+	}
+	progress := details.WaitingOn()
+	for _, approval := range details.Approvals {
+		progress += "\n" + approval.Username
+	}
+	if progress != last {
+		w.OnProgress(details)
+	}
+	return progress
+}
+
+func (w *Waiter) stopped(ctx context.Context) error {
+	err := ErrCancelled
+	if ctx.Err() == context.DeadlineExceeded {
+		err = ErrTimedOut
+	}
+	if w.OnCancel != nil {
+		cancelCtx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+		defer cancel()
+		if cancelErr := w.OnCancel(cancelCtx); cancelErr != nil {
+			w.onError(errors.Wrap(cancelErr, "error cancelling workflow"))
+		}
+	}
+	return err
+}
+
+func (w *Waiter) onError(err error) {
+	if w.OnError != nil {
+		w.OnError(err)
+	}
+}
+
+func (w *Waiter) initialInterval() time.Duration {
+	if w.InitialInterval <= 0 {
+		return DefaultInitialInterval
+	}
+	return w.InitialInterval
+}
+
+func (w *Waiter) maxInterval() time.Duration {
+	if w.MaxInterval <= 0 {
+		return DefaultMaxInterval
+	}
+	return w.MaxInterval
+}
+
+func (w *Waiter) maxErrors() int {
+	if w.MaxErrors <= 0 {
+		return DefaultMaxErrors
+	}
+	return w.MaxErrors
+}
+
+func (w *Waiter) longPoll() time.Duration {
+	if w.LongPoll == 0 {
+		return DefaultLongPoll
+	}
+	return w.LongPoll
+}
+
+// jitter returns a random duration between d/2 and d, so that many
+// waiters don't poll in lockstep
+func jitter(d time.Duration) time.Duration {
+	half := int64(d / 2)
+	if half <= 0 {
+		return d
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,212 @@
+package workflow
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedEngine answers getAssertions with each response in turn,
+// repeating the last, and getDetails with details.
+type scriptedEngine struct {
+	mu        sync.Mutex
+	responses []scriptedResponse
+	polls     int
+	waits     []int
+	details   GetDetailsResponse
+}
+
+type scriptedResponse struct {
+	status int
+	body   interface{}
+	// For long polls
+	delay time.Duration
+}
+
+func (s *scriptedEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path == "/1/workflow/getDetails" {
+		json.NewEncoder(w).Encode(&s.details)
+		return
+	}
+	var req GetAssertionsRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	s.waits = append(s.waits, req.WaitSeconds)
+	resp := s.responses[len(s.responses)-1]
+	if s.polls < len(s.responses) {
+		resp = s.responses[s.polls]
+	}
+	s.polls++
+	time.Sleep(resp.delay)
+	w.WriteHeader(resp.status)
+	json.NewEncoder(w).Encode(resp.body)
+}
+
+func (s *scriptedEngine) pollCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.polls
+}
+
+func status(st string) scriptedResponse {
+	return scriptedResponse{status: http.StatusOK, body: &GetAssertionsResponse{Status: st}}
+}
+
+func failure(code int) scriptedResponse {
+	return scriptedResponse{status: code, body: map[string]string{"error": "failed"}}
+}
+
+func newTestWaiter(t *testing.T, engine *scriptedEngine) (*Waiter, func()) {
+	ts := httptest.NewServer(engine)
+	client, err := NewClient(ts.URL)
+	assert.NoError(t, err)
+	return &Waiter{
+		Client:          client,
+		InitialInterval: time.Millisecond,
+		MaxInterval:     5 * time.Millisecond,
+		LongPoll:        -1,
+	}, ts.Close
+}
+
+func TestWaiter_Completed(t *testing.T) {
+	engine := &scriptedEngine{
+		responses: []scriptedResponse{
+			status(StatusCreated),
+			failure(http.StatusServiceUnavailable),
+			status(StatusCreated),
+			{status: http.StatusOK, body: &GetAssertionsResponse{Status: StatusCompleted, Assertions: []string{"assertion"}}},
+		},
+		details: GetDetailsResponse{MissingApprovals: map[string]int{"security": 1}},
+	}
+	w, done := newTestWaiter(t, engine)
+	defer done()
+	var progress []string
+	var retried []error
+	w.OnProgress = func(details *GetDetailsResponse) { progress = append(progress, details.WaitingOn()) }
+	w.OnError = func(err error) { retried = append(retried, err) }
+
+	resp, err := w.Wait(context.Background(), "id", "nonce")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"assertion"}, resp.Assertions)
+	assert.Equal(t, 4, engine.pollCount())
+	// Only reported when it changes
+	assert.Equal(t, []string{"waiting on 1 more approval from security"}, progress)
+	assert.Len(t, retried, 1)
+}
+
+func TestWaiter_NotApproved(t *testing.T) {
+	w, done := newTestWaiter(t, &scriptedEngine{responses: []scriptedResponse{status(StatusRejected)}})
+	defer done()
+	resp, err := w.Wait(context.Background(), "id", "nonce")
+	assert.Equal(t, ErrRejected, err)
+	assert.Equal(t, StatusRejected, resp.Status)
+
+	w, done = newTestWaiter(t, &scriptedEngine{responses: []scriptedResponse{status(StatusCreated), status(StatusExpired)}})
+	defer done()
+	resp, err = w.Wait(context.Background(), "id", "nonce")
+	assert.Equal(t, ErrExpired, err)
+	assert.Equal(t, StatusExpired, resp.Status)
+
+	// Cancelled by someone else with the nonce
+	cancelled := 0
+	w, done = newTestWaiter(t, &scriptedEngine{responses: []scriptedResponse{status(StatusCancelled)}})
+	defer done()
+	w.OnCancel = func(context.Context) error {
+		cancelled++
+		return nil
+	}
+	_, err = w.Wait(context.Background(), "id", "nonce")
+	assert.Equal(t, ErrCancelled, err)
+	assert.Equal(t, 0, cancelled)
+}
+
+func TestWaiter_Errors(t *testing.T) {
+	// Not temporary, so not retried
+	engine := &scriptedEngine{responses: []scriptedResponse{failure(http.StatusForbidden)}}
+	w, done := newTestWaiter(t, engine)
+	defer done()
+	_, err := w.Wait(context.Background(), "id", "nonce")
+	var httpErr *HTTPError
+	assert.True(t, errors.As(err, &httpErr))
+	assert.Equal(t, http.StatusForbidden, httpErr.StatusCode)
+	assert.Equal(t, 1, engine.pollCount())
+
+	engine = &scriptedEngine{responses: []scriptedResponse{failure(http.StatusBadGateway)}}
+	w, done = newTestWaiter(t, engine)
+	defer done()
+	w.MaxErrors = 3
+	_, err = w.Wait(context.Background(), "id", "nonce")
+	assert.Error(t, err)
+	assert.Equal(t, 3, engine.pollCount())
+
+	w, done = newTestWaiter(t, &scriptedEngine{responses: []scriptedResponse{status("LOST")}})
+	defer done()
+	_, err = w.Wait(context.Background(), "id", "nonce")
+	assert.EqualError(t, err, "unexpected workflow status: LOST")
+}
+
+func TestWaiter_TimeoutAndCancel(t *testing.T) {
+	engine := &scriptedEngine{responses: []scriptedResponse{status(StatusCreated)}}
+	w, done := newTestWaiter(t, engine)
+	defer done()
+	cancelled := 0
+	w.OnCancel = func(ctx context.Context) error {
+		assert.NoError(t, ctx.Err())
+		cancelled++
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := w.Wait(ctx, "id", "nonce")
+	assert.Equal(t, ErrTimedOut, err)
+	assert.Equal(t, 1, cancelled)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	_, err = w.Wait(ctx, "id", "nonce")
+	assert.Equal(t, ErrCancelled, err)
+	assert.Equal(t, 2, cancelled)
+}
+
+func TestWaiter_LongPoll(t *testing.T) {
+	held := scriptedResponse{
+		status: http.StatusOK,
+		body:   &GetAssertionsResponse{Status: StatusCreated, LongPoll: true},
+		delay:  20 * time.Millisecond,
+	}
+	engine := &scriptedEngine{responses: []scriptedResponse{held, held, status(StatusCompleted)}}
+	w, done := newTestWaiter(t, engine)
+	defer done()
+	w.LongPoll = 15 * time.Second
+	w.InitialInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := w.Wait(ctx, "id", "nonce")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{15, 15, 15}, engine.waits)
+}
+
+func TestIsTemporary(t *testing.T) {
+	assert.True(t, IsTemporary(errors.Wrap(&HTTPError{StatusCode: http.StatusServiceUnavailable}, "http error")))
+	assert.True(t, IsTemporary(&HTTPError{StatusCode: http.StatusTooManyRequests}))
+	assert.False(t, IsTemporary(&HTTPError{StatusCode: http.StatusNotFound}))
+	assert.False(t, IsTemporary(errors.New("unmarshal error")))
+
+	client, err := NewClient("http://127.0.0.1:1")
+	assert.NoError(t, err)
+	_, err = client.GetAssertions(context.Background(), &GetAssertionsRequest{})
+	assert.True(t, IsTemporary(err))
+}
@@ -6,6 +6,7 @@ locals {
   config_bucket_name   = var.config_bucket_name == "" ? "km-${var.env_label}" : var.config_bucket_name
   lambda_function_name = var.lambda_function_name == "" ? "km-${var.env_label}" : var.lambda_function_name
   lambda_role_arn      = var.lambda_role_arn == "" ? aws_iam_role.km[0].arn : var.lambda_role_arn
+  replay_table_name    = var.replay_table_name == "" ? "km-${var.env_label}-replay" : var.replay_table_name
 }
 
 resource "aws_lambda_function" "km" {
@@ -53,3 +54,22 @@ resource "aws_s3_bucket_object" "km_config_file" {
   source = var.config_file_name
 }
 
+
+resource "aws_dynamodb_table" "km_replay" {
+  count        = var.replay_table_enable ? 1 : 0
+  name         = local.replay_table_name
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "replay_key"
+
+  attribute {
+    name = "replay_key"
+    type = "S"
+  }
+
+  ttl {
+    attribute_name = "expires_at"
+    enabled        = true
+  }
+
+  tags = merge({}, var.resource_tags)
+}
@@ -8,3 +8,8 @@ output "configuration_bucket_name" {
   value = var.config_bucket_enable ? aws_s3_bucket.km_config[0].bucket : ""
   description = "The name of the km configuration bucket. Will be empty if not configured."
 }
+
+output "replay_table_name" {
+  value = var.replay_table_enable ? aws_dynamodb_table.km_replay[0].name : ""
+  description = "The name of the km replay cache table. Will be empty if not configured."
+}
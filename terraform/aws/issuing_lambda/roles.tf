@@ -37,6 +37,14 @@ data "aws_iam_policy_document" "km" {
     effect    = "Allow"
     resources = var.target_role_arns
   }
+  dynamic "statement" {
+    for_each = aws_dynamodb_table.km_replay[*].arn
+    content {
+      actions   = ["dynamodb:PutItem"]
+      effect    = "Allow"
+      resources = [statement.value]
+    }
+  }
 }
 
 resource "aws_iam_role" "km" {
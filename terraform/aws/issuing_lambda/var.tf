@@ -93,3 +93,15 @@ variable "config_file_name" {
   default = ""
 }
 // TODO: kms key ARN for env var config
+
+variable "replay_table_enable" {
+  description = "Create the DynamoDB table used to prevent replay of approvals"
+  type = bool
+  default = false
+}
+
+variable "replay_table_name" {
+  description = "Name of the DynamoDB replay table"
+  type = string
+  default = ""
+}